@@ -0,0 +1,142 @@
+package log_v1
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io/ioutil"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec compresses and decompresses record batches.
+type Codec interface {
+	Compress(p []byte) ([]byte, error)
+	Decompress(p []byte) ([]byte, error)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[Compression]Codec{
+		Compression_GZIP:  gzipCodec{},
+		Compression_FLATE: flateCodec{},
+	}
+)
+
+// RegisterCodec makes the codec available for the given compression. It
+// replaces the codec already registered for it, if any, and must be called
+// on every node and consumer that handles the compression.
+func RegisterCodec(c Compression, codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c] = codec
+}
+
+// CodecFor returns the codec registered for the given compression.
+func CodecFor(c Compression) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	codec, ok := codecs[c]
+	if !ok {
+		return nil, ErrUnknownCompression{Compression: c}
+	}
+	return codec, nil
+}
+
+// Compress returns a record holding the records compressed as a single
+// batch. The records must have contiguous offsets.
+func Compress(records []*Record, c Compression) (*Record, error) {
+	codec, err := CodecFor(c)
+	if err != nil {
+		return nil, err
+	}
+	b, err := proto.Marshal(&RecordBatch{Records: records})
+	if err != nil {
+		return nil, err
+	}
+	if b, err = codec.Compress(b); err != nil {
+		return nil, err
+	}
+	batch := &Record{
+		Value:       b,
+		Offset:      records[0].Offset,
+		LastOffset:  records[len(records)-1].Offset,
+		Compression: c,
+	}
+	// the batch is as recent as its most recent record
+	for _, record := range records {
+		if batch.Timestamp == nil ||
+			record.Timestamp.AsTime().After(batch.Timestamp.AsTime()) {
+			batch.Timestamp = record.Timestamp
+		}
+	}
+	return batch, nil
+}
+
+// Decompress returns the records in a record holding a compressed batch. A
+// record that isn't compressed is returned as is.
+func Decompress(record *Record) ([]*Record, error) {
+	if record.Compression == Compression_NONE {
+		return []*Record{record}, nil
+	}
+	codec, err := CodecFor(record.Compression)
+	if err != nil {
+		return nil, err
+	}
+	b, err := codec.Decompress(record.Value)
+	if err != nil {
+		return nil, err
+	}
+	batch := &RecordBatch{}
+	if err = proto.Unmarshal(b, batch); err != nil {
+		return nil, err
+	}
+	return batch.Records, nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Compress(p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(p []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+type flateCodec struct{}
+
+func (flateCodec) Compress(p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(p); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCodec) Decompress(p []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(p))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
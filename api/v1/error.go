@@ -2,8 +2,10 @@ package log_v1
 
 import (
 	"fmt"
+	"strconv"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
@@ -31,3 +33,293 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+// ErrCorruptRecord is returned when a record read from a segment fails its
+// checksum, which means the bytes on disk were damaged after being written.
+type ErrCorruptRecord struct {
+	Offset     uint64
+	BaseOffset uint64
+	Position   uint64
+}
+
+func (e ErrCorruptRecord) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.DataLoss,
+		fmt.Sprintf("corrupt record at offset: %d", e.Offset),
+	)
+
+	msg := fmt.Sprintf(
+		"The record at offset %d is corrupt (segment %d, position %d)",
+		e.Offset,
+		e.BaseOffset,
+		e.Position,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+
+	return std
+}
+
+func (e ErrCorruptRecord) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrUnknownCompression is returned for a compression without a registered
+// codec.
+type ErrUnknownCompression struct {
+	Compression Compression
+}
+
+func (e ErrUnknownCompression) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("unknown compression: %d", e.Compression),
+	)
+
+	msg := fmt.Sprintf(
+		"No codec is registered for compression %d",
+		e.Compression,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+
+	return std
+}
+
+func (e ErrUnknownCompression) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrTopicNotFound struct {
+	Topic string
+}
+
+func (e ErrTopicNotFound) GRPCStatus() *status.Status {
+	return status.New(
+		codes.NotFound,
+		fmt.Sprintf("topic not found: %q", e.Topic),
+	)
+}
+
+func (e ErrTopicNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrTopicExists struct {
+	Topic string
+}
+
+func (e ErrTopicExists) GRPCStatus() *status.Status {
+	return status.New(
+		codes.AlreadyExists,
+		fmt.Sprintf("topic already exists: %q", e.Topic),
+	)
+}
+
+func (e ErrTopicExists) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrInvalidTopic struct {
+	Topic string
+}
+
+func (e ErrInvalidTopic) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("invalid topic: %q", e.Topic),
+	)
+
+	msg := fmt.Sprintf(
+		"Topic names are 1 to %d letters, digits, '.', '_' or '-', and can't be '.' or '..'",
+		MaxTopicLen,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+
+	return std
+}
+
+func (e ErrInvalidTopic) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrPartitionOutOfRange struct {
+	Partition  uint32
+	Partitions uint32
+}
+
+func (e ErrPartitionOutOfRange) GRPCStatus() *status.Status {
+	return status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf(
+			"partition out of range: %d, topics have %d partitions",
+			e.Partition,
+			e.Partitions,
+		),
+	)
+}
+
+func (e ErrPartitionOutOfRange) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrStaleSequence is returned for a producer's request whose sequence
+// number is lower than the producer's last, see Producer. The request may
+// or may not have been appended when it was first sent, its offsets are
+// lost.
+type ErrStaleSequence struct {
+	Producer     string
+	Sequence     uint64
+	LastSequence uint64
+}
+
+func (e ErrStaleSequence) GRPCStatus() *status.Status {
+	return status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf(
+			"stale sequence for producer %q: %d, last sequence is %d",
+			e.Producer,
+			e.Sequence,
+			e.LastSequence,
+		),
+	)
+}
+
+func (e ErrStaleSequence) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrTransactionNotFound struct {
+	Transaction string
+}
+
+func (e ErrTransactionNotFound) GRPCStatus() *status.Status {
+	return status.New(
+		codes.NotFound,
+		fmt.Sprintf("open transaction not found: %q", e.Transaction),
+	)
+}
+
+func (e ErrTransactionNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrTransactionExists struct {
+	Transaction string
+}
+
+func (e ErrTransactionExists) GRPCStatus() *status.Status {
+	return status.New(
+		codes.AlreadyExists,
+		fmt.Sprintf("transaction already open: %q", e.Transaction),
+	)
+}
+
+func (e ErrTransactionExists) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrUnexpectedOffset is returned for a conditional append whose expected
+// offset isn't the offset the log is at, see ProduceRequest's
+// expected_offset, or the key is at if Key is set, see its
+// expected_key_offset. The status details hold the offsets, the actual one
+// as the actual_offset metadata of an ErrorInfo.
+type ErrUnexpectedOffset struct {
+	Topic    string
+	Key      []byte
+	Expected uint64
+	Actual   uint64
+}
+
+func (e ErrUnexpectedOffset) GRPCStatus() *status.Status {
+	msg := fmt.Sprintf(
+		"unexpected offset for topic %q: expected %d, log is at %d",
+		e.Topic,
+		e.Expected,
+		e.Actual,
+	)
+	if e.Key != nil {
+		msg = fmt.Sprintf(
+			"unexpected offset for key %q of topic %q: expected %d, key is at %d",
+			e.Key,
+			e.Topic,
+			e.Expected,
+			e.Actual,
+		)
+	}
+	st := status.New(codes.FailedPrecondition, msg)
+
+	d := &errdetails.ErrorInfo{
+		Reason: "UNEXPECTED_OFFSET",
+		Domain: "proglog",
+		Metadata: map[string]string{
+			"expected_offset": strconv.FormatUint(e.Expected, 10),
+			"actual_offset":   strconv.FormatUint(e.Actual, 10),
+		},
+	}
+
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+
+	return std
+}
+
+func (e ErrUnexpectedOffset) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrNotLeader is returned for requests that only the leader can serve.
+// Leader is the address of the leader, if known, in the status details as
+// the leader metadata of an ErrorInfo.
+type ErrNotLeader struct {
+	Leader string
+}
+
+func (e ErrNotLeader) GRPCStatus() *status.Status {
+	msg := "not the leader, the leader is unknown"
+	if e.Leader != "" {
+		msg = fmt.Sprintf("not the leader, the leader is at %s", e.Leader)
+	}
+	st := status.New(codes.Unavailable, msg)
+
+	d := &errdetails.ErrorInfo{
+		Reason:   "NOT_LEADER",
+		Domain:   "proglog",
+		Metadata: map[string]string{"leader": e.Leader},
+	}
+
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+
+	return std
+}
+
+func (e ErrNotLeader) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
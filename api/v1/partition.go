@@ -0,0 +1,19 @@
+package log_v1
+
+import "hash/fnv"
+
+// MaxPartitions is the max number of partitions topics can be split into.
+const MaxPartitions = 256
+
+// Partition returns the partition, out of the given number of partitions,
+// that records with the key are produced to when the request doesn't name
+// one. Records without a key go to the first partition. Clients use it to
+// send keyed records to their partition's leader.
+func Partition(key []byte, partitions uint32) uint32 {
+	if len(key) == 0 || partitions <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write(key)
+	return h.Sum32() % partitions
+}
@@ -0,0 +1,22 @@
+package log_v1
+
+// MaxTopicLen is the max length of topic names.
+const MaxTopicLen = 249
+
+// ValidTopic returns whether name is a valid topic name: 1 to MaxTopicLen
+// letters, digits, '.', '_' or '-'. Topics are stored in directories named
+// after them, so "." and ".." aren't valid.
+func ValidTopic(name string) bool {
+	if name == "" || len(name) > MaxTopicLen || name == "." || name == ".." {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '.', c == '_', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	api "github.com/dikaeinstein/proglog/api/v1"
+	plog "github.com/dikaeinstein/proglog/internal/log"
+)
+
+// logCmd returns the log command, which inspects a stopped node's log
+// without changing it, or repairs it.
+func logCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "log",
+		Short: "Inspect or repair the log in a stopped node's data directory.",
+	}
+	cmd.PersistentFlags().String("data-dir",
+		path.Join(os.TempDir(), "proglog"),
+		"Directory the log and Raft data are stored in.")
+	cmd.PersistentFlags().String("topic",
+		"",
+		"Topic whose log to inspect, the default topic if empty.")
+	cmd.PersistentFlags().Int("partition",
+		0,
+		"Partition whose log to inspect.")
+	cmd.PersistentFlags().Bool("raft",
+		false,
+		"Inspect Raft's log rather than the records'.")
+	cmd.PersistentFlags().String("keyring-file",
+		"",
+		"Keyring file the log segments are encrypted with.")
+
+	segments := &cobra.Command{
+		Use:   "segments",
+		Short: "List the segments with their offsets and sizes as JSON.",
+		RunE: withInspector(func(
+			cmd *cobra.Command,
+			i *plog.Inspector,
+		) error {
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			for _, s := range i.Segments() {
+				if err := enc.Encode(s); err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+	}
+
+	dump := &cobra.Command{
+		Use:   "dump",
+		Short: "Print the records in an offset range as JSON.",
+		RunE: withInspector(func(
+			cmd *cobra.Command,
+			i *plog.Inspector,
+		) error {
+			from, err := cmd.Flags().GetUint64("from")
+			if err != nil {
+				return err
+			}
+			to, err := cmd.Flags().GetUint64("to")
+			if err != nil {
+				return err
+			}
+			out := cmd.OutOrStdout()
+			return i.Records(from, to, func(record *api.Record) error {
+				b, err := protojson.Marshal(record)
+				if err != nil {
+					return err
+				}
+				_, err = fmt.Fprintf(out, "%s\n", b)
+				return err
+			})
+		}),
+	}
+	dump.Flags().Uint64("from", 0, "First offset to print.")
+	dump.Flags().Uint64("to",
+		math.MaxUint64,
+		"Offset to stop printing at, excluded.")
+
+	verify := &cobra.Command{
+		Use:   "verify",
+		Short: "Check that every index entry points at a decodable record.",
+		// the problems are the output, not the usage
+		SilenceUsage: true,
+		RunE: withInspector(func(
+			cmd *cobra.Command,
+			i *plog.Inspector,
+		) error {
+			problems := i.Verify()
+			for _, problem := range problems {
+				fmt.Fprintln(cmd.OutOrStdout(), problem)
+			}
+			if len(problems) > 0 {
+				return fmt.Errorf("found %d problems", len(problems))
+			}
+			return nil
+		}),
+	}
+
+	reindex := &cobra.Command{
+		Use:   "reindex",
+		Short: "Rebuild the segments' indexes from their stores.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir, k, err := logFlags(cmd)
+			if err != nil {
+				return err
+			}
+			c := plog.Config{}
+			c.Segment.Keyring = k
+			return plog.RebuildIndexes(dir, c)
+		},
+	}
+
+	cmd.AddCommand(segments, dump, verify, reindex)
+	return cmd
+}
+
+// withInspector returns a run function that calls fn with an inspector of
+// the log named by the command's flags.
+func withInspector(
+	fn func(cmd *cobra.Command, i *plog.Inspector) error,
+) func(cmd *cobra.Command, args []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		dir, k, err := logFlags(cmd)
+		if err != nil {
+			return err
+		}
+		i, err := plog.Inspect(dir, k)
+		if err != nil {
+			return err
+		}
+		defer i.Close()
+		return fn(cmd, i)
+	}
+}
+
+// logFlags returns the directory of the log named by the command's flags
+// and the keyring it's encrypted with, if any.
+func logFlags(cmd *cobra.Command) (dir string, k *plog.Keyring, err error) {
+	dataDir, err := cmd.Flags().GetString("data-dir")
+	if err != nil {
+		return "", nil, err
+	}
+	topic, err := cmd.Flags().GetString("topic")
+	if err != nil {
+		return "", nil, err
+	}
+	partition, err := cmd.Flags().GetInt("partition")
+	if err != nil {
+		return "", nil, err
+	}
+	raft, err := cmd.Flags().GetBool("raft")
+	if err != nil {
+		return "", nil, err
+	}
+	keyringFile, err := cmd.Flags().GetString("keyring-file")
+	if err != nil {
+		return "", nil, err
+	}
+	if partition > 0 {
+		dataDir = filepath.Join(dataDir, "partitions", strconv.Itoa(partition))
+	}
+	dir = filepath.Join(dataDir, "log")
+	if topic != "" {
+		if !api.ValidTopic(topic) {
+			return "", nil, api.ErrInvalidTopic{Topic: topic}
+		}
+		dir = filepath.Join(dataDir, "topics", topic)
+	}
+	if raft {
+		dir = filepath.Join(dataDir, "raft", "log")
+	}
+	if keyringFile != "" {
+		if k, err = plog.LoadKeyring(keyringFile); err != nil {
+			return "", nil, err
+		}
+	}
+	return dir, k, nil
+}
@@ -8,12 +8,14 @@ import (
 	"os/signal"
 	"path"
 	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
 	"github.com/dikaeinstein/proglog/internal/agent"
 	"github.com/dikaeinstein/proglog/internal/config"
+	plog "github.com/dikaeinstein/proglog/internal/log"
 )
 
 func main() {
@@ -26,6 +28,7 @@ func main() {
 	if err := setupFlags(cmd); err != nil {
 		log.Fatal(err)
 	}
+	cmd.AddCommand(logCmd())
 	if err := cmd.Execute(); err != nil {
 		log.Fatal(err)
 	}
@@ -81,6 +84,62 @@ func setupFlags(cmd *cobra.Command) error {
 		"Serf addresses to join.")
 	cmd.Flags().Bool("bootstrap", false, "Bootstrap the cluster.")
 
+	cmd.Flags().String("storage-engine",
+		string(plog.EngineSegment),
+		"Storage engine to keep the log in: segment or memory. "+
+			"Memory nodes keep nothing across restarts.")
+	cmd.Flags().String("segment-sync-policy",
+		string(plog.SyncOS),
+		"When to fsync appended records: os, always or periodic.")
+	cmd.Flags().Duration("segment-sync-interval",
+		10*time.Millisecond,
+		"Time between the fsyncs appends wait for with the periodic sync policy.")
+	cmd.Flags().Uint64("segment-sync-bytes",
+		0,
+		"Bytes appended that trigger an fsync early with the periodic sync policy.")
+
+	cmd.Flags().Uint64("retention-bytes",
+		0,
+		"Max bytes of log to keep, 0 keeps everything.")
+	cmd.Flags().Duration("retention-age",
+		0,
+		"Max age of log segments to keep, 0 keeps them forever.")
+
+	cmd.Flags().String("offload-dir",
+		"",
+		"Directory to offload sealed log segments to, empty keeps them local.")
+	cmd.Flags().Duration("offload-local-retention",
+		0,
+		"How long offloaded log segments are kept locally.")
+	cmd.Flags().Uint64("offload-cache-bytes",
+		0,
+		"Max bytes of offloaded log segments cached locally to be read.")
+	cmd.Flags().String("keyring-file",
+		"",
+		"Keyring file to encrypt log segments with, empty leaves them unencrypted.")
+	cmd.Flags().Int("partitions",
+		1,
+		"Number of partitions topics are split into, the same on every node.")
+	cmd.Flags().Duration("transaction-timeout",
+		time.Minute,
+		"Max time a transaction may stay open before the leader aborts it, 0 never aborts it.")
+	cmd.Flags().Duration("consume-stream-max-wait",
+		time.Second,
+		"Max time a streaming consumer waits for a record before checking the log again.")
+
+	cmd.Flags().Float64("disk-high-watermark",
+		0,
+		"Share of the data dir's disk, 0 to 1, above which produce requests are rejected, 0 never rejects them.")
+	cmd.Flags().Float64("disk-low-watermark",
+		0,
+		"Share of the data dir's disk below which produce requests are accepted again, defaults to 5 points below the high watermark.")
+	cmd.Flags().Duration("disk-check-interval",
+		10*time.Second,
+		"How often the data dir's disk usage is checked.")
+	cmd.Flags().Bool("forward-produce",
+		false,
+		"Forward produce requests that reach a follower to the leader, with the peer TLS config.")
+
 	cmd.Flags().String("acl-model-file", "", "Path to ACL model.")
 	cmd.Flags().String("acl-policy-file", "", "Path to ACL policy.")
 
@@ -122,6 +181,33 @@ func (c *cli) setupConfig(cmd *cobra.Command, args []string) error {
 	c.cfg.RPCPort = viper.GetInt("rpc-port")
 	c.cfg.StartJoinAddrs = viper.GetStringSlice("start-join-addrs")
 	c.cfg.Bootstrap = viper.GetBool("bootstrap")
+	c.cfg.StorageEngine, err = plog.ParseEngine(
+		viper.GetString("storage-engine"),
+	)
+	if err != nil {
+		return err
+	}
+	c.cfg.SyncPolicy, err = plog.ParseSyncPolicy(
+		viper.GetString("segment-sync-policy"),
+	)
+	if err != nil {
+		return err
+	}
+	c.cfg.SyncInterval = viper.GetDuration("segment-sync-interval")
+	c.cfg.SyncBytes = viper.GetUint64("segment-sync-bytes")
+	c.cfg.RetentionBytes = viper.GetUint64("retention-bytes")
+	c.cfg.RetentionAge = viper.GetDuration("retention-age")
+	c.cfg.OffloadDir = viper.GetString("offload-dir")
+	c.cfg.OffloadLocalRetention = viper.GetDuration("offload-local-retention")
+	c.cfg.OffloadCacheBytes = viper.GetUint64("offload-cache-bytes")
+	c.cfg.KeyringFile = viper.GetString("keyring-file")
+	c.cfg.Partitions = viper.GetInt("partitions")
+	c.cfg.TransactionTimeout = viper.GetDuration("transaction-timeout")
+	c.cfg.ConsumeStreamMaxWait = viper.GetDuration("consume-stream-max-wait")
+	c.cfg.DiskHighWatermark = viper.GetFloat64("disk-high-watermark")
+	c.cfg.DiskLowWatermark = viper.GetFloat64("disk-low-watermark")
+	c.cfg.DiskCheckInterval = viper.GetDuration("disk-check-interval")
+	c.cfg.ForwardProduce = viper.GetBool("forward-produce")
 	c.cfg.ACLModelFile = viper.GetString("acl-model-file")
 	c.cfg.ACLPolicyFile = viper.GetString("acl-policy-file")
 	c.cfg.ServerTLSConfig.CertFile = viper.GetString("server-tls-cert-file")
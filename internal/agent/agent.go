@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -14,6 +15,7 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 
+	api "github.com/dikaeinstein/proglog/api/v1"
 	"github.com/dikaeinstein/proglog/internal/auth"
 	"github.com/dikaeinstein/proglog/internal/discovery"
 	"github.com/dikaeinstein/proglog/internal/log"
@@ -35,6 +37,51 @@ type Config struct {
 	StartJoinAddrs []string
 	ACLModelFile   string
 	ACLPolicyFile  string
+	// StorageEngine is the engine the log is kept in, see log.Config.
+	StorageEngine log.Engine
+	// SyncPolicy, SyncInterval and SyncBytes control when appended records
+	// are fsynced, see log.Config.
+	SyncPolicy   log.SyncPolicy
+	SyncInterval time.Duration
+	SyncBytes    uint64
+	// RetentionBytes and RetentionAge limit how much of the log is kept,
+	// see log.Config.
+	RetentionBytes uint64
+	RetentionAge   time.Duration
+	// OffloadDir, if set, is where sealed segments are offloaded to, in a
+	// directory per node. OffloadLocalRetention and OffloadCacheBytes
+	// control how much of the offloaded log stays on local disk, see
+	// log.Config.
+	OffloadDir            string
+	OffloadLocalRetention time.Duration
+	OffloadCacheBytes     uint64
+	// KeyringFile, if set, names the keyring log segments are encrypted
+	// with, see log.LoadKeyring.
+	KeyringFile string
+	// Partitions is the number of partitions topics are split into, each
+	// replicated by a Raft group of its own. Defaults to one. Every agent of
+	// a cluster must have the same number of partitions.
+	Partitions int
+	// TransactionTimeout, if set, is how long transactions may stay open
+	// before the leader aborts them, see log.Config.
+	TransactionTimeout time.Duration
+	// ConsumeStreamMaxWait is the longest a streaming consumer waits for a
+	// record before the log is checked again, see server.Config.
+	ConsumeStreamMaxWait time.Duration
+	// DiskHighWatermark, if set, is the share of DataDir's disk, from 0 to
+	// 1, above which produce requests are rejected. They're accepted again
+	// below DiskLowWatermark, which defaults to 5 points below the high
+	// watermark. The disk is checked every DiskCheckInterval, ten seconds
+	// by default.
+	DiskHighWatermark float64
+	DiskLowWatermark  float64
+	DiskCheckInterval time.Duration
+	// ForwardProduce, if set, has followers forward the produce requests
+	// they get to their leader, connecting with PeerTLSConfig, rather than
+	// fail them with a NotLeader status naming the leader. The leader
+	// authorizes them as the clients that sent them, trusting followers
+	// whose peer identity the ACL allows to forward.
+	ForwardProduce bool
 	// START: config
 	Bootstrap bool
 	// END: config
@@ -53,9 +100,11 @@ type Agent struct {
 	Config Config
 
 	mux        cmux.CMux
-	log        *log.DistributedLog
+	log        *log.PartitionedLog
 	server     *grpc.Server
 	membership *discovery.Membership
+	diskGuard  *server.DiskGuard
+	forwarder  *server.PeerForwarder
 
 	shutdown     bool
 	shutdowns    chan struct{}
@@ -115,20 +164,36 @@ func (a *Agent) setupMux() error {
 }
 
 func (a *Agent) setupLog() error {
-	raftLn := a.mux.Match(func(reader io.Reader) bool {
-		b := make([]byte, 1)
-		if _, err := reader.Read(b); err != nil {
-			return false
-		}
-		return bytes.Equal(b, []byte{byte(log.RaftRPC)})
-	})
+	partitions := a.Config.Partitions
+	if partitions == 0 {
+		partitions = 1
+	}
+	if partitions > api.MaxPartitions {
+		return fmt.Errorf(
+			"partitions: %d, want at most %d",
+			partitions, api.MaxPartitions,
+		)
+	}
+	// raft connections name their partition after the RaftRPC byte
+	var streamLayers []*log.StreamLayer
+	for p := 0; p < partitions; p++ {
+		header := []byte{byte(log.RaftRPC), byte(p)}
+		raftLn := a.mux.Match(func(reader io.Reader) bool {
+			b := make([]byte, len(header))
+			if _, err := io.ReadFull(reader, b); err != nil {
+				return false
+			}
+			return bytes.Equal(b, header)
+		})
+		streamLayers = append(streamLayers, log.NewPartitionStreamLayer(
+			raftLn,
+			uint8(p),
+			a.Config.ServerTLSConfig,
+			a.Config.PeerTLSConfig,
+		))
+	}
 
 	logConfig := log.Config{}
-	logConfig.Raft.StreamLayer = log.NewStreamLayer(
-		raftLn,
-		a.Config.ServerTLSConfig,
-		a.Config.PeerTLSConfig,
-	)
 	rpcAddr, err := a.Config.RPCAddr()
 	if err != nil {
 		return err
@@ -137,10 +202,29 @@ func (a *Agent) setupLog() error {
 	logConfig.Raft.LocalID = raft.ServerID(a.Config.NodeName)
 	logConfig.Raft.Bootstrap = a.Config.Bootstrap
 	logConfig.Raft.CommitTimeout = 1000 * time.Millisecond
+	logConfig.Engine = a.Config.StorageEngine
+	logConfig.Segment.Sync = a.Config.SyncPolicy
+	logConfig.Segment.SyncInterval = a.Config.SyncInterval
+	logConfig.Segment.SyncBytes = a.Config.SyncBytes
+	logConfig.Segment.RetentionBytes = a.Config.RetentionBytes
+	logConfig.Segment.RetentionAge = a.Config.RetentionAge
+	logConfig.Segment.KeyringFile = a.Config.KeyringFile
+	logConfig.TransactionTimeout = a.Config.TransactionTimeout
+	if a.Config.OffloadDir != "" {
+		logConfig.Segment.ObjectStore, err = log.NewLocalObjectStore(
+			filepath.Join(a.Config.OffloadDir, a.Config.NodeName),
+		)
+		if err != nil {
+			return err
+		}
+		logConfig.Segment.LocalRetention = a.Config.OffloadLocalRetention
+		logConfig.Segment.RemoteCacheBytes = a.Config.OffloadCacheBytes
+	}
 
-	a.log, err = log.NewDistributedLog(
+	a.log, err = log.NewPartitionedLog(
 		a.Config.DataDir,
 		logConfig,
+		streamLayers,
 	)
 	if err != nil {
 		return err
@@ -151,15 +235,49 @@ func (a *Agent) setupLog() error {
 	return nil
 }
 
+func (a *Agent) setupDiskGuard() error {
+	low := a.Config.DiskLowWatermark
+	if low == 0 {
+		low = a.Config.DiskHighWatermark - 0.05
+	}
+	interval := a.Config.DiskCheckInterval
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+	var err error
+	a.diskGuard, err = server.NewDiskGuard(
+		a.Config.DataDir,
+		a.Config.DiskHighWatermark,
+		low,
+		interval,
+	)
+	return err
+}
+
 func (a *Agent) setupServer() error {
 	authorizer := auth.New(
 		a.Config.ACLModelFile,
 		a.Config.ACLPolicyFile,
 	)
+	partitions := a.log.Partitions()
 	serverConfig := &server.Config{
-		CommitLog:   a.log,
-		Authorizer:  authorizer,
-		GetServerer: a.log,
+		CommitLog:            partitions[0],
+		Authorizer:           authorizer,
+		GetServerer:          a.log,
+		ConsumeStreamMaxWait: a.Config.ConsumeStreamMaxWait,
+	}
+	for _, partition := range partitions {
+		serverConfig.Partitions = append(serverConfig.Partitions, partition)
+	}
+	if a.Config.DiskHighWatermark > 0 {
+		if err := a.setupDiskGuard(); err != nil {
+			return err
+		}
+		serverConfig.WriteGuard = a.diskGuard
+	}
+	if a.Config.ForwardProduce {
+		a.forwarder = server.NewPeerForwarder(a.Config.PeerTLSConfig)
+		serverConfig.Forwarder = a.forwarder
 	}
 	var opts []grpc.ServerOption
 	if a.Config.ServerTLSConfig != nil {
@@ -227,6 +345,18 @@ func (a *Agent) Shutdown() error {
 			a.server.GracefulStop()
 			return nil
 		},
+		func() error {
+			if a.diskGuard == nil {
+				return nil
+			}
+			return a.diskGuard.Close()
+		},
+		func() error {
+			if a.forwarder == nil {
+				return nil
+			}
+			return a.forwarder.Close()
+		},
 		a.log.Close,
 	}
 	for _, fn := range shutdown {
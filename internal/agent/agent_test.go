@@ -1,6 +1,7 @@
 package agent_test
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"fmt"
@@ -73,6 +74,8 @@ func TestAgent(t *testing.T) {
 			ACLPolicyFile:   config.ACLPolicyFile,
 			ServerTLSConfig: serverTLSConfig,
 			PeerTLSConfig:   peerTLSConfig,
+			Partitions:      3,
+			ForwardProduce:  true,
 		})
 		require.NoError(t, err)
 
@@ -126,6 +129,80 @@ func TestAgent(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, consumeResponse.Record.Value, []byte("foo"))
 	// END: test_change
+
+	// every agent leads a partition once leadership is balanced, the one
+	// its place in the order of the servers' IDs is meant to lead. The
+	// picker only routes produce and consume calls
+	rpcAddr, err := agents[0].Config.RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.Dial(
+		rpcAddr,
+		grpc.WithTransportCredentials(credentials.NewTLS(peerTLSConfig)),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Eventually(t, func() bool {
+		res, err := api.NewLogClient(conn).GetServers(
+			context.Background(),
+			&api.GetServersRequest{},
+		)
+		if err != nil || res.Partitions != 3 {
+			return false
+		}
+		for _, server := range res.Servers {
+			if len(server.LeaderPartitions) != 1 ||
+				fmt.Sprint(server.LeaderPartitions[0]) != server.Id {
+				return false
+			}
+		}
+		return len(res.Servers) == 3
+	}, 10*time.Second, 100*time.Millisecond)
+
+	key := []byte("bar")
+	partition := api.Partition(key, 3)
+	ctx := loadbalance.WithPartition(context.Background(), partition)
+	produceResponse, err = leaderClient.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("bar"), Key: key},
+	})
+	require.NoError(t, err)
+	require.Equal(t, partition, produceResponse.Partition)
+	require.Eventually(t, func() bool {
+		consumeResponse, err = followerClient.Consume(
+			context.Background(),
+			&api.ConsumeRequest{
+				Partition: partition,
+				Offset:    produceResponse.Offset,
+			},
+		)
+		return err == nil &&
+			bytes.Equal(consumeResponse.Record.Value, []byte("bar"))
+	}, 3*time.Second, 100*time.Millisecond)
+
+	// followers forward produce requests without the picker to the leader,
+	// once they know it again if an election is under way
+	for _, agent := range agents {
+		rpcAddr, err := agent.Config.RPCAddr()
+		require.NoError(t, err)
+		conn, err := grpc.Dial(
+			rpcAddr,
+			grpc.WithTransportCredentials(credentials.NewTLS(peerTLSConfig)),
+		)
+		require.NoError(t, err)
+		defer conn.Close()
+		for p := uint32(0); p < 3; p++ {
+			p := p
+			require.Eventually(t, func() bool {
+				res, err := api.NewLogClient(conn).Produce(
+					context.Background(),
+					&api.ProduceRequest{
+						Record:    &api.Record{Value: []byte("forwarded")},
+						Partition: &p,
+					},
+				)
+				return err == nil && res.Partition == p
+			}, 5*time.Second, 100*time.Millisecond)
+		}
+	}
 }
 
 // START: client
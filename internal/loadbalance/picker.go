@@ -1,6 +1,7 @@
 package loadbalance
 
 import (
+	"context"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -12,6 +13,7 @@ import (
 type Picker struct {
 	mu        sync.RWMutex
 	leader    balancer.SubConn
+	leaders   map[uint32]balancer.SubConn
 	followers []balancer.SubConn
 	current   uint64
 }
@@ -27,7 +29,14 @@ func (p *Picker) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	var followers []balancer.SubConn
+	p.leaders = make(map[uint32]balancer.SubConn)
 	for sc, scInfo := range buildInfo.ReadySCs {
+		partitions, _ := scInfo.Address.Attributes.Value(
+			"leader_partitions",
+		).([]uint32)
+		for _, partition := range partitions {
+			p.leaders[partition] = sc
+		}
 		isLeader := scInfo.Address.Attributes.Value("is_leader").(bool)
 		if isLeader {
 			p.leader = sc
@@ -45,7 +54,18 @@ func (p *Picker) Pick(info balancer.PickInfo) (
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 	var result balancer.PickResult
+	// topics are created, deleted and listed through Raft, like records
+	// are produced and transactions begun and ended
 	if strings.Contains(info.FullMethodName, "Produce") ||
+		strings.Contains(info.FullMethodName, "Transaction") ||
+		strings.Contains(info.FullMethodName, "Consume") &&
+			fromLeader(info.Ctx) {
+		result.SubConn = p.leader
+		if partition, ok := partitionFrom(info.Ctx); ok &&
+			p.leaders[partition] != nil {
+			result.SubConn = p.leaders[partition]
+		}
+	} else if strings.Contains(info.FullMethodName, "Topic") ||
 		len(p.followers) == 0 {
 		result.SubConn = p.leader
 	} else if strings.Contains(info.FullMethodName, "Consume") {
@@ -63,3 +83,40 @@ func (p *Picker) nextFollower() balancer.SubConn {
 	idx := int(cur % len)
 	return p.followers[idx]
 }
+
+type partitionKey struct{}
+
+// WithPartition returns a context that has produce and transaction calls,
+// and consume calls made WithLeader, made with it sent to the leader of the
+// partition, rather than of the first partition. It should be the partition
+// produced to, either the request's or the one the record's key hashes to,
+// see log_v1.Partition, or the transaction's.
+func WithPartition(ctx context.Context, partition uint32) context.Context {
+	return context.WithValue(ctx, partitionKey{}, partition)
+}
+
+func partitionFrom(ctx context.Context) (uint32, bool) {
+	if ctx == nil {
+		return 0, false
+	}
+	partition, ok := ctx.Value(partitionKey{}).(uint32)
+	return partition, ok
+}
+
+type leaderKey struct{}
+
+// WithLeader returns a context that has consume calls made with it sent to
+// the leader of the partition, see WithPartition, rather than to a
+// follower. Linearizable consume requests must be sent to the leader, see
+// log_v1.Consistency.
+func WithLeader(ctx context.Context) context.Context {
+	return context.WithValue(ctx, leaderKey{}, true)
+}
+
+func fromLeader(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+	leader, _ := ctx.Value(leaderKey{}).(bool)
+	return leader
+}
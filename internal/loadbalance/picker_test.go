@@ -1,6 +1,7 @@
 package loadbalance_test
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -49,6 +50,79 @@ func TestPickerProducesToLeader(t *testing.T) {
 	}
 }
 
+func TestPickerManagesTopicsOnLeader(t *testing.T) {
+	picker, subConns := setupTest()
+	for _, method := range []string{
+		"/log.vX.Log/CreateTopic",
+		"/log.vX.Log/DeleteTopic",
+		"/log.vX.Log/ListTopics",
+	} {
+		info := balancer.PickInfo{
+			FullMethodName: method,
+		}
+		gotPick, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.Equal(t, subConns[0], gotPick.SubConn)
+	}
+}
+
+func TestPickerProducesToPartitionLeader(t *testing.T) {
+	buildInfo := base.PickerBuildInfo{
+		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
+	}
+	var subConns []*subConn
+	for i := 0; i < 3; i++ {
+		sc := &subConn{}
+		// 0th sub conn leads the first partition, 2nd the second, and
+		// the third partition has no leader yet
+		addr := resolver.Address{
+			Attributes: attributes.New("is_leader", i == 0),
+		}
+		if i == 2 {
+			addr.Attributes = addr.Attributes.WithValues(
+				"leader_partitions", []uint32{1},
+			)
+		}
+		sc.UpdateAddresses([]resolver.Address{addr})
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: addr}
+		subConns = append(subConns, sc)
+	}
+	picker := &loadbalance.Picker{}
+	picker.Build(buildInfo)
+
+	for partition, want := range []int{0, 2, 0} {
+		for _, method := range []string{
+			"/log.vX.Log/Produce",
+			"/log.vX.Log/BeginTransaction",
+			"/log.vX.Log/CommitTransaction",
+		} {
+			info := balancer.PickInfo{
+				FullMethodName: method,
+				Ctx: loadbalance.WithPartition(
+					context.Background(),
+					uint32(partition),
+				),
+			}
+			gotPick, err := picker.Pick(info)
+			require.NoError(t, err)
+			require.Equal(t, subConns[want], gotPick.SubConn)
+		}
+	}
+}
+
+func TestPickerConsumesFromLeader(t *testing.T) {
+	picker, subConns := setupTest()
+	for i := 0; i < 5; i++ {
+		info := balancer.PickInfo{
+			FullMethodName: "/log.vX.Log/Consume",
+			Ctx:            loadbalance.WithLeader(context.Background()),
+		}
+		gotPick, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.Equal(t, subConns[0], gotPick.SubConn)
+	}
+}
+
 func TestPickerConsumesFromFollowers(t *testing.T) {
 	picker, subConns := setupTest()
 	info := balancer.PickInfo{
@@ -80,6 +80,8 @@ func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
 			Attributes: attributes.New(
 				"is_leader",
 				server.IsLeader,
+				"leader_partitions",
+				server.LeaderPartitions,
 			),
 		})
 	}
@@ -73,11 +73,17 @@ func TestResolver(t *testing.T) {
 
 	wantState := resolver.State{
 		Addresses: []resolver.Address{{
-			Addr:       "localhost:9001",
-			Attributes: attributes.New("is_leader", true),
+			Addr: "localhost:9001",
+			Attributes: attributes.New(
+				"is_leader", true,
+				"leader_partitions", []uint32{0, 2},
+			),
 		}, {
-			Addr:       "localhost:9002",
-			Attributes: attributes.New("is_leader", false),
+			Addr: "localhost:9002",
+			Attributes: attributes.New(
+				"is_leader", false,
+				"leader_partitions", []uint32{1},
+			),
 		}},
 	}
 	require.Equal(t, wantState, conn.state)
@@ -90,12 +96,14 @@ type getServers struct{}
 
 func (s *getServers) GetServers() ([]*api.Server, error) {
 	return []*api.Server{{
-		Id:       "leader",
-		RpcAddr:  "localhost:9001",
-		IsLeader: true,
+		Id:               "leader",
+		RpcAddr:          "localhost:9001",
+		IsLeader:         true,
+		LeaderPartitions: []uint32{0, 2},
 	}, {
-		Id:      "follower",
-		RpcAddr: "localhost:9002",
+		Id:               "follower",
+		RpcAddr:          "localhost:9002",
+		LeaderPartitions: []uint32{1},
 	}}, nil
 }
 
@@ -0,0 +1,253 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+
+	api "github.com/dikaeinstein/proglog/api/v1"
+)
+
+// compactDir is the directory, inside the log's directory, compacted
+// segments are written to before they replace the originals.
+const compactDir = "compact"
+
+// Compact rewrites the sealed segments to keep only the newest record for
+// each key. Compressed batches are rewritten decompressed. Segments
+// offloaded to the object store and removed locally aren't compacted.
+// Records without a key are kept, and so are tombstones until they're older
+// than the configured TombstoneRetention. Records keep their offsets, so
+// compacted segments have gaps in their offsets, and segments left without
+// records are removed. Records superseded by records in the active segment
+// are compacted once it's sealed.
+func (l *Log) Compact() error {
+	l.maintenance.Lock()
+	defer l.maintenance.Unlock()
+
+	// sealed segments aren't written to, so only maintenance, which we're
+	// holding the lock for, can change them
+	l.mu.RLock()
+	sealed := make([]*segment, len(l.segments)-1)
+	copy(sealed, l.segments)
+	l.mu.RUnlock()
+
+	latest := make(map[string]uint64)
+	for _, s := range sealed {
+		if err := s.scan(func(record *api.Record) error {
+			if len(record.Key) > 0 {
+				latest[string(record.Key)] = record.Offset
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	tombstoneCutoff := time.Now().Add(
+		-l.Config.Segment.TombstoneRetention,
+	).UnixNano()
+	keep := func(record *api.Record) bool {
+		if len(record.Key) == 0 {
+			return true
+		}
+		if latest[string(record.Key)] != record.Offset {
+			return false
+		}
+		return len(record.Value) > 0 || appendTime(record) > tombstoneCutoff
+	}
+	for _, s := range sealed {
+		if err := l.compact(s, keep); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compact rewrites the segment with only the records to keep and swaps it
+// in for the original.
+func (l *Log) compact(s *segment, keep func(*api.Record) bool) error {
+	var kept, dropped uint64
+	if err := s.scan(func(record *api.Record) error {
+		if keep(record) {
+			kept++
+		} else {
+			dropped++
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if dropped == 0 {
+		return nil
+	}
+
+	if kept == 0 {
+		return l.removeCompacted(s, dropped)
+	}
+
+	dir := filepath.Join(l.Dir, compactDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	c, err := newSegment(dir, s.baseOffset, l.Config)
+	if err != nil {
+		return err
+	}
+	if err = s.scan(func(record *api.Record) error {
+		if !keep(record) {
+			return nil
+		}
+		c.nextOffset = record.Offset
+		_, err := c.Append(record)
+		return err
+	}); err != nil {
+		return err
+	}
+	if err = c.Sync(); err != nil {
+		return err
+	}
+	if err = c.Close(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := l.segmentIndex(s)
+	if err = s.Close(); err != nil {
+		return err
+	}
+	if err = l.swapCompacted(s.baseOffset); err != nil {
+		return err
+	}
+	// the compacted segment is offloaded again
+	if !s.offloaded.IsZero() {
+		if err = l.removeRemote(s.baseOffset); err != nil {
+			return err
+		}
+	}
+	if l.segments[i], err = newSegment(l.Dir, s.baseOffset, l.Config); err != nil {
+		return err
+	}
+	l.segments[i].nextOffset = s.nextOffset
+	l.logCompaction(s, kept, dropped, s.store.size, l.segments[i].store.size)
+	return nil
+}
+
+// removeCompacted removes a segment compaction left without records. Its
+// offsets are taken over by the previous segment or, if it's the first
+// segment, become out of range.
+func (l *Log) removeCompacted(s *segment, dropped uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := l.segmentIndex(s)
+	if !s.offloaded.IsZero() {
+		if err := l.removeRemote(s.baseOffset); err != nil {
+			return err
+		}
+	}
+	if err := s.Remove(); err != nil {
+		return err
+	}
+	if i > 0 {
+		l.segments[i-1].nextOffset = s.nextOffset
+	}
+	l.segments = append(l.segments[:i], l.segments[i+1:]...)
+	l.logCompaction(s, 0, dropped, s.store.size, 0)
+	return nil
+}
+
+// segmentIndex returns the position of the segment in the log's segments.
+func (l *Log) segmentIndex(s *segment) int {
+	i := 0
+	for l.segments[i] != s {
+		i++
+	}
+	return i
+}
+
+func (l *Log) logCompaction(
+	s *segment,
+	kept, dropped, beforeBytes, afterBytes uint64,
+) {
+	l.logger.Info(
+		"compacted segment",
+		zap.String("dir", l.Dir),
+		zap.Uint64("base_offset", s.baseOffset),
+		zap.Uint64("next_offset", s.nextOffset),
+		zap.Uint64("kept_records", kept),
+		zap.Uint64("dropped_records", dropped),
+		zap.Uint64("store_bytes_before", beforeBytes),
+		zap.Uint64("store_bytes_after", afterBytes),
+	)
+}
+
+// swapCompacted moves the compacted segment's files over the original's.
+// Moving the store commits the swap, so it goes first.
+func (l *Log) swapCompacted(baseOffset uint64) error {
+	name := fmt.Sprintf("%d%s", baseOffset, ".store")
+	if err := os.Rename(
+		filepath.Join(l.Dir, compactDir, name),
+		filepath.Join(l.Dir, name),
+	); err != nil {
+		return err
+	}
+	return l.finishCompaction()
+}
+
+// finishCompaction deals with a compaction interrupted by a crash. If the
+// compacted store is still in the compaction directory the swap hadn't
+// started and the compacted segment is discarded. Otherwise the rest of
+// its files are moved over the original's.
+func (l *Log) finishCompaction() error {
+	dir := filepath.Join(l.Dir, compactDir)
+	stores, err := filepath.Glob(filepath.Join(dir, "*.store"))
+	if err != nil {
+		return err
+	}
+	if len(stores) > 0 {
+		return os.RemoveAll(dir)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err = os.Rename(
+			file,
+			filepath.Join(l.Dir, filepath.Base(file)),
+		); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(dir)
+}
+
+// scan calls fn with each of the segment's records in order, decompressing
+// compressed batches.
+func (s *segment) scan(fn func(*api.Record) error) error {
+	off := s.baseOffset
+	for off < s.nextOffset {
+		stored, err := s.ReadRaw(off)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		records, err := api.Decompress(stored)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if err = fn(record); err != nil {
+				return err
+			}
+		}
+		off = records[len(records)-1].Offset + 1
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package log
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	api "github.com/dikaeinstein/proglog/api/v1"
+)
+
+func TestLogCompact(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, log *Log){
+		"keeps the newest record per key":   testCompactKeepsNewest,
+		"removes segments left empty":       testCompactRemovesEmptySegments,
+		"restores compacted log snapshots":  testCompactSnapshotRestore,
+		"ignores records in active segment": testCompactIgnoresActiveSegment,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "compactor-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := Config{}
+			c.Segment.MaxIndexBytes = entWidth * 2
+			c.Segment.Compact = true
+			c.Segment.CompactionInterval = time.Hour
+			c.Segment.TombstoneRetention = time.Hour
+			log, err := New(dir, c)
+			require.NoError(t, err)
+			fn(t, log)
+		})
+	}
+}
+
+type keyedRecord struct {
+	key, value string
+	old        bool
+}
+
+func appendKeyed(t *testing.T, log *Log, records []keyedRecord) {
+	t.Helper()
+	for _, r := range records {
+		ts := time.Now()
+		if r.old {
+			ts = ts.Add(-2 * time.Hour)
+		}
+		record := &api.Record{
+			Value:     []byte(r.value),
+			Timestamp: timestamppb.New(ts),
+		}
+		if r.key != "" {
+			record.Key = []byte(r.key)
+		}
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+}
+
+// requireReads checks the offset of the record read for each offset.
+func requireReads(t *testing.T, log *Log, want map[uint64]uint64) {
+	t.Helper()
+	for off, wantOff := range want {
+		record, err := log.Read(off)
+		require.NoError(t, err, off)
+		require.Equal(t, wantOff, record.Offset, off)
+	}
+}
+
+func TestLogCompactInBackground(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compactor-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.Segment.Compact = true
+	c.Segment.CompactionInterval = 10 * time.Millisecond
+	log, err := New(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	appendKeyed(t, log, []keyedRecord{
+		{key: "k1", value: "a"},
+		{key: "k1", value: "b"},
+		{key: "k1", value: "c"},
+		{key: "k1", value: "d"},
+		{key: "k1", value: "e"},
+	})
+	require.Eventually(t, func() bool {
+		lowest, err := log.LowestOffset()
+		require.NoError(t, err)
+		return lowest == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+func testCompactKeepsNewest(t *testing.T, log *Log) {
+	appendKeyed(t, log, []keyedRecord{
+		{key: "k1", value: "a"},
+		{key: "k4", value: "a"},
+		{key: "k1", value: "b"},
+		{key: "k2", value: "a"},
+		{key: "k2", old: true},
+		{key: "k3", value: "a"},
+		{key: "k3", value: "b"},
+		{value: "no key"},
+	})
+	require.NoError(t, log.Compact())
+
+	want := map[uint64]uint64{
+		0: 1, 1: 1,
+		2: 2, 3: 5,
+		4: 5, 5: 5,
+		6: 6, 7: 7,
+	}
+	requireReads(t, log, want)
+	record, err := log.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("b"), record.Value)
+
+	// compacting again changes nothing
+	require.NoError(t, log.Compact())
+	requireReads(t, log, want)
+
+	log = reopen(t, log)
+	requireReads(t, log, want)
+	off, err := log.Append(&api.Record{Value: []byte("next")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), off)
+	require.NoError(t, log.Close())
+}
+
+func testCompactRemovesEmptySegments(t *testing.T, log *Log) {
+	appendKeyed(t, log, []keyedRecord{
+		{key: "k1", value: "a"},
+		{key: "k2", value: "a"},
+		{value: "no key"},
+		{key: "k1", value: "b"},
+		{key: "k1", value: "c"},
+		{key: "k2", value: "b"},
+		{key: "k1", value: "d"},
+		{key: "k2", value: "c"},
+		{key: "k3", value: "a"},
+	})
+	require.NoError(t, log.Compact())
+
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), lowest)
+	_, err = log.Read(0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, err)
+	// the removed segment's offsets are read from the previous segment
+	requireReads(t, log, map[uint64]uint64{
+		2: 2, 3: 6, 4: 6, 5: 6, 6: 6, 7: 7, 8: 8,
+	})
+	require.NoError(t, log.Close())
+}
+
+func testCompactSnapshotRestore(t *testing.T, log *Log) {
+	appendKeyed(t, log, []keyedRecord{
+		{key: "k1", value: "a"},
+		{key: "k2", value: "a"},
+		{key: "k1", value: "b"},
+		{key: "k2", value: "b"},
+		{key: "k3", value: "a"},
+	})
+	require.NoError(t, log.Compact())
+
+	snap, err := (&fsm{topics: singleTopic(log)}).Snapshot()
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(snap.(*snapshot).reader)
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "compactor-restore-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	restored, err := New(dir, log.Config)
+	require.NoError(t, err)
+	defer restored.Close()
+	_, err = restored.Append(&api.Record{Value: []byte("overwritten")})
+	require.NoError(t, err)
+
+	f := &fsm{topics: singleTopic(restored)}
+	err = f.Restore(ioutil.NopCloser(bytes.NewReader(b)))
+	require.NoError(t, err)
+	requireReads(t, restored, map[uint64]uint64{
+		2: 2, 3: 3, 4: 4,
+	})
+	off, err := restored.Append(&api.Record{Value: []byte("next")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	require.NoError(t, log.Close())
+}
+
+func testCompactIgnoresActiveSegment(t *testing.T, log *Log) {
+	appendKeyed(t, log, []keyedRecord{
+		{key: "k1", value: "a"},
+		{key: "k2", value: "a"},
+		{key: "k1", value: "b"},
+	})
+	require.NoError(t, log.Compact())
+	// superseded by a record in the active segment
+	requireReads(t, log, map[uint64]uint64{0: 0, 1: 1, 2: 2})
+	require.NoError(t, log.Close())
+}
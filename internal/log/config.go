@@ -1,6 +1,11 @@
 package log
 
-import "github.com/hashicorp/raft"
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
 
 type Config struct {
 	Raft struct {
@@ -13,5 +18,98 @@ type Config struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// Sync is the durability guarantee that must hold before an
+		// append returns. Defaults to SyncOS.
+		Sync SyncPolicy
+		// SyncInterval and SyncBytes control how SyncPeriodic batches
+		// fsyncs: the active segment is fsynced every SyncInterval, and
+		// as soon as SyncBytes have been appended since the last fsync if
+		// SyncBytes is set. SyncInterval defaults to 10ms, it's the
+		// longest an append waits for its fsync.
+		SyncInterval time.Duration
+		SyncBytes    uint64
+		// TimeIndexIntervalBytes is roughly how many store bytes are
+		// appended between two time index entries. Defaults to 4096.
+		TimeIndexIntervalBytes uint64
+		// RetentionBytes is the max number of store bytes the log keeps.
+		// Sealed segments are removed, oldest first, while the log is
+		// larger. Zero keeps everything.
+		RetentionBytes uint64
+		// RetentionAge is how long sealed segments are kept after their
+		// last record was appended. Zero keeps them forever.
+		RetentionAge time.Duration
+		// CleanupInterval is how often retention is enforced. Defaults to
+		// one minute when RetentionBytes or RetentionAge is set.
+		CleanupInterval time.Duration
+		// Compact enables key-based compaction: sealed segments are
+		// rewritten to keep only the newest record for each key.
+		Compact bool
+		// CompactionInterval is how often sealed segments are compacted.
+		// Defaults to one minute when Compact is set.
+		CompactionInterval time.Duration
+		// TombstoneRetention is how long tombstones are kept after being
+		// appended so that consumers get to see the delete. Defaults to
+		// 24 hours.
+		TombstoneRetention time.Duration
+		// ObjectStore, if set, is where sealed segments are offloaded
+		// to so that only the newest segments take up local disk. Every
+		// log needs an object store of its own.
+		ObjectStore ObjectStore
+		// OffloadInterval is how often sealed segments are uploaded to the
+		// ObjectStore. Defaults to one minute.
+		OffloadInterval time.Duration
+		// LocalRetention is how long offloaded segments are kept on local
+		// disk after being uploaded.
+		LocalRetention time.Duration
+		// RemoteCacheBytes bounds the store bytes of the offloaded
+		// segments fetched back to local disk to be read. The most
+		// recently read segment is always kept.
+		RemoteCacheBytes uint64
+		// KeyringFile names the file Keyring is loaded from, unless
+		// Keyring is set.
+		KeyringFile string
+		// Keyring, if set, holds the keys store frames are encrypted
+		// with. New segments are encrypted with its active key; segments
+		// written before keep the key, or lack of key, they were written
+		// with.
+		Keyring *Keyring
+	}
+	// Engine is the storage engine topics' records and Raft's logs are
+	// kept in. Defaults to EngineSegment. With EngineMemory, Raft's term,
+	// vote and snapshots are kept in memory too, so a restarted node
+	// starts over empty.
+	Engine Engine
+	// TransactionTimeout, if set, is how long transactions may stay open.
+	// The leader aborts the transactions open for longer, so that a
+	// producer that died mid-transaction doesn't hold read committed
+	// consumers back for good. It counts from when the node saw the
+	// transaction begin: a new leader gives them the full timeout again.
+	TransactionTimeout time.Duration
+}
+
+// SyncPolicy controls when appended records are fsynced to stable storage.
+type SyncPolicy string
+
+const (
+	// SyncOS hands every appended record to the operating system and leaves
+	// it to decide when to write it to disk. Records survive the process
+	// crashing but may be lost on power failure.
+	SyncOS SyncPolicy = "os"
+	// SyncAlways fsyncs the segment before every append returns.
+	SyncAlways SyncPolicy = "always"
+	// SyncPeriodic fsyncs the active segment periodically, see
+	// Config.Segment.SyncInterval and Config.Segment.SyncBytes. Appends
+	// wait for the next fsync, which covers every record appended since
+	// the last one: the appends share the cost of the fsync, at the cost
+	// of their latency.
+	SyncPeriodic SyncPolicy = "periodic"
+)
+
+// ParseSyncPolicy returns the SyncPolicy named by s.
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch p := SyncPolicy(s); p {
+	case SyncOS, SyncAlways, SyncPeriodic:
+		return p, nil
 	}
+	return "", fmt.Errorf("unknown sync policy: %q", s)
 }
@@ -1,28 +1,41 @@
 package log
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/cipher"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/raft"
 	raftboltdb "github.com/hashicorp/raft-boltdb"
+	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	api "github.com/dikaeinstein/proglog/api/v1"
 )
 
 type DistributedLog struct {
 	config       Config
-	log          *Log
+	topics       *Topics
 	raft         *raft.Raft
 	raftLogStore *logStore
+	// stableStore holds Raft's term and vote.
+	stableStore raft.StableStore
+
+	// done stops the background tasks, see abortExpiredTransactions.
+	done chan struct{}
+	wg   sync.WaitGroup
 }
 
 func NewDistributedLog(dataDir string, config Config) (
@@ -42,52 +55,86 @@ func NewDistributedLog(dataDir string, config Config) (
 }
 
 func (dl *DistributedLog) setupLog(dataDir string) error {
-	logDir := filepath.Join(dataDir, "log")
-	if err := os.MkdirAll(logDir, 0o755); err != nil {
-		return err
-	}
-
 	var err error
-	dl.log, err = New(logDir, dl.config)
+	dl.topics, err = NewTopics(dataDir, dl.config)
 	return err
 }
 
-func (dl *DistributedLog) setupRaft(dataDir string) error {
-	fsm := &fsm{log: dl.log}
+// setupRaft starts the log's Raft group. If it fails, whatever it started
+// is shut down again, leaving only the topics to close.
+func (dl *DistributedLog) setupRaft(dataDir string) (err error) {
+	fsm := &fsm{topics: dl.topics, producers: producers{}}
+	var transport *raft.NetworkTransport
+	defer func() {
+		if err == nil {
+			return
+		}
+		if dl.raft != nil {
+			// shutting Raft down closes the transport too
+			dl.raft.Shutdown().Error()
+			dl.raft = nil
+		} else if transport != nil {
+			transport.Close()
+		}
+		dl.closeStableStore()
+		if dl.raftLogStore != nil {
+			dl.raftLogStore.Close()
+			dl.raftLogStore = nil
+		}
+	}()
 
 	logDir := filepath.Join(dataDir, "raft", "log")
 	if err := os.MkdirAll(logDir, 0o755); err != nil {
 		return err
 	}
-	logConfig := dl.config
-	logConfig.Segment.InitialOffset = 1
+	var snapshotStore raft.SnapshotStore
+	if dl.config.Engine == EngineMemory {
+		// a node that lost its log on restart mustn't remember its term
+		// and vote either, or it would rejoin claiming entries it no
+		// longer has
+		dl.stableStore = raft.NewInmemStore()
+		snapshotStore = raft.NewInmemSnapshotStore()
+	} else {
+		var stableStore *raftboltdb.BoltStore
+		stableStore, err = raftboltdb.NewBoltStore(
+			filepath.Join(dataDir, "raft", "stable"),
+		)
+		if err != nil {
+			return err
+		}
+		dl.stableStore = stableStore
+		if err = checkRaftLogVersion(stableStore); err != nil {
+			return err
+		}
 
-	var err error
-	dl.raftLogStore, err = newLogStore(logDir, logConfig)
-	if err != nil {
-		return err
+		retain := 1
+		snapshotStore, err = raft.NewFileSnapshotStore(
+			filepath.Join(dataDir, "raft"),
+			retain,
+			os.Stderr,
+		)
+		if err != nil {
+			return err
+		}
 	}
 
-	stableStore, err := raftboltdb.NewBoltStore(
-		filepath.Join(dataDir, "raft", "stable"),
-	)
-	if err != nil {
-		return err
-	}
+	logConfig := dl.config
+	logConfig.Segment.InitialOffset = 1
+	// Raft decides when its own log is truncated
+	logConfig.Segment.RetentionBytes = 0
+	logConfig.Segment.RetentionAge = 0
+	logConfig.Segment.CleanupInterval = 0
+	logConfig.Segment.Compact = false
+	logConfig.Segment.ObjectStore = nil
 
-	retain := 1
-	snapshotStore, err := raft.NewFileSnapshotStore(
-		filepath.Join(dataDir, "raft"),
-		retain,
-		os.Stderr,
-	)
+	dl.raftLogStore, err = newLogStore(logDir, logConfig)
 	if err != nil {
 		return err
 	}
 
 	maxPool := 5
 	timeout := 10 * time.Second
-	transport := raft.NewNetworkTransport(
+	transport = raft.NewNetworkTransport(
 		dl.config.Raft.StreamLayer,
 		maxPool,
 		timeout,
@@ -113,7 +160,7 @@ func (dl *DistributedLog) setupRaft(dataDir string) error {
 		config,
 		fsm,
 		dl.raftLogStore,
-		stableStore,
+		dl.stableStore,
 		snapshotStore,
 		transport,
 	)
@@ -122,7 +169,7 @@ func (dl *DistributedLog) setupRaft(dataDir string) error {
 	}
 	hasState, err := raft.HasExistingState(
 		dl.raftLogStore,
-		stableStore,
+		dl.stableStore,
 		snapshotStore,
 	)
 	if err != nil {
@@ -136,15 +183,61 @@ func (dl *DistributedLog) setupRaft(dataDir string) error {
 			}},
 		}
 		err = dl.raft.BootstrapCluster(config).Error()
+		if err != nil {
+			return err
+		}
 	}
-	return err
+
+	dl.done = make(chan struct{})
+	if dl.config.TransactionTimeout > 0 {
+		dl.wg.Add(1)
+		go dl.abortExpiredTransactions()
+	}
+	return nil
 }
 
 var errInvalidResponseType = errors.New("invalid response type")
 
-func (dl *DistributedLog) Append(record *api.Record) (uint64, error) {
+// Append replicates the record through Raft and returns its offset in the
+// topic, see Produce.
+func (dl *DistributedLog) Append(topic string, record *api.Record) (
+	uint64,
+	error,
+) {
+	return dl.Produce(&api.ProduceRequest{Record: record, Topic: topic})
+}
+
+// Produce replicates the request's record through Raft and returns its
+// offset in the topic. The record is stamped with its append time here,
+// before replication, so that every replica stores the same timestamp. A
+// retry of a producer's request isn't appended again, it gets the offset
+// the request got the first time, see api.Producer. A conditional append,
+// with an expected offset for the topic or the record's key, is checked
+// against the topic once replicated, in the order of Raft's log.
+func (dl *DistributedLog) Produce(req *api.ProduceRequest) (uint64, error) {
+	if req.Compression != api.Compression_NONE {
+		first, _, err := dl.ProduceBatch(&api.ProduceBatchRequest{
+			Records:           []*api.Record{req.Record},
+			Compression:       req.Compression,
+			Topic:             req.Topic,
+			Producer:          req.Producer,
+			Transaction:       req.Transaction,
+			ExpectedOffset:    req.ExpectedOffset,
+			ExpectedKeyOffset: req.ExpectedKeyOffset,
+		})
+		return first, err
+	}
+	if err := dl.followTopic(req.Topic); err != nil {
+		return 0, err
+	}
+	req.Record.Timestamp = timestamppb.Now()
 	res, err := dl.apply(AppendRequestType, &api.ProduceRequest{
-		Record: record,
+		Record:            req.Record,
+		Topic:             req.Topic,
+		Producer:          req.Producer,
+		Transaction:       req.Transaction,
+		ExpectedOffset:    req.ExpectedOffset,
+		ExpectedKeyOffset: req.ExpectedKeyOffset,
 	})
 	if err != nil {
 		return 0, err
@@ -158,6 +251,198 @@ func (dl *DistributedLog) Append(record *api.Record) (uint64, error) {
 	return v.Offset, nil
 }
 
+// AppendBatch replicates the records through Raft as a single entry and
+// returns the offsets of the first and last records, which are appended at
+// contiguous offsets. Like Append, it stamps the records before replication.
+func (dl *DistributedLog) AppendBatch(topic string, records []*api.Record) (
+	first, last uint64,
+	err error,
+) {
+	return dl.AppendCompressed(topic, records, api.Compression_NONE)
+}
+
+// AppendCompressed is like AppendBatch but stores the records as a single
+// batch compressed with the given codec, see Log.AppendCompressed. Records
+// are replicated uncompressed and every replica compresses them.
+func (dl *DistributedLog) AppendCompressed(
+	topic string,
+	records []*api.Record,
+	c api.Compression,
+) (first, last uint64, err error) {
+	return dl.ProduceBatch(&api.ProduceBatchRequest{
+		Records:     records,
+		Compression: c,
+		Topic:       topic,
+	})
+}
+
+// ProduceBatch replicates the request's records through Raft, see
+// AppendCompressed. Like Produce, a retry of a producer's request gets the
+// offsets the request got the first time.
+func (dl *DistributedLog) ProduceBatch(req *api.ProduceBatchRequest) (
+	first, last uint64,
+	err error,
+) {
+	// fail before replicating records no replica can compress
+	if req.Compression != api.Compression_NONE {
+		if _, err = api.CodecFor(req.Compression); err != nil {
+			return 0, 0, err
+		}
+	}
+	if err = dl.followTopic(req.Topic); err != nil {
+		return 0, 0, err
+	}
+	now := time.Now()
+	for _, record := range req.Records {
+		record.Timestamp = timestamppb.New(now)
+	}
+	res, err := dl.apply(AppendBatchRequestType, &api.ProduceBatchRequest{
+		Records:           req.Records,
+		Compression:       req.Compression,
+		Topic:             req.Topic,
+		Producer:          req.Producer,
+		Transaction:       req.Transaction,
+		ExpectedOffset:    req.ExpectedOffset,
+		ExpectedKeyOffset: req.ExpectedKeyOffset,
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	v, ok := res.(*api.ProduceBatchResponse)
+	if !ok {
+		return 0, 0, fmt.Errorf("ErrInvalidResponseType %w: %v", errInvalidResponseType, res)
+	}
+
+	return v.FirstOffset, v.LastOffset, nil
+}
+
+// followTopic creates the topic through Raft if the log is a partition
+// that doesn't have a topic the controller has yet, see
+// PartitionedLog.followTopics, so that records can be produced to topics
+// as soon as they're created. Topics the controller doesn't have aren't
+// produced to, even if the partition hasn't deleted them yet.
+func (dl *DistributedLog) followTopic(topic string) error {
+	controller := dl.topics.controller
+	if controller == nil {
+		return nil
+	}
+	if _, err := controller.Topic(topic); err != nil {
+		return err
+	}
+	if _, err := dl.topics.Topic(topic); err == nil {
+		return nil
+	}
+	err := dl.CreateTopic(topic)
+	if _, ok := err.(api.ErrTopicExists); ok {
+		return nil
+	}
+	return err
+}
+
+// CreateTopic replicates the topic's creation through Raft.
+func (dl *DistributedLog) CreateTopic(topic string) error {
+	// fail before replicating a name no replica can create
+	if !api.ValidTopic(topic) {
+		return api.ErrInvalidTopic{Topic: topic}
+	}
+	_, err := dl.apply(CreateTopicRequestType, &api.CreateTopicRequest{
+		Topic: topic,
+	})
+	return err
+}
+
+// DeleteTopic replicates the topic's deletion through Raft.
+func (dl *DistributedLog) DeleteTopic(topic string) error {
+	_, err := dl.apply(DeleteTopicRequestType, &api.DeleteTopicRequest{
+		Topic: topic,
+	})
+	return err
+}
+
+// BeginTransaction replicates the transaction's opening through Raft.
+func (dl *DistributedLog) BeginTransaction(id string) error {
+	_, err := dl.apply(BeginTransactionRequestType, &api.BeginTransactionRequest{
+		Transaction: id,
+	})
+	return err
+}
+
+// CommitTransaction replicates the transaction's commit through Raft. Like
+// Append, it stamps the commit markers before replication.
+func (dl *DistributedLog) CommitTransaction(id string) error {
+	_, err := dl.apply(CommitTransactionRequestType, &api.Record{
+		Transaction: id,
+		Timestamp:   timestamppb.Now(),
+	})
+	return err
+}
+
+// AbortTransaction replicates the transaction's abort through Raft, see
+// CommitTransaction.
+func (dl *DistributedLog) AbortTransaction(id string) error {
+	_, err := dl.apply(AbortTransactionRequestType, &api.Record{
+		Transaction: id,
+		Timestamp:   timestamppb.Now(),
+	})
+	return err
+}
+
+// abortExpiredTransactions aborts the transactions open for longer than
+// the transaction timeout while this node leads, until the log is closed.
+func (dl *DistributedLog) abortExpiredTransactions() {
+	defer dl.wg.Done()
+	logger := zap.L().Named("log")
+	ticker := time.NewTicker(dl.config.TransactionTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-dl.done:
+			return
+		case <-ticker.C:
+		}
+		if dl.raft.State() != raft.Leader {
+			continue
+		}
+		timeout := dl.config.TransactionTimeout
+		for _, id := range dl.topics.expiredTransactions(timeout) {
+			err := dl.AbortTransaction(id)
+			if _, ok := err.(api.ErrTransactionNotFound); ok {
+				// it ended in the meantime
+				continue
+			} else if err != nil {
+				logger.Error(
+					"abort expired transaction failed",
+					zap.String("transaction", id),
+					zap.Error(err),
+				)
+				continue
+			}
+			logger.Info(
+				"aborted expired transaction",
+				zap.String("transaction", id),
+				zap.Duration("timeout", timeout),
+			)
+		}
+	}
+}
+
+// ListTopics returns the topics, see Topics.ListTopics. The list goes
+// through Raft so that it reflects every topic created or deleted before.
+func (dl *DistributedLog) ListTopics() ([]string, error) {
+	res, err := dl.apply(ListTopicsRequestType, &api.ListTopicsRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	v, ok := res.(*api.ListTopicsResponse)
+	if !ok {
+		return nil, fmt.Errorf("ErrInvalidResponseType %w: %v", errInvalidResponseType, res)
+	}
+
+	return v.Topics, nil
+}
+
 func (dl *DistributedLog) apply(reqType RequestType, req proto.Message) (
 	interface{},
 	error,
@@ -178,8 +463,11 @@ func (dl *DistributedLog) apply(reqType RequestType, req proto.Message) (
 
 	timeout := 10 * time.Second
 	future := dl.raft.Apply(buf.Bytes(), timeout)
-	if future.Error() != nil {
-		return nil, future.Error()
+	if err := future.Error(); errors.Is(err, raft.ErrNotLeader) {
+		// the request wasn't appended, the caller can retry it on the leader
+		return nil, api.ErrNotLeader{Leader: string(dl.raft.Leader())}
+	} else if err != nil {
+		return nil, err
 	}
 	res := future.Response()
 	if err, ok := res.(error); ok {
@@ -188,8 +476,96 @@ func (dl *DistributedLog) apply(reqType RequestType, req proto.Message) (
 	return res, nil
 }
 
-func (dl *DistributedLog) Read(offset uint64) (*api.Record, error) {
-	return dl.log.Read(offset)
+func (dl *DistributedLog) Read(topic string, offset uint64) (
+	*api.Record,
+	error,
+) {
+	return dl.topics.Read(topic, offset)
+}
+
+func (dl *DistributedLog) ReadRaw(topic string, offset uint64) (
+	*api.Record,
+	error,
+) {
+	return dl.topics.ReadRaw(topic, offset)
+}
+
+func (dl *DistributedLog) ReadRange(
+	topic string,
+	from uint64,
+	maxRecords int,
+	maxBytes uint64,
+) ([]*api.Record, error) {
+	return dl.topics.ReadRange(topic, from, maxRecords, maxBytes)
+}
+
+// ReadCommitted reads the topic's committed records, see
+// Topics.ReadCommitted.
+func (dl *DistributedLog) ReadCommitted(topic string, offset uint64) (
+	*api.Record,
+	error,
+) {
+	return dl.topics.ReadCommitted(topic, offset)
+}
+
+// ReadRawCommitted is ReadCommitted for ReadRaw, see
+// Topics.ReadRawCommitted.
+func (dl *DistributedLog) ReadRawCommitted(topic string, offset uint64) (
+	*api.Record,
+	error,
+) {
+	return dl.topics.ReadRawCommitted(topic, offset)
+}
+
+// HighWatermark returns the offset the next record will be appended at.
+// Records are only applied to the log once they're committed, so every
+// record before it is committed.
+func (dl *DistributedLog) HighWatermark(topic string) (uint64, error) {
+	return dl.topics.HighWatermark(topic)
+}
+
+func (dl *DistributedLog) LowestOffset(topic string) (uint64, error) {
+	return dl.topics.LowestOffset(topic)
+}
+
+func (dl *DistributedLog) OffsetForTime(topic string, t time.Time) (
+	uint64,
+	error,
+) {
+	return dl.topics.OffsetForTime(topic, t)
+}
+
+// WaitForOffset blocks until the topic has a committed record at or past
+// offset off, or ctx is done, see Log.WaitForOffset.
+func (dl *DistributedLog) WaitForOffset(
+	ctx context.Context,
+	topic string,
+	off uint64,
+) error {
+	return dl.topics.WaitForOffset(ctx, topic, off)
+}
+
+func (dl *DistributedLog) WaitForStableOffset(
+	ctx context.Context,
+	topic string,
+	off uint64,
+) error {
+	return dl.topics.WaitForStableOffset(ctx, topic, off)
+}
+
+// VerifyLeader returns an error unless the log leads its Raft group and has
+// applied every entry committed before the call, so that reads that follow
+// are linearizable. Followers return an api.ErrNotLeader naming the leader.
+func (dl *DistributedLog) VerifyLeader() error {
+	err := dl.raft.VerifyLeader().Error()
+	if err == nil {
+		err = dl.raft.Barrier(10 * time.Second).Error()
+	}
+	if errors.Is(err, raft.ErrNotLeader) ||
+		errors.Is(err, raft.ErrLeadershipLost) {
+		return api.ErrNotLeader{Leader: string(dl.raft.Leader())}
+	}
+	return err
 }
 
 func (dl *DistributedLog) Join(id, addr string) error {
@@ -220,6 +596,11 @@ func (dl *DistributedLog) Join(id, addr string) error {
 }
 
 func (dl *DistributedLog) Close() error {
+	if dl.done != nil {
+		close(dl.done)
+		dl.wg.Wait()
+		dl.done = nil
+	}
 	f := dl.raft.Shutdown()
 	if err := f.Error(); err != nil {
 		return err
@@ -229,8 +610,21 @@ func (dl *DistributedLog) Close() error {
 	if err := dl.raftLogStore.Close(); err != nil {
 		return err
 	}
+	if err := dl.closeStableStore(); err != nil {
+		return err
+	}
 
-	return dl.log.Close()
+	return dl.topics.Close()
+}
+
+// closeStableStore closes Raft's stable store, if it has to be.
+func (dl *DistributedLog) closeStableStore() error {
+	closer, ok := dl.stableStore.(io.Closer)
+	dl.stableStore = nil
+	if !ok {
+		return nil
+	}
+	return closer.Close()
 }
 
 func (dl *DistributedLog) Leave(id string) error {
@@ -273,21 +667,49 @@ func (dl *DistributedLog) GetServers() ([]*api.Server, error) {
 }
 
 type fsm struct {
-	log *Log
+	topics    *Topics
+	producers producers
 }
 
 type RequestType uint8
 
 const (
-	AppendRequestType RequestType = 0
+	AppendRequestType      RequestType = 0
+	AppendBatchRequestType RequestType = 1
+	CreateTopicRequestType RequestType = 2
+	DeleteTopicRequestType RequestType = 3
+	ListTopicsRequestType  RequestType = 4
+	// BeginTransactionRequestType requests hold an api.BeginTransactionRequest,
+	// commit and abort ones the marker to append to the transaction's
+	// topics.
+	BeginTransactionRequestType  RequestType = 5
+	CommitTransactionRequestType RequestType = 6
+	AbortTransactionRequestType  RequestType = 7
 )
 
 func (f *fsm) Apply(record *raft.Log) interface{} {
+	if f.producers == nil {
+		f.producers = producers{}
+	}
 	buf := record.Data
 	reqType := RequestType(buf[0])
 	switch reqType {
 	case AppendRequestType:
 		return f.applyAppend(buf[1:])
+	case AppendBatchRequestType:
+		return f.applyAppendBatch(buf[1:])
+	case CreateTopicRequestType:
+		return f.applyCreateTopic(buf[1:])
+	case DeleteTopicRequestType:
+		return f.applyDeleteTopic(buf[1:])
+	case ListTopicsRequestType:
+		return f.applyListTopics()
+	case BeginTransactionRequestType:
+		return f.applyBeginTransaction(buf[1:])
+	case CommitTransactionRequestType:
+		return f.applyEndTransaction(buf[1:], api.Control_CONTROL_COMMIT)
+	case AbortTransactionRequestType:
+		return f.applyEndTransaction(buf[1:], api.Control_CONTROL_ABORT)
 	}
 	return nil
 }
@@ -298,47 +720,315 @@ func (f *fsm) applyAppend(b []byte) interface{} {
 	if err != nil {
 		return err
 	}
-	offset, err := f.log.Append(req.Record)
+	state, retry, err := f.producers.check(req.Producer)
 	if err != nil {
 		return err
 	}
+	if retry {
+		return &api.ProduceResponse{Offset: state.first}
+	}
+	if err = f.checkExpectedOffset(req.Topic, req.ExpectedOffset); err != nil {
+		return err
+	}
+	err = f.checkExpectedKeyOffset(req.Topic, req.Record, req.ExpectedKeyOffset)
+	if err != nil {
+		return err
+	}
+	offset, err := f.topics.Produce(&req)
+	if err != nil {
+		return err
+	}
+	f.producers.appended(req.Producer, offset, offset)
 	return &api.ProduceResponse{Offset: offset}
 }
 
+func (f *fsm) applyAppendBatch(b []byte) interface{} {
+	var req api.ProduceBatchRequest
+	err := proto.Unmarshal(b, &req)
+	if err != nil {
+		return err
+	}
+	state, retry, err := f.producers.check(req.Producer)
+	if err != nil {
+		return err
+	}
+	if retry {
+		return &api.ProduceBatchResponse{
+			FirstOffset: state.first,
+			LastOffset:  state.last,
+		}
+	}
+	if err = f.checkExpectedOffset(req.Topic, req.ExpectedOffset); err != nil {
+		return err
+	}
+	if len(req.Records) > 0 {
+		err = f.checkExpectedKeyOffset(
+			req.Topic,
+			req.Records[0],
+			req.ExpectedKeyOffset,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	first, last, err := f.topics.ProduceBatch(&req)
+	if err != nil {
+		return err
+	}
+	f.producers.appended(req.Producer, first, last)
+	return &api.ProduceBatchResponse{FirstOffset: first, LastOffset: last}
+}
+
+// checkExpectedOffset fails a conditional append if the topic isn't at the
+// offset the writer expects, see api.ProduceRequest's expected offset.
+func (f *fsm) checkExpectedOffset(topic string, expected *uint64) error {
+	if expected == nil {
+		return nil
+	}
+	hw, err := f.topics.HighWatermark(topic)
+	if err != nil {
+		return err
+	}
+	if hw != *expected {
+		return api.ErrUnexpectedOffset{
+			Topic:    topic,
+			Expected: *expected,
+			Actual:   hw,
+		}
+	}
+	return nil
+}
+
+// checkExpectedKeyOffset fails a conditional append on the record's key if
+// the key isn't at the offset the writer expects, see api.ProduceRequest's
+// expected key offset.
+func (f *fsm) checkExpectedKeyOffset(
+	topic string,
+	record *api.Record,
+	expected *uint64,
+) error {
+	if expected == nil {
+		return nil
+	}
+	key := record.GetKey()
+	off, err := f.topics.KeyOffset(topic, key)
+	if err != nil {
+		return err
+	}
+	if off != *expected {
+		return api.ErrUnexpectedOffset{
+			Topic:    topic,
+			Key:      key,
+			Expected: *expected,
+			Actual:   off,
+		}
+	}
+	return nil
+}
+
+func (f *fsm) applyCreateTopic(b []byte) interface{} {
+	var req api.CreateTopicRequest
+	err := proto.Unmarshal(b, &req)
+	if err != nil {
+		return err
+	}
+	if err = f.topics.CreateTopic(req.Topic); err != nil {
+		return err
+	}
+	return &api.CreateTopicResponse{}
+}
+
+func (f *fsm) applyDeleteTopic(b []byte) interface{} {
+	var req api.DeleteTopicRequest
+	err := proto.Unmarshal(b, &req)
+	if err != nil {
+		return err
+	}
+	if err = f.topics.DeleteTopic(req.Topic); err != nil {
+		return err
+	}
+	return &api.DeleteTopicResponse{}
+}
+
+func (f *fsm) applyBeginTransaction(b []byte) interface{} {
+	var req api.BeginTransactionRequest
+	err := proto.Unmarshal(b, &req)
+	if err != nil {
+		return err
+	}
+	if err = f.topics.BeginTransaction(req.Transaction); err != nil {
+		return err
+	}
+	return &api.BeginTransactionResponse{}
+}
+
+func (f *fsm) applyEndTransaction(b []byte, c api.Control) interface{} {
+	var marker api.Record
+	err := proto.Unmarshal(b, &marker)
+	if err != nil {
+		return err
+	}
+	marker.Control = c
+	if err = f.topics.endTransaction(&marker); err != nil {
+		return err
+	}
+	if c == api.Control_CONTROL_ABORT {
+		return &api.AbortTransactionResponse{}
+	}
+	return &api.CommitTransactionResponse{}
+}
+
+func (f *fsm) applyListTopics() interface{} {
+	topics, err := f.topics.ListTopics()
+	if err != nil {
+		return err
+	}
+	return &api.ListTopicsResponse{Topics: topics}
+}
+
+// Snapshot returns a snapshot of every topic's records followed by the
+// open transactions and the producers' states. Those are read right away,
+// while the fsm doesn't apply requests.
 func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
-	r := f.log.Reader()
+	r := io.MultiReader(
+		f.topics.Reader(),
+		f.topics.transactionsReader(),
+		f.producers.Reader(),
+	)
 	return &snapshot{reader: r}, nil
 }
 
+// Restore replaces every topic's records with the snapshot's, see
+// Topics.Reader, and the open transactions and producers' states with the
+// snapshot's. Topics missing from the snapshot are deleted.
 func (f *fsm) Restore(r io.ReadCloser) error {
-	b := make([]byte, lenWidth)
+	f.producers = producers{}
+	if err := f.topics.clearTransactions(); err != nil {
+		return err
+	}
+	br := bufio.NewReader(r)
+	b := make([]byte, frameHeaderWidth)
 	var buf bytes.Buffer
-	for i := 0; ; i++ {
-		_, err := io.ReadFull(r, b)
+	// the frames that follow a store header are encrypted with its key,
+	// they're decrypted here and re-encrypted with the log's active key
+	var aead cipher.AEAD
+	// the topic whose records are being restored and its log, nil until
+	// its first record is, as the log starts at that record's offset
+	var topic string
+	var log Storage
+	restored := map[string]bool{"": true}
+	// empty the topic if the snapshot holds none of its records
+	done := func() error {
+		if log != nil {
+			return nil
+		}
+		_, err := f.topics.restore(topic, 0)
+		return err
+	}
+	for {
+		id, ok, err := readNamedHeader(br, snapshotProducerMagic)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if err = f.producers.restore(br, id); err != nil {
+				return err
+			}
+			continue
+		}
+		id, ok, err = readNamedHeader(br, snapshotTransactionMagic)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if err = f.topics.restoreTransaction(id); err != nil {
+				return err
+			}
+			continue
+		}
+		name, ok, err := readNamedHeader(br, snapshotTopicMagic)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if err = done(); err != nil {
+				return err
+			}
+			topic, log, aead = name, nil, nil
+			restored[topic] = true
+			continue
+		}
+		keyID, ok, err := readStoreHeader(br)
+		if err != nil {
+			return err
+		}
+		if ok {
+			aead = nil
+			if keyID != "" {
+				aead, err = f.topics.Config.Segment.Keyring.aead(keyID)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		_, err = io.ReadFull(br, b)
 		if err == io.EOF {
 			break
 		} else if err != nil {
 			return err
 		}
-		size := int64(enc.Uint64(b))
-		if _, err = io.CopyN(&buf, r, size); err != nil {
+		size := int64(enc.Uint64(b[:lenWidth]))
+		if _, err = io.CopyN(&buf, br, size); err != nil {
 			return err
 		}
-		record := &api.Record{}
-		if err = proto.Unmarshal(buf.Bytes(), record); err != nil {
-			return err
+		if crc32.Checksum(buf.Bytes(), crcTable) != enc.Uint32(b[lenWidth:]) {
+			return errCorruptFrame
 		}
-		if i == 0 {
-			f.log.Config.Segment.InitialOffset = record.Offset
-			if err := f.log.Reset(); err != nil {
+		p := buf.Bytes()
+		if aead != nil {
+			if p, err = unseal(aead, p); err != nil {
 				return err
 			}
 		}
-		if _, err = f.log.Append(record); err != nil {
+		stored := &api.Record{}
+		if err = proto.Unmarshal(p, stored); err != nil {
+			return err
+		}
+		records, err := api.Decompress(stored)
+		if err != nil {
 			return err
 		}
+		if log == nil {
+			if log, err = f.topics.restore(topic, stored.Offset); err != nil {
+				return err
+			}
+		}
+		// keep the records' offsets, they're sparse if the log was
+		// compacted
+		for _, record := range records {
+			if err = log.AppendAt(record); err != nil {
+				return err
+			}
+		}
+		f.topics.indexTransactions(topic, records)
 		buf.Reset()
 	}
+	if err := done(); err != nil {
+		return err
+	}
+	topics, err := f.topics.ListTopics()
+	if err != nil {
+		return err
+	}
+	for _, topic := range topics {
+		if restored[topic] {
+			continue
+		}
+		if err = f.topics.DeleteTopic(topic); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -355,12 +1045,60 @@ func (s *snapshot) Persist(sink raft.SnapshotSink) error {
 }
 func (s *snapshot) Release() {}
 
+// logStore stores Raft's logs as records, the log's term and type
+// prefixed to its data in the record's value.
 type logStore struct {
-	*Log
+	Storage
+}
+
+const (
+	termWidth = 8
+	typeWidth = 1
+	// raftLogHeaderWidth is the width of the term and type prefixed to
+	// Raft's logs' data.
+	raftLogHeaderWidth = termWidth + typeWidth
+)
+
+// raftLogVersionKey is the stable store key of the version of the format
+// Raft's logs are stored in. Logs stored before it kept their term and type
+// in the record rather than prefixed to the value, and can't be read.
+var raftLogVersionKey = []byte("ProglogRaftLogVersion")
+
+const raftLogVersion = 1
+
+// errRaftLogFormat is returned when opening a data dir whose Raft logs are
+// in an unsupported format. The server's data dir has to be removed for it
+// to rejoin the cluster and get the logs again from the leader.
+var errRaftLogFormat = errors.New("raft log stored in an unsupported format")
+
+// checkRaftLogVersion checks that the Raft logs of the data dir whose
+// stable store is given are in the format logStore reads. The version is
+// set in new stable stores; one that already has a term, but no version,
+// is from a data dir written before the version was.
+func checkRaftLogVersion(s raft.StableStore) error {
+	version, err := s.GetUint64(raftLogVersionKey)
+	if err != nil && !errors.Is(err, raftboltdb.ErrKeyNotFound) {
+		return err
+	}
+	if version == raftLogVersion {
+		return nil
+	}
+	if version != 0 {
+		return fmt.Errorf("version %d: %w", version, errRaftLogFormat)
+	}
+	// Raft's key for the current term
+	term, err := s.GetUint64([]byte("CurrentTerm"))
+	if err != nil && !errors.Is(err, raftboltdb.ErrKeyNotFound) {
+		return err
+	}
+	if term != 0 {
+		return fmt.Errorf("no version: %w", errRaftLogFormat)
+	}
+	return s.SetUint64(raftLogVersionKey, raftLogVersion)
 }
 
 func newLogStore(dir string, c Config) (*logStore, error) {
-	log, err := New(dir, c)
+	log, err := NewStorage(dir, c)
 	if err != nil {
 		return nil, err
 	}
@@ -381,10 +1119,13 @@ func (l *logStore) GetLog(index uint64, out *raft.Log) error {
 	if err != nil {
 		return err
 	}
-	out.Data = in.Value
+	if len(in.Value) < raftLogHeaderWidth {
+		return fmt.Errorf("raft log %d: %w", in.Offset, errCorruptFrame)
+	}
+	out.Term = enc.Uint64(in.Value[:termWidth])
+	out.Type = raft.LogType(in.Value[termWidth])
+	out.Data = in.Value[raftLogHeaderWidth:]
 	out.Index = in.Offset
-	out.Type = raft.LogType(in.Type)
-	out.Term = in.Term
 	return nil
 }
 
@@ -393,24 +1134,48 @@ func (l *logStore) StoreLog(record *raft.Log) error {
 }
 
 func (l *logStore) StoreLogs(records []*raft.Log) error {
-	for _, record := range records {
-		if _, err := l.Append(&api.Record{
-			Value: record.Data,
-			Term:  record.Term,
-			Type:  uint32(record.Type),
-		}); err != nil {
-			return err
-		}
+	if len(records) == 0 {
+		return nil
 	}
-	return nil
+	batch := make([]*api.Record, len(records))
+	for i, record := range records {
+		value := make([]byte, raftLogHeaderWidth+len(record.Data))
+		enc.PutUint64(value[:termWidth], record.Term)
+		value[termWidth] = byte(record.Type)
+		copy(value[raftLogHeaderWidth:], record.Data)
+		batch[i] = &api.Record{Value: value}
+	}
+	_, _, err := l.AppendBatch(batch)
+	return err
 }
 
+// DeleteRange removes Raft's logs from min to max. Raft deletes logs from
+// the front of the log once a snapshot holds them, and from the back when
+// they conflict with the leader's after a leader change.
 func (l *logStore) DeleteRange(min, max uint64) error {
-	return l.Truncate(max)
+	last, err := l.LastIndex()
+	if err != nil {
+		return err
+	}
+	if max >= last {
+		return l.TruncateFrom(min)
+	}
+	first, err := l.FirstIndex()
+	if err != nil {
+		return err
+	}
+	if min <= first {
+		return l.Truncate(max)
+	}
+	return fmt.Errorf(
+		"delete raft logs %d to %d: only logs at either end of %d to %d can be deleted",
+		min, max, first, last,
+	)
 }
 
 type StreamLayer struct {
 	ln              net.Listener
+	partition       uint8
 	serverTLSConfig *tls.Config
 	peerTLSConfig   *tls.Config
 }
@@ -419,9 +1184,22 @@ func NewStreamLayer(
 	ln net.Listener,
 	serverTLSConfig,
 	peerTLSConfig *tls.Config,
+) *StreamLayer {
+	return NewPartitionStreamLayer(ln, 0, serverTLSConfig, peerTLSConfig)
+}
+
+// NewPartitionStreamLayer returns the stream layer of a partition's Raft
+// group. Raft connections start with RaftRPC followed by the partition so
+// that every partition's connections can share a listener.
+func NewPartitionStreamLayer(
+	ln net.Listener,
+	partition uint8,
+	serverTLSConfig,
+	peerTLSConfig *tls.Config,
 ) *StreamLayer {
 	return &StreamLayer{
 		ln:              ln,
+		partition:       partition,
 		serverTLSConfig: serverTLSConfig,
 		peerTLSConfig:   peerTLSConfig,
 	}
@@ -438,8 +1216,8 @@ func (s *StreamLayer) Dial(
 	if err != nil {
 		return nil, err
 	}
-	// identify to mux if this is a raft rpc
-	_, err = conn.Write([]byte{byte(RaftRPC)})
+	// identify to mux if this is a raft rpc, and of which partition
+	_, err = conn.Write([]byte{byte(RaftRPC), s.partition})
 	if err != nil {
 		return nil, err
 	}
@@ -456,12 +1234,12 @@ func (s *StreamLayer) Accept() (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	b := make([]byte, 1)
-	_, err = conn.Read(b)
+	b := make([]byte, 2)
+	_, err = io.ReadFull(conn, b)
 	if err != nil {
 		return nil, err
 	}
-	if !bytes.Equal([]byte{byte(RaftRPC)}, b) {
+	if !bytes.Equal([]byte{byte(RaftRPC), s.partition}, b) {
 		return nil, fmt.Errorf("%w", errNotARaftRPC)
 	}
 	if s.serverTLSConfig != nil {
@@ -1,17 +1,25 @@
 package log
 
 import (
+	"bytes"
 	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
 
 	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
 	"github.com/stretchr/testify/require"
 	"github.com/travisjeffery/go-dynaport"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	api "github.com/dikaeinstein/proglog/api/v1"
 )
@@ -83,17 +91,25 @@ func TestMultipleNodes(t *testing.T) {
 		logs = append(logs, l)
 	}
 
+	// only the leader serves linearizable reads, followers name it
+	require.NoError(t, logs[0].VerifyLeader())
+	require.Eventually(t, func() bool {
+		return logs[1].VerifyLeader() == api.ErrNotLeader{
+			Leader: logs[0].config.Raft.BindAddr,
+		}
+	}, 3*time.Second, 50*time.Millisecond)
+
 	records := []*api.Record{
 		{Value: []byte("first")},
 		{Value: []byte("second")},
 	}
 	for _, record := range records {
-		off, err := logs[0].Append(record)
+		off, err := logs[0].Append("", record)
 		require.NoError(t, err)
 
 		require.Eventually(t, func() bool {
 			for j := 0; j < nodeCount; j++ {
-				got, err := logs[j].Read(off)
+				got, err := logs[j].Read("", off)
 				if err != nil {
 					return false
 				}
@@ -106,6 +122,26 @@ func TestMultipleNodes(t *testing.T) {
 		}, 500*time.Millisecond, 50*time.Millisecond)
 	}
 
+	first, last, err := logs[0].AppendBatch("", []*api.Record{
+		{Value: []byte("batch first")},
+		{Value: []byte("batch second")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), first)
+	require.Equal(t, uint64(3), last)
+	require.Eventually(t, func() bool {
+		for j := 0; j < nodeCount; j++ {
+			got, err := logs[j].Read("", last)
+			if err != nil {
+				return false
+			}
+			if !bytes.Equal(got.Value, []byte("batch second")) {
+				return false
+			}
+		}
+		return true
+	}, 500*time.Millisecond, 50*time.Millisecond)
+
 	servers, err := logs[0].GetServers()
 	require.NoError(t, err)
 	require.Equal(t, 3, len(servers))
@@ -124,19 +160,593 @@ func TestMultipleNodes(t *testing.T) {
 	require.True(t, servers[0].IsLeader)
 	require.False(t, servers[1].IsLeader)
 
-	off, err := logs[0].Append(&api.Record{
+	off, err := logs[0].Append("", &api.Record{
 		Value: []byte("third"),
 	})
 	require.NoError(t, err)
 
 	time.Sleep(50 * time.Millisecond)
 
-	record, err := logs[1].Read(off)
+	record, err := logs[1].Read("", off)
 	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
 	require.Nil(t, record)
 
-	record, err = logs[2].Read(off)
+	record, err = logs[2].Read("", off)
 	require.NoError(t, err)
 	require.Equal(t, []byte("third"), record.Value)
 	require.Equal(t, off, record.Offset)
 }
+
+func TestMemoryEngineRestart(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "memory-engine-restart-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	open := func() *DistributedLog {
+		t.Helper()
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		config := Config{Engine: EngineMemory}
+		config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = "0"
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.BindAddr = ln.Addr().String()
+		config.Raft.Bootstrap = true
+		l, err := NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		require.NoError(t, l.WaitForLeader(3*time.Second))
+		return l
+	}
+	l := open()
+	_, err = l.Append("", &api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	// nothing of Raft's state survives, so the node bootstraps afresh
+	l = open()
+	defer l.Close()
+	hw, err := l.HighWatermark("")
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), hw)
+	_, err = os.Stat(filepath.Join(dataDir, "raft", "stable"))
+	require.True(t, os.IsNotExist(err))
+	off, err := l.Append("", &api.Record{Value: []byte("second")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+}
+
+func TestTransactionTimeout(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "transaction-timeout-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	config := Config{TransactionTimeout: 100 * time.Millisecond}
+	config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+	config.Raft.LocalID = "0"
+	config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+	config.Raft.ElectionTimeout = 50 * time.Millisecond
+	config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.Raft.CommitTimeout = 5 * time.Millisecond
+	config.Raft.BindAddr = ln.Addr().String()
+	config.Raft.Bootstrap = true
+	l, err := NewDistributedLog(dataDir, config)
+	require.NoError(t, err)
+	defer l.Close()
+	require.NoError(t, l.WaitForLeader(3*time.Second))
+
+	// the producer dies mid-transaction
+	require.NoError(t, l.BeginTransaction("abandoned"))
+	off, err := l.Produce(&api.ProduceRequest{
+		Record:      &api.Record{Value: []byte("abandoned")},
+		Transaction: "abandoned",
+	})
+	require.NoError(t, err)
+	_, err = l.Append("", &api.Record{Value: []byte("after")})
+	require.NoError(t, err)
+	_, err = l.ReadCommitted("", off)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: off}, err)
+
+	// the leader aborts it, which unblocks read committed consumers
+	require.Eventually(t, func() bool {
+		record, err := l.ReadCommitted("", off)
+		return err == nil && string(record.Value) == "after"
+	}, 3*time.Second, 50*time.Millisecond)
+	marker, err := l.Read("", off+2)
+	require.NoError(t, err)
+	require.Equal(t, api.Control_CONTROL_ABORT, marker.Control)
+	require.Equal(
+		t,
+		api.ErrTransactionNotFound{Transaction: "abandoned"},
+		l.CommitTransaction("abandoned"),
+	)
+}
+
+func TestFSMRestoreCompressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsm-restore-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	l, err := New(dir, Config{})
+	require.NoError(t, err)
+	defer l.Close()
+
+	records := []*api.Record{
+		{
+			Value:   []byte("first"),
+			Offset:  3,
+			Key:     []byte("key"),
+			Headers: []*api.Header{{Key: "header", Value: []byte("value")}},
+		},
+		{Value: []byte("second"), Offset: 4},
+	}
+	stored, err := api.Compress(records, api.Compression_FLATE)
+	require.NoError(t, err)
+	p, err := proto.Marshal(stored)
+	require.NoError(t, err)
+	frame := make([]byte, frameHeaderWidth)
+	enc.PutUint64(frame[:lenWidth], uint64(len(p)))
+	enc.PutUint32(frame[lenWidth:], crc32.Checksum(p, crcTable))
+	frame = append(frame, p...)
+
+	f := &fsm{topics: singleTopic(l)}
+	require.NoError(t, f.Restore(ioutil.NopCloser(bytes.NewReader(frame))))
+	for _, want := range records {
+		record, err := l.Read(want.Offset)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, record.Value)
+		require.Equal(t, want.Key, record.Key)
+		require.Equal(t, len(want.Headers), len(record.Headers))
+		for i, header := range want.Headers {
+			require.True(t, proto.Equal(header, record.Headers[i]))
+		}
+	}
+	off, err := l.Append(&api.Record{Value: []byte("third")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+}
+
+func TestFSMProducers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsm-producers-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topics, err := NewTopics(filepath.Join(dir, "topics"), Config{})
+	require.NoError(t, err)
+	defer topics.Close()
+	f := &fsm{topics: topics}
+
+	apply := func(reqType RequestType, req proto.Message) interface{} {
+		b, err := proto.Marshal(req)
+		require.NoError(t, err)
+		return f.Apply(&raft.Log{Data: append([]byte{byte(reqType)}, b...)})
+	}
+	produce := func(sequence uint64, value string) interface{} {
+		return apply(AppendRequestType, &api.ProduceRequest{
+			Record:   &api.Record{Value: []byte(value)},
+			Producer: &api.Producer{Id: "producer", Sequence: sequence},
+		})
+	}
+
+	require.Equal(t, &api.ProduceResponse{Offset: 0}, produce(1, "first"))
+	require.Equal(t, &api.ProduceResponse{Offset: 1}, produce(2, "second"))
+	// a retry gets the offset it got the first time
+	require.Equal(t, &api.ProduceResponse{Offset: 1}, produce(2, "second"))
+	require.Equal(t, api.ErrStaleSequence{
+		Producer:     "producer",
+		Sequence:     1,
+		LastSequence: 2,
+	}, produce(1, "first"))
+	// requests without a producer are always appended
+	for i := 0; i < 2; i++ {
+		res := apply(AppendRequestType, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("anonymous")},
+		})
+		require.Equal(t, &api.ProduceResponse{Offset: uint64(2 + i)}, res)
+	}
+	batch := &api.ProduceBatchRequest{
+		Records:  []*api.Record{{Value: []byte("fifth")}, {Value: []byte("sixth")}},
+		Producer: &api.Producer{Id: "batch-producer", Sequence: 7},
+	}
+	for i := 0; i < 2; i++ {
+		res := apply(AppendBatchRequestType, batch)
+		require.Equal(t, &api.ProduceBatchResponse{FirstOffset: 4, LastOffset: 5}, res)
+	}
+	hw, err := topics.HighWatermark("")
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), hw)
+
+	// the producers' states survive a snapshot
+	snap, err := f.Snapshot()
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(snap.(*snapshot).reader)
+	require.NoError(t, err)
+	restored, err := NewTopics(filepath.Join(dir, "restored"), Config{})
+	require.NoError(t, err)
+	defer restored.Close()
+	f = &fsm{topics: restored}
+	require.NoError(t, f.Restore(ioutil.NopCloser(bytes.NewReader(b))))
+	hw, err = restored.HighWatermark("")
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), hw)
+	require.Equal(t, &api.ProduceResponse{Offset: 1}, produce(2, "second"))
+	require.Equal(t, &api.ProduceBatchResponse{FirstOffset: 4, LastOffset: 5},
+		apply(AppendBatchRequestType, batch))
+	require.Equal(t, &api.ProduceResponse{Offset: 6}, produce(3, "seventh"))
+}
+
+func TestFSMTransactions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsm-transactions-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topics, err := NewTopics(dir, Config{})
+	require.NoError(t, err)
+	defer topics.Close()
+	f := &fsm{topics: topics}
+	apply := func(reqType RequestType, req proto.Message) interface{} {
+		b, err := proto.Marshal(req)
+		require.NoError(t, err)
+		return f.Apply(&raft.Log{Data: append([]byte{byte(reqType)}, b...)})
+	}
+
+	res := apply(BeginTransactionRequestType, &api.BeginTransactionRequest{
+		Transaction: "order",
+	})
+	require.Equal(t, &api.BeginTransactionResponse{}, res)
+	res = apply(AppendRequestType, &api.ProduceRequest{
+		Record:      &api.Record{Value: []byte("order")},
+		Transaction: "order",
+	})
+	require.Equal(t, &api.ProduceResponse{Offset: 0}, res)
+	_, err = topics.ReadCommitted("", 0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, err)
+
+	// every replica appends the marker stamped by the leader
+	ts := timestamppb.New(time.Unix(1, 0))
+	res = apply(CommitTransactionRequestType, &api.Record{
+		Transaction: "order",
+		Timestamp:   ts,
+	})
+	require.Equal(t, &api.CommitTransactionResponse{}, res)
+	marker, err := topics.Read("", 1)
+	require.NoError(t, err)
+	require.Equal(t, api.Control_CONTROL_COMMIT, marker.Control)
+	require.True(t, proto.Equal(ts, marker.Timestamp))
+	record, err := topics.ReadCommitted("", 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("order"), record.Value)
+
+	res = apply(AbortTransactionRequestType, &api.Record{Transaction: "order"})
+	require.Equal(t, api.ErrTransactionNotFound{Transaction: "order"}, res)
+}
+
+func TestFSMConditionalAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsm-conditional-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topics, err := NewTopics(dir, Config{})
+	require.NoError(t, err)
+	defer topics.Close()
+	f := &fsm{topics: topics}
+	apply := func(reqType RequestType, req proto.Message) interface{} {
+		b, err := proto.Marshal(req)
+		require.NoError(t, err)
+		return f.Apply(&raft.Log{Data: append([]byte{byte(reqType)}, b...)})
+	}
+	expect := func(off uint64) *uint64 { return &off }
+
+	res := apply(AppendRequestType, &api.ProduceRequest{
+		Record:         &api.Record{Value: []byte("first")},
+		ExpectedOffset: expect(0),
+	})
+	require.Equal(t, &api.ProduceResponse{Offset: 0}, res)
+	// a writer that saw the empty log loses the race
+	res = apply(AppendRequestType, &api.ProduceRequest{
+		Record:         &api.Record{Value: []byte("lost")},
+		ExpectedOffset: expect(0),
+	})
+	require.Equal(t, api.ErrUnexpectedOffset{Expected: 0, Actual: 1}, res)
+	st := res.(api.ErrUnexpectedOffset).GRPCStatus()
+	require.Equal(t, codes.FailedPrecondition, st.Code())
+	info := st.Details()[0].(*errdetails.ErrorInfo)
+	require.Equal(t, "1", info.Metadata["actual_offset"])
+
+	res = apply(AppendBatchRequestType, &api.ProduceBatchRequest{
+		Records:        []*api.Record{{Value: []byte("second")}},
+		ExpectedOffset: expect(1),
+	})
+	require.Equal(t, &api.ProduceBatchResponse{FirstOffset: 1, LastOffset: 1}, res)
+	res = apply(AppendBatchRequestType, &api.ProduceBatchRequest{
+		Records:        []*api.Record{{Value: []byte("lost")}},
+		ExpectedOffset: expect(3),
+	})
+	require.Equal(t, api.ErrUnexpectedOffset{Expected: 3, Actual: 2}, res)
+
+	// a retry of an append that succeeded gets its offset rather than
+	// failing, the log has moved past the expected offset since
+	req := &api.ProduceRequest{
+		Record:         &api.Record{Value: []byte("third")},
+		Producer:       &api.Producer{Id: "producer", Sequence: 1},
+		ExpectedOffset: expect(2),
+	}
+	for i := 0; i < 2; i++ {
+		require.Equal(t, &api.ProduceResponse{Offset: 2}, apply(AppendRequestType, req))
+	}
+
+	// conditional appends on a key only race with appends of the key
+	key := []byte("account")
+	res = apply(AppendRequestType, &api.ProduceRequest{
+		Record:            &api.Record{Key: key, Value: []byte("opened")},
+		ExpectedKeyOffset: expect(0),
+	})
+	require.Equal(t, &api.ProduceResponse{Offset: 3}, res)
+	res = apply(AppendRequestType, &api.ProduceRequest{
+		Record: &api.Record{Key: []byte("other"), Value: []byte("other")},
+	})
+	require.Equal(t, &api.ProduceResponse{Offset: 4}, res)
+	res = apply(AppendBatchRequestType, &api.ProduceBatchRequest{
+		Records:           []*api.Record{{Key: key, Value: []byte("credited")}},
+		ExpectedKeyOffset: expect(4),
+	})
+	require.Equal(t, &api.ProduceBatchResponse{FirstOffset: 5, LastOffset: 5}, res)
+	res = apply(AppendRequestType, &api.ProduceRequest{
+		Record:            &api.Record{Key: key, Value: []byte("lost")},
+		ExpectedKeyOffset: expect(4),
+	})
+	require.Equal(t, api.ErrUnexpectedOffset{Key: key, Expected: 4, Actual: 6}, res)
+	st = res.(api.ErrUnexpectedOffset).GRPCStatus()
+	require.Equal(t, codes.FailedPrecondition, st.Code())
+	info = st.Details()[0].(*errdetails.ErrorInfo)
+	require.Equal(t, "6", info.Metadata["actual_offset"])
+
+	// a tombstone deletes the key, which has no records as far as
+	// conditional appends go, from then on and after restarts
+	res = apply(AppendRequestType, &api.ProduceRequest{
+		Record:            &api.Record{Key: key},
+		ExpectedKeyOffset: expect(6),
+	})
+	require.Equal(t, &api.ProduceResponse{Offset: 6}, res)
+	require.NoError(t, topics.Close())
+	topics, err = NewTopics(dir, Config{})
+	require.NoError(t, err)
+	f.topics = topics
+	res = apply(AppendRequestType, &api.ProduceRequest{
+		Record:            &api.Record{Key: key, Value: []byte("lost")},
+		ExpectedKeyOffset: expect(7),
+	})
+	require.Equal(t, api.ErrUnexpectedOffset{Key: key, Expected: 7, Actual: 0}, res)
+	res = apply(AppendRequestType, &api.ProduceRequest{
+		Record:            &api.Record{Key: key, Value: []byte("reopened")},
+		ExpectedKeyOffset: expect(0),
+	})
+	require.Equal(t, &api.ProduceResponse{Offset: 7}, res)
+}
+
+func TestLogStoreGetLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.InitialOffset = 1
+	ls, err := newLogStore(dir, c)
+	require.NoError(t, err)
+	defer ls.Close()
+
+	logs := []*raft.Log{
+		{Index: 1, Term: 1, Type: raft.LogCommand, Data: []byte("first")},
+		{Index: 2, Term: 3, Type: raft.LogConfiguration, Data: []byte{}},
+	}
+	require.NoError(t, ls.StoreLogs(logs))
+	for _, want := range logs {
+		got := &raft.Log{}
+		require.NoError(t, ls.GetLog(want.Index, got))
+		require.Equal(t, want, got)
+	}
+
+	// the record's value holds the term and type, clients can't set them
+	record, err := ls.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, raftLogHeaderWidth, len(record.Value))
+}
+
+func TestRaftLogVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft-log-version-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// a new stable store gets the version
+	stable, err := raftboltdb.NewBoltStore(filepath.Join(dir, "new"))
+	require.NoError(t, err)
+	defer stable.Close()
+	require.NoError(t, checkRaftLogVersion(stable))
+	require.NoError(t, stable.SetUint64([]byte("CurrentTerm"), 3))
+	require.NoError(t, checkRaftLogVersion(stable))
+	version, err := stable.GetUint64(raftLogVersionKey)
+	require.NoError(t, err)
+	require.Equal(t, uint64(raftLogVersion), version)
+
+	// one with a term but no version was written before the version was
+	old, err := raftboltdb.NewBoltStore(filepath.Join(dir, "old"))
+	require.NoError(t, err)
+	defer old.Close()
+	require.NoError(t, old.SetUint64([]byte("CurrentTerm"), 3))
+	require.ErrorIs(t, checkRaftLogVersion(old), errRaftLogFormat)
+}
+
+func TestLogStoreDeleteRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-store-delete-range-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.InitialOffset = 1
+	c.Segment.MaxIndexBytes = 2 * entWidth
+	ls, err := newLogStore(dir, c)
+	require.NoError(t, err)
+	defer ls.Close()
+
+	storeLogs := func(term uint64, indexes ...uint64) {
+		t.Helper()
+		var logs []*raft.Log
+		for _, index := range indexes {
+			logs = append(logs, &raft.Log{
+				Index: index,
+				Term:  term,
+				Type:  raft.LogCommand,
+				Data:  []byte(fmt.Sprintf("%d-%d", term, index)),
+			})
+		}
+		require.NoError(t, ls.StoreLogs(logs))
+	}
+	requireIndexes := func(first, last uint64) {
+		t.Helper()
+		got, err := ls.FirstIndex()
+		require.NoError(t, err)
+		require.Equal(t, first, got)
+		got, err = ls.LastIndex()
+		require.NoError(t, err)
+		require.Equal(t, last, got)
+	}
+	storeLogs(1, 1, 2, 3, 4, 5, 6)
+
+	// conflicting logs are deleted from the back, then replaced
+	require.NoError(t, ls.DeleteRange(4, 6))
+	requireIndexes(1, 3)
+	storeLogs(2, 4, 5)
+	requireIndexes(1, 5)
+	got := &raft.Log{}
+	require.NoError(t, ls.GetLog(4, got))
+	require.Equal(t, uint64(2), got.Term)
+	require.Equal(t, []byte("2-4"), got.Data)
+	require.NoError(t, ls.GetLog(3, got))
+	require.Equal(t, uint64(1), got.Term)
+
+	// logs in a snapshot are deleted from the front
+	require.NoError(t, ls.DeleteRange(1, 2))
+	requireIndexes(3, 5)
+
+	require.Error(t, ls.DeleteRange(4, 4))
+}
+
+func TestRaftLogConflicts(t *testing.T) {
+	nodeCount := 3
+	var (
+		rafts      []*raft.Raft
+		stores     []*logStore
+		transports []*raft.InmemTransport
+		servers    []raft.Server
+	)
+	for i := 0; i < nodeCount; i++ {
+		dir, err := ioutil.TempDir("", "raft-log-conflicts-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		c := Config{}
+		c.Segment.InitialOffset = 1
+		c.Segment.MaxIndexBytes = 4 * entWidth
+		ls, err := newLogStore(dir, c)
+		require.NoError(t, err)
+		defer ls.Close()
+		stores = append(stores, ls)
+
+		addr, transport := raft.NewInmemTransport("")
+		transports = append(transports, transport)
+		servers = append(servers, raft.Server{
+			ID:      raft.ServerID(fmt.Sprintf("%d", i)),
+			Address: addr,
+		})
+	}
+	for _, transport := range transports {
+		for _, peer := range transports {
+			transport.Connect(peer.LocalAddr(), peer)
+		}
+	}
+	for i, ls := range stores {
+		config := raft.DefaultConfig()
+		config.LocalID = servers[i].ID
+		config.HeartbeatTimeout = 50 * time.Millisecond
+		config.ElectionTimeout = 50 * time.Millisecond
+		config.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.CommitTimeout = 5 * time.Millisecond
+		config.LogOutput = ioutil.Discard
+		r, err := raft.NewRaft(
+			config,
+			&raft.MockFSM{},
+			ls,
+			raft.NewInmemStore(),
+			raft.NewInmemSnapshotStore(),
+			transports[i],
+		)
+		require.NoError(t, err)
+		defer r.Shutdown()
+		rafts = append(rafts, r)
+	}
+	err := rafts[0].BootstrapCluster(raft.Configuration{
+		Servers: servers,
+	}).Error()
+	require.NoError(t, err)
+
+	leader := func(except int) int {
+		for i, r := range rafts {
+			if i != except && r.State() == raft.Leader {
+				return i
+			}
+		}
+		return -1
+	}
+	require.Eventually(t, func() bool {
+		return leader(-1) != -1
+	}, 3*time.Second, 10*time.Millisecond)
+	old := leader(-1)
+	require.NoError(t, rafts[old].Apply([]byte("committed"), time.Second).Error())
+
+	// the old leader appends logs no other server gets
+	transports[old].DisconnectAll()
+	for i, transport := range transports {
+		if i != old {
+			transport.Disconnect(transports[old].LocalAddr())
+		}
+	}
+	var lost []raft.ApplyFuture
+	for i := 0; i < 3; i++ {
+		lost = append(lost, rafts[old].Apply([]byte("lost"), time.Second))
+	}
+
+	var next int
+	require.Eventually(t, func() bool {
+		next = leader(old)
+		return next != -1
+	}, 3*time.Second, 10*time.Millisecond)
+	for i := 0; i < 2; i++ {
+		err = rafts[next].Apply([]byte("kept"), time.Second).Error()
+		require.NoError(t, err)
+	}
+	for _, future := range lost {
+		require.Error(t, future.Error())
+	}
+
+	// once back, the old leader's conflicting logs are replaced
+	for i, transport := range transports {
+		if i != old {
+			transport.Connect(transports[old].LocalAddr(), transports[old])
+			transports[old].Connect(transport.LocalAddr(), transport)
+		}
+	}
+	want, err := stores[next].LastIndex()
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		last, err := stores[old].LastIndex()
+		if err != nil || last != want {
+			return false
+		}
+		for index := uint64(1); index <= want; index++ {
+			wantLog, gotLog := &raft.Log{}, &raft.Log{}
+			if stores[next].GetLog(index, wantLog) != nil ||
+				stores[old].GetLog(index, gotLog) != nil ||
+				!reflect.DeepEqual(wantLog, gotLog) {
+				return false
+			}
+		}
+		return true
+	}, 3*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,168 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// storeHeaderMagic starts the header of every store, followed by the ID of
+// the key its frames are encrypted with, empty for plaintext stores. It
+// marks the format of the frames, which start with their length and
+// checksum. Stores written before it have no header and frames without a
+// checksum; a frame's length starts with 0 for any frame that fits in a
+// store, so they're told apart by their first byte.
+var storeHeaderMagic = []byte("plogstr1")
+
+const nameLenWidth = 2
+
+// Keyring holds the keys segments are encrypted with. New segments are
+// encrypted with the active key, and the key's ID is written to their
+// header so they stay readable once another key is made active.
+type Keyring struct {
+	// Active is the ID of the key new segments are encrypted with.
+	Active string
+	keys   map[string]cipher.AEAD
+}
+
+// keyringFile is the format of keyring files: the ID of the active key and
+// every key by ID, base64 encoded. Keys must be 16, 24 or 32 bytes long to
+// select AES-128, AES-192 or AES-256.
+type keyringFile struct {
+	Active string            `json:"active"`
+	Keys   map[string]string `json:"keys"`
+}
+
+// LoadKeyring reads the keyring from the named file.
+func LoadKeyring(name string) (*Keyring, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var f keyringFile
+	if err = json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("keyring %s: %w", name, err)
+	}
+	k := &Keyring{Active: f.Active, keys: make(map[string]cipher.AEAD)}
+	for id, encoded := range f.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("keyring %s: key %q: %w", name, id, err)
+		}
+		if err = k.Add(id, key); err != nil {
+			return nil, fmt.Errorf("keyring %s: %w", name, err)
+		}
+	}
+	if _, err = k.aead(k.Active); err != nil {
+		return nil, fmt.Errorf("keyring %s: active %w", name, err)
+	}
+	return k, nil
+}
+
+// Add adds the key with the given ID to the keyring.
+func (k *Keyring) Add(id string, key []byte) error {
+	if id == "" || len(id) > 1<<(8*nameLenWidth)-1 {
+		return fmt.Errorf("invalid key id: %q", id)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("key %q: %w", id, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("key %q: %w", id, err)
+	}
+	if k.keys == nil {
+		k.keys = make(map[string]cipher.AEAD)
+	}
+	k.keys[id] = aead
+	return nil
+}
+
+func (k *Keyring) aead(id string) (cipher.AEAD, error) {
+	if k == nil {
+		return nil, fmt.Errorf("key %q: no keyring", id)
+	}
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("key %q: not in keyring", id)
+	}
+	return aead, nil
+}
+
+// storeHeader returns the header of a store encrypted with the given key,
+// or of a plaintext store if the key ID is empty.
+func storeHeader(keyID string) []byte {
+	return namedHeader(storeHeaderMagic, keyID)
+}
+
+// readStoreHeader reads a store header from r and returns the key ID in it.
+// ok is false, and nothing is read, if r doesn't start with a header.
+func readStoreHeader(r *bufio.Reader) (keyID string, ok bool, err error) {
+	return readNamedHeader(r, storeHeaderMagic)
+}
+
+// namedHeader returns a header made of the magic followed by the name and
+// its length.
+func namedHeader(magic []byte, name string) []byte {
+	b := make([]byte, len(magic)+nameLenWidth+len(name))
+	copy(b, magic)
+	enc.PutUint16(b[len(magic):], uint16(len(name)))
+	copy(b[len(magic)+nameLenWidth:], name)
+	return b
+}
+
+// readNamedHeader reads a header starting with the magic from r and returns
+// the name in it. ok is false, and nothing is read, if r doesn't start with
+// the magic.
+func readNamedHeader(
+	r *bufio.Reader,
+	magic []byte,
+) (name string, ok bool, err error) {
+	b, err := r.Peek(len(magic))
+	if err != nil || !bytes.Equal(b, magic) {
+		// too short for a header
+		return "", false, nil
+	}
+	if _, err = r.Discard(len(magic)); err != nil {
+		return "", false, err
+	}
+	b = make([]byte, nameLenWidth)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return "", false, err
+	}
+	id := make([]byte, enc.Uint16(b))
+	if _, err = io.ReadFull(r, id); err != nil {
+		return "", false, err
+	}
+	return string(id), true, nil
+}
+
+// seal encrypts p, prefixing it with the random nonce it was sealed with.
+func seal(aead cipher.AEAD, p []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(p)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, p, nil), nil
+}
+
+// unseal decrypts p sealed by seal. It returns errCorruptFrame if p wasn't
+// sealed with the key or was changed since.
+func unseal(aead cipher.AEAD, p []byte) ([]byte, error) {
+	if len(p) < aead.NonceSize() {
+		return nil, errCorruptFrame
+	}
+	b, err := aead.Open(nil, p[:aead.NonceSize()], p[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errCorruptFrame, err)
+	}
+	return b, nil
+}
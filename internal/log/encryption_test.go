@@ -0,0 +1,190 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/dikaeinstein/proglog/api/v1"
+)
+
+var secret = []byte("top secret")
+
+func TestLoadKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	name := writeKeyring(t, dir, "2", "1", "2")
+	k, err := LoadKeyring(name)
+	require.NoError(t, err)
+	require.Equal(t, "2", k.Active)
+	require.Equal(t, 2, len(k.keys))
+
+	name = writeKeyring(t, dir, "3", "1", "2")
+	_, err = LoadKeyring(name)
+	require.Error(t, err)
+}
+
+func TestLogEncryption(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string){
+		"encrypts stores":      testEncryptStores,
+		"reads rotated keys":   testRotateKeys,
+		"restores snapshots":   testRestoreEncrypted,
+		"rejects missing keys": testMissingKey,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "encryption-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			fn(t, dir)
+		})
+	}
+}
+
+func testEncryptStores(t *testing.T, dir string) {
+	log := newEncryptedLog(t, dir, "log", "1")
+	appendSecrets(t, log, 3)
+	// reading flushes the stores
+	requireSecrets(t, log, 0, 3)
+	requireEncrypted(t, log.Dir)
+
+	log = reopen(t, log)
+	requireSecrets(t, log, 0, 3)
+	require.NoError(t, log.Close())
+}
+
+func testRotateKeys(t *testing.T, dir string) {
+	// written before the log was encrypted
+	logDir := filepath.Join(dir, "log")
+	require.NoError(t, os.MkdirAll(logDir, 0o755))
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := New(logDir, c)
+	require.NoError(t, err)
+	appendSecrets(t, log, 2)
+	require.NoError(t, log.Close())
+
+	log = newEncryptedLog(t, dir, "log", "1")
+	appendSecrets(t, log, 2)
+	require.NoError(t, log.Close())
+
+	log = newEncryptedLog(t, dir, "log", "2")
+	appendSecrets(t, log, 2)
+	require.Equal(t, 3, len(log.segments))
+	requireSecrets(t, log, 0, 6)
+
+	for i, want := range []string{"", "1", "2"} {
+		keyID, _, err := readStoreHeader(bufio.NewReader(
+			io.NewSectionReader(log.segments[i].store, 0, 64),
+		))
+		require.NoError(t, err)
+		require.Equal(t, want, keyID)
+	}
+	require.NoError(t, log.Close())
+}
+
+func testRestoreEncrypted(t *testing.T, dir string) {
+	log := newEncryptedLog(t, dir, "log", "1")
+	appendSecrets(t, log, 2)
+	_, _, err := log.AppendCompressed([]*api.Record{
+		{Value: secret},
+		{Value: secret},
+	}, api.Compression_GZIP)
+	require.NoError(t, err)
+
+	snapshot, err := ioutil.ReadAll(log.Reader())
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(snapshot, secret))
+	require.NoError(t, log.Close())
+
+	restored := newEncryptedLog(t, dir, "restored", "2")
+	f := &fsm{topics: singleTopic(restored)}
+	require.NoError(t, f.Restore(ioutil.NopCloser(bytes.NewReader(snapshot))))
+	requireSecrets(t, restored, 0, 4)
+	requireEncrypted(t, restored.Dir)
+	require.NoError(t, restored.Close())
+}
+
+func testMissingKey(t *testing.T, dir string) {
+	log := newEncryptedLog(t, dir, "log", "1")
+	appendSecrets(t, log, 1)
+	require.NoError(t, log.Close())
+
+	k := &Keyring{Active: "2"}
+	require.NoError(t, k.Add("2", bytes.Repeat([]byte{2}, 32)))
+	c := log.Config
+	c.Segment.Keyring = k
+	_, err := New(log.Dir, c)
+	require.Error(t, err)
+}
+
+// newEncryptedLog opens the log in dir named name with a keyring holding the
+// keys "1" and "2".
+func newEncryptedLog(t *testing.T, dir, name, active string) *Log {
+	t.Helper()
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.Segment.KeyringFile = writeKeyring(t, dir, active, "1", "2")
+	logDir := filepath.Join(dir, name)
+	require.NoError(t, os.MkdirAll(logDir, 0o755))
+	log, err := New(logDir, c)
+	require.NoError(t, err)
+	return log
+}
+
+// writeKeyring writes a keyring file to dir with a key for every ID, each
+// made of the ID's first byte repeated.
+func writeKeyring(t *testing.T, dir, active string, ids ...string) string {
+	t.Helper()
+	f := keyringFile{Active: active, Keys: make(map[string]string)}
+	for _, id := range ids {
+		f.Keys[id] = base64.StdEncoding.EncodeToString(
+			bytes.Repeat([]byte{id[0]}, 32),
+		)
+	}
+	b, err := json.Marshal(f)
+	require.NoError(t, err)
+	name := filepath.Join(dir, "keyring.json")
+	require.NoError(t, ioutil.WriteFile(name, b, 0o600))
+	return name
+}
+
+func appendSecrets(t *testing.T, log *Log, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		_, err := log.Append(&api.Record{Value: secret})
+		require.NoError(t, err)
+	}
+}
+
+func requireSecrets(t *testing.T, log *Log, from, to uint64) {
+	t.Helper()
+	for off := from; off < to; off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+		require.Equal(t, secret, record.Value)
+	}
+}
+
+func requireEncrypted(t *testing.T, dir string) {
+	t.Helper()
+	stores, err := filepath.Glob(filepath.Join(dir, "*.store"))
+	require.NoError(t, err)
+	require.NotEmpty(t, stores)
+	for _, name := range stores {
+		b, err := ioutil.ReadFile(name)
+		require.NoError(t, err)
+		require.True(t, bytes.HasPrefix(b, storeHeaderMagic))
+		require.False(t, bytes.Contains(b, secret))
+	}
+}
@@ -3,6 +3,7 @@ package log
 import (
 	"io"
 	"os"
+	"sort"
 
 	"github.com/tysonmote/gommap"
 )
@@ -29,6 +30,10 @@ func newIndex(f *os.File, c Config) (*index, error) {
 		return nil, err
 	}
 	idx.size = uint64(fi.Size())
+	if idx.size > c.Segment.MaxIndexBytes {
+		// truncating the file would drop entries
+		return nil, errIndexFull
+	}
 	if err = os.Truncate(
 		f.Name(), int64(c.Segment.MaxIndexBytes),
 	); err != nil {
@@ -59,6 +64,11 @@ func (i *index) Close() error {
 	return i.file.Close()
 }
 
+// Sync commits the memory-mapped entries to stable storage.
+func (i *index) Sync() error {
+	return i.mmap.Sync(gommap.MS_SYNC)
+}
+
 // Read takes in an offset and returns the associated record’s position in
 // the store.
 func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
@@ -79,6 +89,24 @@ func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
 	return out, pos, nil
 }
 
+// Find returns the entry for the lowest relative offset at or after off.
+// Offsets are dense, so entry n is for offset n, unless the segment was
+// compacted, in which case the entries are searched.
+func (i *index) Find(off uint32) (out uint32, pos uint64, err error) {
+	n := i.size / entWidth
+	if uint64(off) < n {
+		out, pos, err = i.Read(int64(off))
+		if err != nil || out == off {
+			return out, pos, err
+		}
+	}
+	entry := sort.Search(int(n), func(j int) bool {
+		out, _, _ := i.Read(int64(j))
+		return out >= off
+	})
+	return i.Read(int64(entry))
+}
+
 // Write appends the given offset and record's position to the index.
 func (i *index) Write(off uint32, pos uint64) error {
 	if i.IsMaxed() {
@@ -91,6 +119,20 @@ func (i *index) Write(off uint32, pos uint64) error {
 	return nil
 }
 
+// Truncate removes the entries from entry n on. They're zeroed so that
+// recovering the index after a crash, before Close truncates the file,
+// doesn't bring them back.
+func (i *index) Truncate(n uint64) {
+	end := n * entWidth
+	if end >= i.size {
+		return
+	}
+	for j := end; j < i.size; j++ {
+		i.mmap[j] = 0
+	}
+	i.size = end
+}
+
 // Name returns the index’s file path.
 func (i *index) Name() string {
 	return i.file.Name()
@@ -49,6 +49,31 @@ func TestIndex(t *testing.T) {
 	require.Equal(t, entries[1].Pos, pos)
 }
 
+func TestIndexFind(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_find_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	defer idx.Close()
+	// a compacted segment's offsets have gaps
+	for _, off := range []uint32{0, 3, 4, 9} {
+		require.NoError(t, idx.Write(off, uint64(off)*10))
+	}
+	for off, want := range map[uint32]uint32{
+		0: 0, 1: 3, 3: 3, 4: 4, 5: 9, 9: 9,
+	} {
+		out, pos, err := idx.Find(off)
+		require.NoError(t, err)
+		require.Equal(t, want, out)
+		require.Equal(t, uint64(want)*10, pos)
+	}
+	_, _, err = idx.Find(10)
+	require.Equal(t, io.EOF, err)
+}
+
 func Test_newIndex(t *testing.T) {
 	type args struct {
 		f *os.File
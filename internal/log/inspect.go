@@ -0,0 +1,251 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/dikaeinstein/proglog/api/v1"
+)
+
+// SegmentStat describes a segment's files.
+type SegmentStat struct {
+	BaseOffset uint64 `json:"base_offset"`
+	NextOffset uint64 `json:"next_offset"`
+	// Entries is the number of index entries, which is less than the
+	// number of records if the segment holds compressed batches or was
+	// compacted.
+	Entries    uint64 `json:"entries"`
+	StoreBytes uint64 `json:"store_bytes"`
+	IndexBytes uint64 `json:"index_bytes"`
+	Encrypted  bool   `json:"encrypted"`
+}
+
+// Inspector reads the segments in a log's directory without changing them,
+// unlike New, which repairs segments and creates the active one. It's for
+// looking into the log of a node that's stopped.
+type Inspector struct {
+	Dir      string
+	segments []*inspectedSegment
+}
+
+type inspectedSegment struct {
+	SegmentStat
+	store   *store
+	entries []indexEntry
+	// dropped is the number of entries after the last one in order,
+	// zeroed entries excluded.
+	dropped uint64
+}
+
+type indexEntry struct {
+	off uint32
+	pos uint64
+}
+
+// Inspect opens the segments in dir read-only. Encrypted segments are read
+// with the keyring's keys; the keyring may be nil if none are encrypted.
+func Inspect(dir string, k *Keyring) (*Inspector, error) {
+	baseOffsets, err := segmentBaseOffsets(dir)
+	if err != nil {
+		return nil, err
+	}
+	i := &Inspector{Dir: dir}
+	for _, off := range baseOffsets {
+		s, err := inspectSegment(dir, off, k)
+		if err != nil {
+			i.Close()
+			return nil, err
+		}
+		i.segments = append(i.segments, s)
+	}
+	return i, nil
+}
+
+func inspectSegment(
+	dir string,
+	baseOffset uint64,
+	k *Keyring,
+) (*inspectedSegment, error) {
+	name := filepath.Join(dir, fmt.Sprint(baseOffset))
+	f, err := os.Open(name + ".store")
+	if err != nil {
+		return nil, err
+	}
+	st, err := newStore(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	// an empty store would get a header
+	if st.size > 0 {
+		if err = st.setupHeader(k); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("segment %d: %w", baseOffset, err)
+		}
+	}
+	b, err := ioutil.ReadFile(name + ".index")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		f.Close()
+		return nil, err
+	}
+	s := &inspectedSegment{store: st}
+	// the index is zero padded up to its max size until it's closed
+	for n := uint64(0); (n+1)*entWidth <= uint64(len(b)); n++ {
+		e := indexEntry{
+			off: enc.Uint32(b[n*entWidth:]),
+			pos: enc.Uint64(b[n*entWidth+offWidth:]),
+		}
+		if n > uint64(len(s.entries)) ||
+			n > 0 && (e.off <= s.entries[n-1].off ||
+				e.pos <= s.entries[n-1].pos) {
+			if e.off != 0 || e.pos != 0 {
+				s.dropped++
+			}
+			continue
+		}
+		s.entries = append(s.entries, e)
+	}
+	s.BaseOffset = baseOffset
+	s.NextOffset = baseOffset
+	if len(s.entries) > 0 {
+		s.NextOffset += uint64(s.entries[len(s.entries)-1].off) + 1
+	}
+	s.Entries = uint64(len(s.entries))
+	s.StoreBytes = st.size
+	s.IndexBytes = uint64(len(b))
+	s.Encrypted = st.aead != nil
+	return s, nil
+}
+
+// read returns the record stored for the entry and the position the
+// record's frame ends at.
+func (s *inspectedSegment) read(e indexEntry) (*api.Record, uint64, error) {
+	p, err := s.store.Read(e.pos)
+	if err != nil {
+		return nil, 0, api.ErrCorruptRecord{
+			Offset:     s.BaseOffset + uint64(e.off),
+			BaseOffset: s.BaseOffset,
+			Position:   e.pos,
+		}
+	}
+	record := &api.Record{}
+	if err = proto.Unmarshal(p, record); err != nil {
+		return nil, 0, fmt.Errorf(
+			"segment %d: record at offset %d: %w",
+			s.BaseOffset, s.BaseOffset+uint64(e.off), err,
+		)
+	}
+	return record, e.pos + s.store.frameSize(len(p)), nil
+}
+
+// Segments describes the segments, oldest first.
+func (i *Inspector) Segments() []SegmentStat {
+	stats := make([]SegmentStat, len(i.segments))
+	for j, s := range i.segments {
+		stats[j] = s.SegmentStat
+	}
+	return stats
+}
+
+// Records calls fn with the records from offset from up to, but not
+// including, offset to, in order. Compressed batches are decompressed.
+func (i *Inspector) Records(
+	from, to uint64,
+	fn func(record *api.Record) error,
+) error {
+	for _, s := range i.segments {
+		if s.NextOffset <= from || to <= s.BaseOffset {
+			continue
+		}
+		for _, e := range s.entries {
+			off := s.BaseOffset + uint64(e.off)
+			if off < from {
+				continue
+			}
+			stored, _, err := s.read(e)
+			if err != nil {
+				return err
+			}
+			records, err := api.Decompress(stored)
+			if err != nil {
+				return err
+			}
+			for _, record := range records {
+				if record.Offset < from || to <= record.Offset {
+					continue
+				}
+				if err = fn(record); err != nil {
+					return err
+				}
+			}
+			if to <= off+1 {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// Verify checks that every index entry points at a store frame that
+// decodes to the record indexed, and that the stores hold nothing past
+// their last indexed frame. It returns every problem it finds.
+func (i *Inspector) Verify() []error {
+	var problems []error
+	for _, s := range i.segments {
+		if s.dropped > 0 {
+			problems = append(problems, fmt.Errorf(
+				"segment %d: %d index entries out of order",
+				s.BaseOffset, s.dropped,
+			))
+		}
+		end := s.store.start
+		for _, e := range s.entries {
+			off := s.BaseOffset + uint64(e.off)
+			stored, frameEnd, err := s.read(e)
+			if err != nil {
+				problems = append(problems, err)
+				continue
+			}
+			end = frameEnd
+			// compressed batches are indexed by their last offset
+			last := stored.Offset
+			if stored.Compression != api.Compression_NONE {
+				last = stored.LastOffset
+			}
+			if last != off {
+				problems = append(problems, fmt.Errorf(
+					"segment %d: index entry for offset %d points at offset %d",
+					s.BaseOffset, off, last,
+				))
+			}
+			if _, err = api.Decompress(stored); err != nil {
+				problems = append(problems, fmt.Errorf(
+					"segment %d: record at offset %d: %w",
+					s.BaseOffset, off, err,
+				))
+			}
+		}
+		if end < s.store.size {
+			problems = append(problems, fmt.Errorf(
+				"segment %d: %d store bytes past the last indexed record",
+				s.BaseOffset, s.store.size-end,
+			))
+		}
+	}
+	return problems
+}
+
+// Close closes the segments' files.
+func (i *Inspector) Close() error {
+	for _, s := range i.segments {
+		if err := s.store.file.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
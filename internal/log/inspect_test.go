@@ -0,0 +1,87 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/dikaeinstein/proglog/api/v1"
+)
+
+func TestInspect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inspect-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := New(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	_, _, err = log.AppendCompressed([]*api.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+	}, api.Compression_GZIP)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+	before := readDir(t, dir)
+
+	i, err := Inspect(dir, nil)
+	require.NoError(t, err)
+	segments := i.Segments()
+	require.Equal(t, 2, len(segments))
+	require.Equal(t, uint64(0), segments[0].BaseOffset)
+	require.Equal(t, uint64(2), segments[0].NextOffset)
+	// the compressed batch takes a single entry
+	require.Equal(t, uint64(2), segments[1].Entries)
+	require.Equal(t, uint64(5), segments[1].NextOffset)
+
+	var offsets []uint64
+	require.NoError(t, i.Records(1, 4, func(record *api.Record) error {
+		offsets = append(offsets, record.Offset)
+		return nil
+	}))
+	require.Equal(t, []uint64{1, 2, 3}, offsets)
+	require.Empty(t, i.Verify())
+	require.NoError(t, i.Close())
+
+	// inspecting doesn't change the files, New would have padded the
+	// indexes and created a segment
+	require.Equal(t, before, readDir(t, dir))
+
+	// corrupt the second record and append a torn frame
+	store := filepath.Join(dir, "0.store")
+	b, err := ioutil.ReadFile(store)
+	require.NoError(t, err)
+	b[len(b)-1]++
+	b = append(b, 0, 0, 0)
+	require.NoError(t, ioutil.WriteFile(store, b, 0o644))
+
+	i, err = Inspect(dir, nil)
+	require.NoError(t, err)
+	defer i.Close()
+	problems := i.Verify()
+	require.Equal(t, 2, len(problems))
+	require.Equal(t, uint64(1), problems[0].(api.ErrCorruptRecord).Offset)
+	require.Contains(t, problems[1].Error(), "past the last indexed record")
+}
+
+// readDir returns the contents of the files in dir by name.
+func readDir(t *testing.T, dir string) map[string][]byte {
+	t.Helper()
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	contents := make(map[string][]byte)
+	for _, file := range files {
+		b, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		require.NoError(t, err)
+		contents[file.Name()] = b
+	}
+	return contents
+}
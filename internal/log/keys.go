@@ -0,0 +1,139 @@
+package log
+
+import (
+	"sync"
+
+	api "github.com/dikaeinstein/proglog/api/v1"
+)
+
+// keyIndex maps the keys of a topic's records to the offset of the newest
+// record with the key, as conditional appends on a key need it. It's built
+// from the topic's records the first time it's needed, and only kept up to
+// date with the records appended since, so topics nobody appends to
+// conditionally on a key don't pay for it.
+type keyIndex struct {
+	mu    sync.Mutex
+	built bool
+	// newest maps the keys to their newest record. Tombstones are kept
+	// rather than removed so that observing a record again is harmless.
+	newest map[string]keyRecord
+}
+
+type keyRecord struct {
+	offset    uint64
+	tombstone bool
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{newest: make(map[string]keyRecord)}
+}
+
+// observe indexes the records appended from offset first on, in order,
+// unless the index isn't built yet.
+func (x *keyIndex) observe(first uint64, records []*api.Record) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if !x.built {
+		return
+	}
+	for i, record := range records {
+		x.add(record, first+uint64(i))
+	}
+}
+
+// add indexes the record appended at offset off. It must be called with
+// the lock held.
+func (x *keyIndex) add(record *api.Record, off uint64) {
+	if len(record.Key) == 0 {
+		return
+	}
+	key := string(record.Key)
+	if r, ok := x.newest[key]; ok && r.offset > off {
+		return
+	}
+	x.newest[key] = keyRecord{offset: off, tombstone: len(record.Value) == 0}
+}
+
+// nextOffset returns the offset past the newest record with the key in the
+// log, or 0 if the key has none: if it was never appended, its newest
+// record is a tombstone, or retention removed it. Compaction keeps the
+// newest record of every key and tombstones are as good as gone, so the
+// offset doesn't depend on when the log was compacted.
+func (x *keyIndex) nextOffset(l Storage, key []byte) (uint64, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if !x.built {
+		if err := x.build(l); err != nil {
+			return 0, err
+		}
+	}
+	r, ok := x.newest[string(key)]
+	if !ok || r.tombstone {
+		return 0, nil
+	}
+	lowest, err := l.LowestOffset()
+	if err != nil {
+		return 0, err
+	}
+	if r.offset < lowest {
+		return 0, nil
+	}
+	return r.offset + 1, nil
+}
+
+// build indexes every record the log holds. It must be called with the
+// lock held.
+func (x *keyIndex) build(l Storage) error {
+	off, err := l.LowestOffset()
+	if err != nil {
+		return err
+	}
+	hw, err := l.HighWatermark()
+	if err != nil {
+		return err
+	}
+	for off < hw {
+		stored, err := l.ReadRaw(off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			break
+		} else if err != nil {
+			return err
+		}
+		records, err := api.Decompress(stored)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			x.add(record, record.Offset)
+		}
+		off = lastOffset(stored) + 1
+	}
+	x.built = true
+	return nil
+}
+
+// KeyOffset returns the offset past the newest record with the key in the
+// topic, see keyIndex.nextOffset.
+func (t *Topics) KeyOffset(topic string, key []byte) (uint64, error) {
+	l, err := t.Topic(topic)
+	if err != nil {
+		return 0, err
+	}
+	return t.keyIndex(topic).nextOffset(l, key)
+}
+
+// keyIndex returns the topic's key index.
+func (t *Topics) keyIndex(topic string) *keyIndex {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.keys[topic]
+}
+
+// indexKeys indexes the records appended to the topic from offset first on,
+// see keyIndex.observe.
+func (t *Topics) indexKeys(topic string, first uint64, records []*api.Record) {
+	// the topic may have been deleted since
+	if x := t.keyIndex(topic); x != nil {
+		x.observe(first, records)
+	}
+}
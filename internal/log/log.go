@@ -1,14 +1,27 @@
 package log
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	api "github.com/dikaeinstein/proglog/api/v1"
 )
@@ -19,6 +32,27 @@ type Log struct {
 	Config        Config
 	activeSegment *segment
 	segments      []*segment
+	logger        *zap.Logger
+	// maintenance serializes the operations that remove or rewrite sealed
+	// segments.
+	maintenance sync.Mutex
+	// unsynced is the number of bytes appended to the active segment since
+	// it was last fsynced.
+	unsynced uint64
+	// pending is the batch of appends the next fsync of the active segment
+	// covers, which wait for it with SyncPeriodic.
+	pending *syncBatch
+	// done is closed to stop the log's background goroutines.
+	done chan struct{}
+	wg   sync.WaitGroup
+	// remote describes the segments that were offloaded to the object
+	// store and removed from local disk, oldest first. They're all older
+	// than the local segments.
+	remote []SegmentInfo
+	cache  *segmentCache
+	// appended is closed, and replaced, whenever records are appended to
+	// wake up WaitForOffset.
+	appended chan struct{}
 }
 
 // New create and setup Log instance.
@@ -29,20 +63,93 @@ func New(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
+	if c.Segment.TimeIndexIntervalBytes == 0 {
+		c.Segment.TimeIndexIntervalBytes = 4096
+	}
+	if c.Segment.Sync == "" {
+		c.Segment.Sync = SyncOS
+	}
+	if c.Segment.Sync == SyncPeriodic && c.Segment.SyncInterval == 0 {
+		c.Segment.SyncInterval = 10 * time.Millisecond
+	}
+	if (c.Segment.RetentionBytes > 0 || c.Segment.RetentionAge > 0) &&
+		c.Segment.CleanupInterval == 0 {
+		c.Segment.CleanupInterval = time.Minute
+	}
+	if c.Segment.Compact && c.Segment.CompactionInterval == 0 {
+		c.Segment.CompactionInterval = time.Minute
+	}
+	if c.Segment.TombstoneRetention == 0 {
+		c.Segment.TombstoneRetention = 24 * time.Hour
+	}
+	if c.Segment.ObjectStore != nil && c.Segment.OffloadInterval == 0 {
+		c.Segment.OffloadInterval = time.Minute
+	}
+	if c.Segment.KeyringFile != "" && c.Segment.Keyring == nil {
+		k, err := LoadKeyring(c.Segment.KeyringFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Segment.Keyring = k
+	}
 	l := &Log{
 		Dir:    dir,
 		Config: c,
+		logger: zap.L().Named("log"),
 	}
 	return l, l.setup()
 }
 
-func (l *Log) setup() error {
-	files, err := ioutil.ReadDir(l.Dir)
+// RebuildIndexes regenerates the indexes of the segments in dir from their
+// stores, for indexes damaged in ways New doesn't notice. New rebuilds
+// indexes that are missing or point past the end of their store by itself.
+// The indexes are sized to fit their stores, whatever c's MaxIndexBytes.
+// The log in dir must not be open.
+func RebuildIndexes(dir string, c Config) error {
+	baseOffsets, err := segmentBaseOffsets(dir)
+	if err != nil || len(baseOffsets) == 0 {
+		return err
+	}
+	for _, off := range baseOffsets {
+		// every entry is indexed again when the log is set up
+		name := filepath.Join(dir, fmt.Sprintf("%d%s", off, ".index"))
+		if err = os.Truncate(name, 0); err != nil &&
+			!errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		fi, err := os.Stat(
+			filepath.Join(dir, fmt.Sprintf("%d%s", off, ".store")),
+		)
+		if err != nil {
+			return err
+		}
+		// every frame is at least a header, so this bounds their number
+		maxIndexBytes := uint64(fi.Size()) / frameHeaderWidth * entWidth
+		if maxIndexBytes > c.Segment.MaxIndexBytes {
+			c.Segment.MaxIndexBytes = maxIndexBytes
+		}
+	}
+	l, err := New(dir, c)
 	if err != nil {
 		return err
 	}
+	return l.Close()
+}
+
+// segmentBaseOffsets returns the base offsets of the segments in dir, in
+// order.
+func segmentBaseOffsets(dir string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
 	var baseOffsets []uint64
 	for _, file := range files {
+		// every segment has a store file, the other files are named
+		// after the same base offset
+		if path.Ext(file.Name()) != ".store" {
+			continue
+		}
 		offStr := strings.TrimSuffix(
 			file.Name(),
 			path.Ext(file.Name()),
@@ -53,65 +160,579 @@ func (l *Log) setup() error {
 	sort.Slice(baseOffsets, func(i, j int) bool {
 		return baseOffsets[i] < baseOffsets[j]
 	})
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
+	return baseOffsets, nil
+}
+
+func (l *Log) setup() error {
+	if err := l.finishCompaction(); err != nil {
+		return err
+	}
+	baseOffsets, err := segmentBaseOffsets(l.Dir)
+	if err != nil {
+		return err
+	}
+	for _, off := range baseOffsets {
+		if err = l.newSegment(off); err != nil {
 			return err
 		}
-		// baseOffset contains dup for index and store so we skip
-		// the dup
-		i++
 	}
-	if l.segments == nil {
-		if err = l.newSegment(
-			l.Config.Segment.InitialOffset,
+	for i, s := range l.segments {
+		if err = l.recover(s, i == len(l.segments)-1); err != nil {
+			return err
+		}
+		// a compacted segment may have lost its last records, its
+		// offsets run up to the next segment's
+		if i > 0 {
+			l.segments[i-1].nextOffset = s.baseOffset
+		}
+	}
+	if l.Config.Segment.ObjectStore != nil {
+		if err = l.loadRemote(); err != nil {
+			return err
+		}
+		if l.cache, err = newSegmentCache(
+			filepath.Join(l.Dir, cacheDir),
+			l.Config,
 		); err != nil {
 			return err
 		}
 	}
+	if l.segments == nil {
+		off := l.Config.Segment.InitialOffset
+		if len(l.remote) > 0 {
+			off = l.remote[len(l.remote)-1].NextOffset
+		}
+		if err = l.newSegment(off); err != nil {
+			return err
+		}
+	}
+
+	if l.appended == nil {
+		l.appended = make(chan struct{})
+	}
+	if l.pending == nil {
+		l.pending = newSyncBatch()
+	}
+	l.done = make(chan struct{})
+	if l.Config.Segment.Sync == SyncPeriodic &&
+		l.Config.Segment.SyncInterval > 0 {
+		l.every(l.Config.Segment.SyncInterval, "sync", l.syncUnsynced)
+	}
+	if l.Config.Segment.CleanupInterval > 0 {
+		l.every(l.Config.Segment.CleanupInterval, "clean", func() error {
+			_, err := l.Clean()
+			return err
+		})
+	}
+	if l.Config.Segment.Compact {
+		l.every(l.Config.Segment.CompactionInterval, "compact", l.Compact)
+	}
+	if l.Config.Segment.ObjectStore != nil {
+		l.every(l.Config.Segment.OffloadInterval, "offload", l.Offload)
+	}
 	return nil
 }
 
+// every runs fn every interval in the background until the log is closed.
+func (l *Log) every(interval time.Duration, task string, fn func() error) {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.done:
+				return
+			case <-ticker.C:
+				if err := fn(); err != nil {
+					l.logger.Error(
+						"background task failed",
+						zap.String("task", task),
+						zap.String("dir", l.Dir),
+						zap.Error(err),
+					)
+				}
+			}
+		}
+	}()
+}
+
+// recover repairs the given segment if a crash left its index or store
+// inconsistent and logs what was repaired. Only the active segment's store
+// is repaired.
+func (l *Log) recover(s *segment, active bool) error {
+	r, err := s.recover(active)
+	if err != nil {
+		return err
+	}
+	if r.droppedEntries > 0 || r.reindexedEntries > 0 || r.truncatedBytes > 0 {
+		l.logger.Warn(
+			"repaired segment",
+			zap.String("dir", l.Dir),
+			zap.Uint64("base_offset", s.baseOffset),
+			zap.Uint64("next_offset", s.nextOffset),
+			zap.Uint64("dropped_index_entries", r.droppedEntries),
+			zap.Uint64("reindexed_entries", r.reindexedEntries),
+			zap.Uint64("truncated_store_bytes", r.truncatedBytes),
+		)
+	}
+	if r.unindexedBytes > 0 {
+		l.logger.Warn(
+			"sealed segment has unindexed bytes",
+			zap.String("dir", l.Dir),
+			zap.Uint64("base_offset", s.baseOffset),
+			zap.Uint64("unindexed_store_bytes", r.unindexedBytes),
+		)
+	}
+	return nil
+}
+
+// Append appends the record to the log and returns its offset. Records
+// without a timestamp are stamped with the current time.
 func (l *Log) Append(record *api.Record) (uint64, error) {
-	// HighestOffset() acquires the lock
-	// call here to avoid recursive locking (not permitted by sync.RWMutex)
-	highestOffset, err := l.HighestOffset()
+	if record.Timestamp == nil {
+		record.Timestamp = timestamppb.Now()
+	}
+
+	l.mu.Lock()
+	off, batch, err := l.append(record, l.activeSegment.nextOffset)
+	l.mu.Unlock()
 	if err != nil {
 		return 0, err
 	}
+	return off, batch.wait()
+}
+
+// errEmptyBatch is returned when appending a batch without records.
+var errEmptyBatch = errors.New("empty batch")
+
+// AppendBatch appends the records to the log at contiguous offsets and
+// returns the offsets of the first and last records. The records are
+// written to each segment they span with a single write and flushed once,
+// rolling segments partway through the batch as they fill up. Records
+// without a timestamp are stamped with the current time.
+func (l *Log) AppendBatch(records []*api.Record) (
+	first, last uint64,
+	err error,
+) {
+	if len(records) == 0 {
+		return 0, 0, errEmptyBatch
+	}
+	now := time.Now()
+	for _, record := range records {
+		if record.Timestamp == nil {
+			record.Timestamp = timestamppb.New(now)
+		}
+	}
 
 	l.mu.Lock()
-	defer l.mu.Unlock()
+	first, last, batch, err := l.appendBatch(records)
+	l.mu.Unlock()
+	if err != nil {
+		return 0, 0, err
+	}
+	return first, last, batch.wait()
+}
+
+// appendBatch appends the records like AppendBatch and returns the batch
+// of appends to wait for, see sync. It must be called with the write lock
+// held.
+func (l *Log) appendBatch(records []*api.Record) (
+	first, last uint64,
+	batch *syncBatch,
+	err error,
+) {
+	first = l.activeSegment.nextOffset
+	for len(records) > 0 {
+		if l.activeSegment.IsMaxed() {
+			if err = l.roll(l.activeSegment.nextOffset); err != nil {
+				return 0, 0, nil, err
+			}
+		}
+		size := l.activeSegment.store.size
+		var n int
+		n, err = l.activeSegment.AppendBatch(records)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		l.unsynced += l.activeSegment.store.size - size
+		if batch, err = l.sync(); err != nil {
+			return 0, 0, nil, err
+		}
+		records = records[n:]
+	}
+	l.notifyAppended()
+	return first, l.activeSegment.nextOffset - 1, batch, nil
+}
+
+// AppendCompressed appends the records to the log at contiguous offsets as
+// a single batch compressed with the given codec and returns the offsets of
+// the first and last records. Unlike AppendBatch, the batch isn't split
+// across segments. Without compression it's the same as AppendBatch.
+func (l *Log) AppendCompressed(records []*api.Record, c api.Compression) (
+	first, last uint64,
+	err error,
+) {
+	if c == api.Compression_NONE {
+		return l.AppendBatch(records)
+	}
+	if len(records) == 0 {
+		return 0, 0, errEmptyBatch
+	}
+	now := time.Now()
+	for _, record := range records {
+		if record.Timestamp == nil {
+			record.Timestamp = timestamppb.New(now)
+		}
+	}
+
+	l.mu.Lock()
+	first, last, batch, err := l.appendCompressed(records, c)
+	l.mu.Unlock()
+	if err != nil {
+		return 0, 0, err
+	}
+	return first, last, batch.wait()
+}
 
+// appendCompressed appends the records like AppendCompressed and returns
+// the batch of appends to wait for, see sync. It must be called with the
+// write lock held.
+func (l *Log) appendCompressed(records []*api.Record, c api.Compression) (
+	first, last uint64,
+	batch *syncBatch,
+	err error,
+) {
 	if l.activeSegment.IsMaxed() {
-		if err := l.newSegment(highestOffset + 1); err != nil {
-			return 0, err
+		if err = l.roll(l.activeSegment.nextOffset); err != nil {
+			return 0, 0, nil, err
+		}
+	}
+	size := l.activeSegment.store.size
+	first = l.activeSegment.nextOffset
+	if last, err = l.activeSegment.AppendCompressed(records, c); err != nil {
+		return 0, 0, nil, err
+	}
+	l.unsynced += l.activeSegment.store.size - size
+	if batch, err = l.sync(); err != nil {
+		return 0, 0, nil, err
+	}
+	l.notifyAppended()
+	return first, last, batch, nil
+}
+
+// AppendAt appends the record at its own offset rather than the log's next
+// offset, leaving a gap in the log's offsets if it's past the next offset.
+// It's used to restore compacted logs.
+func (l *Log) AppendAt(record *api.Record) error {
+	l.mu.Lock()
+	if next := l.activeSegment.nextOffset; record.Offset < next {
+		l.mu.Unlock()
+		return fmt.Errorf(
+			"append at offset %d: log is at offset %d",
+			record.Offset,
+			next,
+		)
+	}
+	_, batch, err := l.append(record, record.Offset)
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return batch.wait()
+}
+
+// append appends the record at the given offset, which must not be lower
+// than the active segment's next offset, and returns the batch of appends
+// to wait for, see sync. It must be called with the write lock held.
+func (l *Log) append(record *api.Record, off uint64) (
+	uint64,
+	*syncBatch,
+	error,
+) {
+	if l.activeSegment.IsMaxed() {
+		if err := l.roll(off); err != nil {
+			return 0, nil, err
 		}
 	}
 
+	size := l.activeSegment.store.size
+	l.activeSegment.nextOffset = off
 	off, err := l.activeSegment.Append(record)
 	if err != nil {
-		return 0, err
+		return 0, nil, err
+	}
+	l.unsynced += l.activeSegment.store.size - size
+	batch, err := l.sync()
+	if err != nil {
+		return 0, nil, err
+	}
+	l.notifyAppended()
+	return off, batch, nil
+}
+
+// sync makes sure the records appended to the active segment satisfy the
+// configured SyncPolicy, or will once the returned batch of appends is
+// done: with SyncPeriodic, appends wait outside the lock for the next fsync
+// unless they're the ones whose bytes trigger it. It must be called with
+// the write lock held.
+func (l *Log) sync() (*syncBatch, error) {
+	switch l.Config.Segment.Sync {
+	case SyncAlways:
+		return nil, l.syncActiveSegment()
+	case SyncPeriodic:
+		if l.Config.Segment.SyncBytes > 0 &&
+			l.unsynced >= l.Config.Segment.SyncBytes {
+			return nil, l.syncActiveSegment()
+		}
+		return l.pending, l.activeSegment.store.Flush()
+	}
+	return nil, l.activeSegment.store.Flush()
+}
+
+// syncBatch is a group of appends waiting for the fsync that covers them.
+// done is closed once the fsync is done, and err is its error.
+type syncBatch struct {
+	done chan struct{}
+	err  error
+}
+
+func newSyncBatch() *syncBatch {
+	return &syncBatch{done: make(chan struct{})}
+}
+
+// wait blocks until the batch is done and returns the fsync's error. A nil
+// batch has nothing to wait for.
+func (b *syncBatch) wait() error {
+	if b == nil {
+		return nil
+	}
+	<-b.done
+	return b.err
+}
+
+// notifyAppended wakes up the callers of WaitForOffset. It must be called
+// with the write lock held.
+func (l *Log) notifyAppended() {
+	close(l.appended)
+	l.appended = make(chan struct{})
+}
+
+// WaitForOffset blocks until the log has a record at or past offset off,
+// or ctx is done, in which case it returns ctx's error. Readers tailing the
+// log use it to wait for records to be appended rather than polling.
+func (l *Log) WaitForOffset(ctx context.Context, off uint64) error {
+	for {
+		l.mu.RLock()
+		next := l.activeSegment.nextOffset
+		appended := l.appended
+		l.mu.RUnlock()
+		if off < next {
+			return nil
+		}
+		select {
+		case <-appended:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
-	return off, err
 }
 
+// syncUnsynced fsyncs the active segment if anything was appended since it
+// was last fsynced.
+func (l *Log) syncUnsynced() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.unsynced == 0 {
+		return nil
+	}
+	return l.syncActiveSegment()
+}
+
+// syncActiveSegment fsyncs the active segment and ends the pending batch of
+// appends, which get the fsync's error.
+func (l *Log) syncActiveSegment() error {
+	err := l.activeSegment.Sync()
+	if err == nil {
+		l.unsynced = 0
+	}
+	l.pending.err = err
+	close(l.pending.done)
+	l.pending = newSyncBatch()
+	return err
+}
+
+// roll seals the active segment and starts a new one at the given offset.
+// Unless the OS manages durability, the sealed segment is fsynced first so
+// that only the active segment can hold unsynced records.
+func (l *Log) roll(off uint64) error {
+	if l.Config.Segment.Sync != SyncOS {
+		if err := l.syncActiveSegment(); err != nil {
+			return err
+		}
+	}
+	return l.newSegment(off)
+}
+
+// Read returns the record at the given offset. If compaction removed that
+// record, it returns the log's next record instead, so sequential readers
+// should carry on from the returned record's offset.
 func (l *Log) Read(off uint64) (*api.Record, error) {
+	return l.read(off, (*segment).Read)
+}
+
+// ReadRaw returns the record at the given offset like Read does, except
+// that if it was appended in a compressed batch it returns the batch as
+// stored. Sequential readers should carry on from the batch's last offset.
+func (l *Log) ReadRaw(off uint64) (*api.Record, error) {
+	return l.read(off, (*segment).ReadRaw)
+}
+
+// ReadRange returns the records from offset from on, in order, reading the
+// segments sequentially. It stops after maxRecords records, or before the
+// records' marshalled size exceeds maxBytes; zero limits aren't enforced.
+// The first record is returned however large it is so that readers always
+// make progress. It returns api.ErrOffsetOutOfRange if there's no record at
+// or after from.
+func (l *Log) ReadRange(
+	from uint64,
+	maxRecords int,
+	maxBytes uint64,
+) ([]*api.Record, error) {
+	return readRange(l.ReadRaw, from, maxRecords, maxBytes)
+}
+
+// readRange implements ReadRange on top of ReadRaw.
+func readRange(
+	readRaw func(off uint64) (*api.Record, error),
+	from uint64,
+	maxRecords int,
+	maxBytes uint64,
+) ([]*api.Record, error) {
+	var records []*api.Record
+	var size uint64
+	for off := from; maxRecords == 0 || len(records) < maxRecords; {
+		stored, err := readRaw(off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok && len(records) > 0 {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		batch, err := api.Decompress(stored)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range batch {
+			if record.Offset < off {
+				continue
+			}
+			size += uint64(proto.Size(record))
+			if maxBytes > 0 && size > maxBytes && len(records) > 0 {
+				return records, nil
+			}
+			records = append(records, record)
+			if len(records) == maxRecords {
+				return records, nil
+			}
+		}
+		off = stored.Offset + 1
+		if stored.Compression != api.Compression_NONE {
+			off = stored.LastOffset + 1
+		}
+	}
+	return records, nil
+}
+
+func (l *Log) read(
+	off uint64,
+	read func(s *segment, off uint64) (*api.Record, error),
+) (*api.Record, error) {
 	l.mu.RLock()
+	for len(l.remote) > 0 &&
+		l.remote[0].BaseOffset <= off &&
+		off < l.segments[0].baseOffset {
+		// fetching an offloaded segment can be slow, so don't hold up
+		// appends and local reads meanwhile
+		remote, next := l.remote, l.segments[0].baseOffset
+		l.mu.RUnlock()
+		record, err := l.readRemote(remote, off, read)
+		if err != io.EOF {
+			return record, err
+		}
+		// the rest of the offloaded segments were compacted away
+		off = next
+		l.mu.RLock()
+	}
 	defer l.mu.RUnlock()
-	var s *segment
-	for _, segment := range l.segments {
-		if segment.baseOffset <= off && off < segment.nextOffset {
-			s = segment
-			break
+	for i, s := range l.segments {
+		if s.nextOffset <= off {
+			continue
+		}
+		if off < s.baseOffset {
+			if i == 0 {
+				break
+			}
+			// the offsets between segments were compacted away
+			off = s.baseOffset
+		}
+		record, err := read(s, off)
+		if err == io.EOF {
+			// the rest of the segment was compacted away
+			continue
+		}
+		return record, err
+	}
+	return nil, api.ErrOffsetOutOfRange{Offset: off}
+}
+
+// OffsetForTime returns the offset of the first record appended at or after
+// t. If every record was appended before t, it returns the offset the next
+// record will be appended at.
+func (l *Log) OffsetForTime(t time.Time) (uint64, error) {
+	ts := t.UnixNano()
+	// the offloaded segments below from were searched
+	var from uint64
+	l.mu.RLock()
+	for len(l.remote) > 0 && l.remote[len(l.remote)-1].NextOffset > from {
+		// fetching an offloaded segment can be slow, so don't hold up
+		// appends meanwhile
+		remote := l.remote
+		l.mu.RUnlock()
+		off, ok, err := l.offsetForTimeRemote(remote, from, ts)
+		if err != nil || ok {
+			return off, err
 		}
+		from = remote[len(remote)-1].NextOffset
+		l.mu.RLock()
 	}
-	if s == nil || s.nextOffset <= off {
-		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	defer l.mu.RUnlock()
+	for _, s := range l.segments {
+		off, ok, err := s.OffsetForTime(ts)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return off, nil
+		}
 	}
-	return s.Read(off)
+	return l.activeSegment.nextOffset, nil
 }
 
 func (l *Log) Close() error {
+	if l.done != nil {
+		close(l.done)
+		l.wg.Wait()
+		l.done = nil
+	}
+	// the appends still waiting for an fsync get it
+	if l.Config.Segment.Sync == SyncPeriodic {
+		if err := l.syncUnsynced(); err != nil {
+			return err
+		}
+	}
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	for _, segment := range l.segments {
@@ -120,7 +741,7 @@ func (l *Log) Close() error {
 		}
 	}
 
-	return nil
+	return l.cache.Close()
 }
 
 func (l *Log) Remove() error {
@@ -130,16 +751,45 @@ func (l *Log) Remove() error {
 	return os.RemoveAll(l.Dir)
 }
 
-func (l *Log) Reset() error {
+// Delete removes the log, including the segments offloaded to the object
+// store.
+func (l *Log) Delete() error {
 	if err := l.Remove(); err != nil {
 		return err
 	}
-	return l.setup()
+	return l.removeAllRemote()
+}
+
+// Reset removes the log, including the segments offloaded to the object
+// store, and sets it up again empty, the next record to be appended at
+// offset off.
+func (l *Log) Reset(off uint64) error {
+	if err := l.Delete(); err != nil {
+		return err
+	}
+	l.Config.Segment.InitialOffset = off
+	if err := os.MkdirAll(l.Dir, 0o755); err != nil {
+		return err
+	}
+	l.segments = nil
+	l.activeSegment = nil
+	l.cache = nil
+	if err := l.setup(); err != nil {
+		return err
+	}
+	// the restored log may be past the offsets waited for
+	l.mu.Lock()
+	l.notifyAppended()
+	l.mu.Unlock()
+	return nil
 }
 
 func (l *Log) LowestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	if len(l.remote) > 0 {
+		return l.remote[0].BaseOffset, nil
+	}
 	return l.segments[0].baseOffset, nil
 }
 
@@ -153,7 +803,56 @@ func (l *Log) HighestOffset() (uint64, error) {
 	return off - 1, nil
 }
 
+// HighWatermark returns the offset the next record will be appended at.
+func (l *Log) HighWatermark() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.activeSegment.nextOffset, nil
+}
+
+// TruncateFrom removes the records from offset off on, so the next record
+// is appended at off. Segments that only hold such records are removed and
+// the last remaining segment is cut short and becomes the active segment.
+// Records offloaded to the object store can't be removed this way.
+func (l *Log) TruncateFrom(off uint64) error {
+	l.maintenance.Lock()
+	defer l.maintenance.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if off >= l.activeSegment.nextOffset {
+		return nil
+	}
+	if len(l.remote) > 0 && off < l.segments[0].baseOffset {
+		return fmt.Errorf(
+			"truncate from offset %d: offsets below %d were offloaded",
+			off,
+			l.segments[0].baseOffset,
+		)
+	}
+	for len(l.segments) > 0 {
+		s := l.segments[len(l.segments)-1]
+		if s.baseOffset < off {
+			break
+		}
+		if err := s.Remove(); err != nil {
+			return err
+		}
+		l.segments = l.segments[:len(l.segments)-1]
+	}
+	if len(l.segments) == 0 {
+		return l.newSegment(off)
+	}
+	l.activeSegment = l.segments[len(l.segments)-1]
+	l.unsynced = 0
+	if err := l.activeSegment.Truncate(off); err != nil {
+		return err
+	}
+	return l.syncActiveSegment()
+}
+
 func (l *Log) Truncate(lowest uint64) error {
+	l.maintenance.Lock()
+	defer l.maintenance.Unlock()
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	var segments []*segment
@@ -170,25 +869,120 @@ func (l *Log) Truncate(lowest uint64) error {
 	return nil
 }
 
+// Reader returns a reader of the log's records framed as the store frames
+// them. Compressed batches are decompressed into a frame per record, and
+// offloaded segments are read from the object store. Encrypted frames are
+// read as they are, each store's frames preceded by the header naming their
+// key.
 func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	readers := make([]io.Reader, len(l.segments))
-	for i, segment := range l.segments {
-		readers[i] = &originReader{segment.store, 0}
+	var readers []io.Reader
+	for _, info := range l.remote {
+		readers = append(readers, newRecordReader(&remoteReader{
+			objects: l.Config.Segment.ObjectStore,
+			name:    objectName(info.BaseOffset, ".store"),
+		}, l.Config.Segment.Keyring))
+	}
+	for _, segment := range l.segments {
+		readers = append(readers, newRecordReader(io.NewSectionReader(
+			segment.store,
+			0,
+			int64(segment.store.size),
+		), l.Config.Segment.Keyring))
 	}
 	return io.MultiReader(readers...)
 }
 
-type originReader struct {
-	*store
-	off int64
+// recordReader reads a store's frames from its start.
+type recordReader struct {
+	r       *bufio.Reader
+	keyring *Keyring
+	aead    cipher.AEAD
+	started bool
+	buf     bytes.Buffer
+}
+
+func newRecordReader(r io.Reader, k *Keyring) *recordReader {
+	return &recordReader{r: bufio.NewReader(r), keyring: k}
+}
+
+func (r *recordReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	return r.buf.Read(p)
 }
 
-func (o *originReader) Read(p []byte) (int, error) {
-	n, err := o.ReadAt(p, o.off)
-	o.off += int64(n)
-	return n, err
+// next buffers the next frame, or the frames of the records in it if it
+// holds a compressed batch. The store's header is buffered first when the
+// store or the log is encrypted, with an empty key ID for plaintext stores
+// so that readers know to stop decrypting.
+func (r *recordReader) next() error {
+	if !r.started {
+		r.started = true
+		keyID, _, err := readStoreHeader(r.r)
+		if err != nil {
+			return err
+		}
+		if keyID != "" {
+			if r.aead, err = r.keyring.aead(keyID); err != nil {
+				return err
+			}
+		}
+		if keyID != "" || r.keyring != nil {
+			r.buf.Write(storeHeader(keyID))
+			return nil
+		}
+	}
+	header := make([]byte, frameHeaderWidth)
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return io.EOF
+		}
+		return err
+	}
+	b := make([]byte, enc.Uint64(header[:lenWidth]))
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return err
+	}
+	p := b
+	if r.aead != nil {
+		var err error
+		if p, err = unseal(r.aead, b); err != nil {
+			return err
+		}
+	}
+	record := &api.Record{}
+	if err := proto.Unmarshal(p, record); err != nil {
+		return err
+	}
+	if record.Compression == api.Compression_NONE {
+		r.buf.Write(header)
+		r.buf.Write(b)
+		return nil
+	}
+	records, err := api.Decompress(record)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if b, err = proto.Marshal(record); err != nil {
+			return err
+		}
+		if r.aead != nil {
+			if b, err = seal(r.aead, b); err != nil {
+				return err
+			}
+		}
+		enc.PutUint64(header[:lenWidth], uint64(len(b)))
+		enc.PutUint32(header[lenWidth:], crc32.Checksum(b, crcTable))
+		r.buf.Write(header)
+		r.buf.Write(b)
+	}
+	return nil
 }
 
 func (l *Log) newSegment(off uint64) error {
@@ -1,12 +1,19 @@
 package log
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	api "github.com/dikaeinstein/proglog/api/v1"
 )
@@ -20,6 +27,17 @@ func TestLog(t *testing.T) {
 		"init with existing segments":       testInitExisting,
 		"reader":                            testReader,
 		"truncate":                          testTruncate,
+		"truncate from":                     testTruncateFrom,
+		"wait for offset":                   testWaitForOffset,
+		"corrupt record":                    testCorruptRecord,
+		"recover torn segment tail":         testRecoverTornTail,
+		"recover lost index entries":        testRecoverLostIndex,
+		"keep corrupt sealed segment":       testKeepCorruptSealed,
+		"reject store without header":       testRejectStoreWithoutHeader,
+		"offset for time":                   testOffsetForTime,
+		"append batch":                      testAppendBatch,
+		"append compressed batch":           testAppendCompressed,
+		"read range":                        testReadRange,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "store-test")
@@ -91,11 +109,158 @@ func testReader(t *testing.T, log *Log) {
 	b, err := ioutil.ReadAll(reader)
 	require.NoError(t, err)
 	read := &api.Record{}
-	err = proto.Unmarshal(b[lenWidth:], read)
+	err = proto.Unmarshal(b[frameHeaderWidth:], read)
 	require.NoError(t, err)
 	require.Equal(t, append.Value, read.Value)
 }
 
+func testAppendBatch(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+
+	var records []*api.Record
+	for i := 0; i < 4; i++ {
+		records = append(records, &api.Record{
+			Value: []byte(fmt.Sprintf("batch %d", i)),
+		})
+	}
+	first, last, err := log.AppendBatch(records)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	require.Equal(t, uint64(4), last)
+	// the batch doesn't fit in a single segment
+	require.Greater(t, len(log.segments), 1)
+
+	for i, record := range records {
+		read, err := log.Read(first + uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, record.Value, read.Value)
+		require.Equal(t, first+uint64(i), read.Offset)
+		require.NotNil(t, read.Timestamp)
+	}
+
+	log = reopen(t, log)
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, last, off)
+	off, err = log.Append(&api.Record{Value: []byte("next")})
+	require.NoError(t, err)
+	require.Equal(t, last+1, off)
+
+	_, _, err = log.AppendBatch(nil)
+	require.Error(t, err)
+}
+
+func testAppendCompressed(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+
+	var records []*api.Record
+	for i := 0; i < 3; i++ {
+		records = append(records, &api.Record{
+			Value: []byte(fmt.Sprintf(`{"batch": %d}`, i)),
+		})
+	}
+	first, last, err := log.AppendCompressed(records, api.Compression_GZIP)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	require.Equal(t, uint64(3), last)
+
+	requireRecords := func(log *Log) {
+		t.Helper()
+		for i, record := range records {
+			read, err := log.Read(first + uint64(i))
+			require.NoError(t, err)
+			require.Equal(t, record.Value, read.Value)
+			require.Equal(t, first+uint64(i), read.Offset)
+			require.Equal(t, api.Compression_NONE, read.Compression)
+
+			raw, err := log.ReadRaw(first + uint64(i))
+			require.NoError(t, err)
+			require.Equal(t, api.Compression_GZIP, raw.Compression)
+			require.Equal(t, first, raw.Offset)
+			require.Equal(t, last, raw.LastOffset)
+			batch, err := api.Decompress(raw)
+			require.NoError(t, err)
+			require.Equal(t, len(records), len(batch))
+		}
+	}
+	requireRecords(log)
+
+	// the reader decompresses batches into a frame per record
+	b, err := ioutil.ReadAll(log.Reader())
+	require.NoError(t, err)
+	var offsets []uint64
+	for len(b) > 0 {
+		size := enc.Uint64(b[:lenWidth])
+		read := &api.Record{}
+		err = proto.Unmarshal(b[frameHeaderWidth:frameHeaderWidth+size], read)
+		require.NoError(t, err)
+		require.Equal(t, api.Compression_NONE, read.Compression)
+		offsets = append(offsets, read.Offset)
+		b = b[frameHeaderWidth+size:]
+	}
+	require.Equal(t, []uint64{0, 1, 2, 3}, offsets)
+
+	log = reopen(t, log)
+	requireRecords(log)
+	off, err := log.Append(&api.Record{Value: []byte("next")})
+	require.NoError(t, err)
+	require.Equal(t, last+1, off)
+
+	_, _, err = log.AppendCompressed(records, api.Compression(99))
+	require.Equal(t, api.ErrUnknownCompression{Compression: 99}, err)
+}
+
+func testReadRange(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	_, _, err = log.AppendCompressed([]*api.Record{
+		{Value: []byte("second")},
+		{Value: []byte("third")},
+		{Value: []byte("fourth")},
+	}, api.Compression_FLATE)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("next")})
+		require.NoError(t, err)
+	}
+	hw, err := log.HighWatermark()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), hw)
+
+	offsets := func(records []*api.Record) []uint64 {
+		var offs []uint64
+		for _, record := range records {
+			require.Equal(t, api.Compression_NONE, record.Compression)
+			offs = append(offs, record.Offset)
+		}
+		return offs
+	}
+	records, err := log.ReadRange(0, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1, 2, 3, 4, 5}, offsets(records))
+	require.Equal(t, []byte("third"), records[2].Value)
+
+	// starting in the middle of a compressed batch
+	records, err = log.ReadRange(2, 3, 0)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2, 3, 4}, offsets(records))
+
+	size := uint64(proto.Size(records[0]) + proto.Size(records[1]))
+	records, err = log.ReadRange(2, 0, size)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2, 3}, offsets(records))
+
+	// the first record is returned even if it's too large
+	records, err = log.ReadRange(4, 0, 1)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{4}, offsets(records))
+
+	_, err = log.ReadRange(hw, 0, 0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: hw}, err)
+}
+
 func testTruncate(t *testing.T, log *Log) {
 	append := &api.Record{
 		Value: []byte("hello world"),
@@ -109,3 +274,551 @@ func testTruncate(t *testing.T, log *Log) {
 	_, err = log.Read(0)
 	require.Error(t, err)
 }
+
+func testTruncateFrom(t *testing.T, log *Log) {
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	_, _, err := log.AppendCompressed([]*api.Record{
+		{Value: []byte("five")},
+		{Value: []byte("six")},
+		{Value: []byte("seven")},
+	}, api.Compression_GZIP)
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("eight")})
+	require.NoError(t, err)
+
+	// the records of the batch before the truncated offset are kept
+	require.NoError(t, log.TruncateFrom(7))
+	hw, err := log.HighWatermark()
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), hw)
+	read, err := log.Read(6)
+	require.NoError(t, err)
+	require.Equal(t, []byte("six"), read.Value)
+	_, err = log.Read(7)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 7}, err)
+	off, err := log.Append(&api.Record{Value: []byte("new seven")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), off)
+	read, err = log.Read(7)
+	require.NoError(t, err)
+	require.Equal(t, []byte("new seven"), read.Value)
+
+	// truncating past the high watermark does nothing
+	require.NoError(t, log.TruncateFrom(8))
+	hw, err = log.HighWatermark()
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), hw)
+
+	// across segments
+	require.NoError(t, log.TruncateFrom(2))
+	_, err = log.Read(2)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 2}, err)
+	for _, s := range log.segments {
+		require.Less(t, s.baseOffset, uint64(2))
+	}
+
+	log = reopen(t, log)
+	hw, err = log.HighWatermark()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), hw)
+	read, err = log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+	off, err = log.Append(&api.Record{Value: []byte("new two")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+
+	// everything
+	require.NoError(t, log.TruncateFrom(0))
+	off, err = log.Append(&api.Record{Value: []byte("new zero")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+}
+
+func testWaitForOffset(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	require.NoError(t, log.WaitForOffset(context.Background(), 0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, log.WaitForOffset(ctx, 1))
+
+	waited := make(chan error)
+	go func() {
+		waited <- log.WaitForOffset(context.Background(), 2)
+	}()
+	_, err = log.Append(&api.Record{Value: []byte("second")})
+	require.NoError(t, err)
+	select {
+	case err = <-waited:
+		t.Fatalf("waited for offset 2 with offsets up to 1: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	_, _, err = log.AppendBatch([]*api.Record{{Value: []byte("third")}})
+	require.NoError(t, err)
+	select {
+	case err = <-waited:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("still waiting for offset 2")
+	}
+}
+
+func testCorruptRecord(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	off, err := log.Append(append)
+	require.NoError(t, err)
+
+	s := log.activeSegment
+	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	require.NoError(t, err)
+	require.NoError(t, s.store.buf.Flush())
+	f, err := os.OpenFile(s.store.Name(), os.O_RDWR, 0o644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("x"), int64(pos+frameHeaderWidth))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	read, err := log.Read(off)
+	require.Nil(t, read)
+	require.Equal(t, api.ErrCorruptRecord{
+		Offset:     off,
+		BaseOffset: s.baseOffset,
+		Position:   pos,
+	}, err)
+	require.Equal(t, codes.DataLoss, status.Code(err))
+}
+
+func testRecoverTornTail(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+
+	// simulate a crash mid-append: the index gained an entry for a record
+	// whose frame only partially made it to the store
+	s := log.activeSegment
+	require.NoError(t, s.store.buf.Flush())
+	size := s.store.size
+	err := s.index.Write(uint32(s.nextOffset-s.baseOffset), size)
+	require.NoError(t, err)
+	f, err := os.OpenFile(s.store.Name(), os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 42, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	n, err := New(log.Dir, log.Config)
+	require.NoError(t, err)
+	off, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	read, err := n.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, append.Value, read.Value)
+	require.Equal(t, size, n.activeSegment.store.size)
+
+	off, err = n.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	read, err = n.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, append.Value, read.Value)
+}
+
+func testRecoverLostIndex(t *testing.T, log *Log) {
+	log.Config.Segment.MaxStoreBytes = 1024
+	log = reopen(t, log)
+	for i := 0; i < 2; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	_, _, err := log.AppendCompressed([]*api.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+	}, api.Compression_GZIP)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	// the index only has its first entry, then none at all
+	index := filepath.Join(log.Dir, "0.index")
+	require.NoError(t, os.Truncate(index, int64(entWidth)))
+	for i := 0; i < 2; i++ {
+		log, err = New(log.Dir, log.Config)
+		require.NoError(t, err)
+		off, err := log.HighestOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(3), off)
+		for off := uint64(0); off < 4; off++ {
+			record, err := log.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, off, record.Offset)
+		}
+		require.NoError(t, log.Close())
+		require.NoError(t, os.Remove(index))
+	}
+}
+
+func testKeepCorruptSealed(t *testing.T, log *Log) {
+	log.Config.Segment.MaxStoreBytes = 200
+	log = reopen(t, log)
+	for i := 0; i < 20; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.True(t, len(log.segments) > 1)
+
+	// flip a byte in the payload of the first segment's last record
+	s := log.segments[0]
+	off := s.nextOffset - 1
+	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	require.NoError(t, err)
+	size := s.store.size
+	require.NoError(t, log.Close())
+	f, err := os.OpenFile(s.store.Name(), os.O_RDWR, 0o644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("x"), int64(pos+frameHeaderWidth))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	log, err = New(log.Dir, log.Config)
+	require.NoError(t, err)
+	require.Equal(t, size, log.segments[0].store.size)
+	_, err = log.Read(off)
+	require.Equal(t, api.ErrCorruptRecord{
+		Offset:     off,
+		BaseOffset: s.baseOffset,
+		Position:   pos,
+	}, err)
+	require.NoError(t, log.Close())
+}
+
+func testRejectStoreWithoutHeader(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	name := log.segments[0].store.Name()
+	require.NoError(t, log.Close())
+
+	// stores used to be frames of a length and a payload, without a header
+	p, err := proto.Marshal(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	b := make([]byte, lenWidth, lenWidth+len(p))
+	enc.PutUint64(b, uint64(len(p)))
+	require.NoError(t, ioutil.WriteFile(name, append(b, p...), 0o644))
+
+	_, err = New(log.Dir, log.Config)
+	require.ErrorIs(t, err, errStoreFormat)
+}
+
+func TestRebuildIndexes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebuild-index-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	log, err := New(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = log.Append(&api.Record{Value: []byte(fmt.Sprint(i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	// entries that are in order but point at the wrong frames go unnoticed
+	index := filepath.Join(dir, "0.index")
+	b, err := ioutil.ReadFile(index)
+	require.NoError(t, err)
+	copy(b[offWidth:entWidth], b[entWidth+offWidth:2*entWidth])
+	enc.PutUint64(b[entWidth+offWidth:], enc.Uint64(b[entWidth+offWidth:])+1)
+	require.NoError(t, ioutil.WriteFile(index, b, 0o644))
+
+	require.NoError(t, RebuildIndexes(dir, c))
+	log, err = New(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		record, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprint(i)), record.Value)
+	}
+	require.NoError(t, log.Close())
+}
+
+func TestRebuildIndexesLargeSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebuild-large-index-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 16
+	c.Segment.MaxIndexBytes = entWidth * 200
+	log, err := New(dir, c)
+	require.NoError(t, err)
+	// more records than the default MaxIndexBytes has entries for
+	n := 1024/int(entWidth) + 15
+	for i := 0; i < n; i++ {
+		_, err = log.Append(&api.Record{Value: []byte(fmt.Sprint(i))})
+		require.NoError(t, err)
+	}
+	size := log.activeSegment.store.size
+	require.NoError(t, log.Close())
+
+	// the default config's index is too small, which is an error rather
+	// than a reason to truncate the store
+	_, err = New(dir, Config{})
+	require.Equal(t, errIndexFull, err)
+	fi, err := os.Stat(filepath.Join(dir, "0.store"))
+	require.NoError(t, err)
+	require.Equal(t, int64(size), fi.Size())
+
+	// like the reindex command, without the segment limits
+	require.NoError(t, RebuildIndexes(dir, Config{}))
+	log, err = New(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, size, log.activeSegment.store.size)
+	for i := 0; i < n; i++ {
+		record, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprint(i)), record.Value)
+	}
+	require.NoError(t, log.Close())
+}
+
+func TestLogSyncPolicy(t *testing.T) {
+	for scenario, fn := range map[string]func(c *Config){
+		"os": func(c *Config) {
+			c.Segment.Sync = SyncOS
+		},
+		"always": func(c *Config) {
+			c.Segment.Sync = SyncAlways
+		},
+		"periodic bytes": func(c *Config) {
+			c.Segment.Sync = SyncPeriodic
+			c.Segment.SyncBytes = 64
+		},
+		"periodic time": func(c *Config) {
+			c.Segment.Sync = SyncPeriodic
+			c.Segment.SyncInterval = 10 * time.Millisecond
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log-sync-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			fn(&c)
+			log, err := New(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			append := &api.Record{
+				Value: []byte("hello world"),
+			}
+			for i := 0; i < 5; i++ {
+				_, err := log.Append(append)
+				require.NoError(t, err)
+
+				// appended records never sit in user-space buffers
+				fi, err := os.Stat(log.activeSegment.store.Name())
+				require.NoError(t, err)
+				require.Equal(t, log.activeSegment.store.size, uint64(fi.Size()))
+			}
+
+			// the appends only return once their records are fsynced
+			if c.Segment.Sync != SyncOS {
+				require.Zero(t, log.unsynced)
+			}
+		})
+	}
+}
+
+func TestLogSyncPeriodicWaits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-sync-periodic-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.Sync = SyncPeriodic
+	c.Segment.SyncInterval = time.Hour
+	log, err := New(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	appended := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := log.Append(&api.Record{Value: []byte("hello world")})
+			appended <- err
+		}()
+	}
+	require.Eventually(t, func() bool {
+		hw, err := log.HighWatermark()
+		return err == nil && hw == 2
+	}, time.Second, 10*time.Millisecond)
+	select {
+	case <-appended:
+		t.Fatal("append returned before its record was fsynced")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// a single fsync covers both appends
+	require.NoError(t, log.syncUnsynced())
+	for i := 0; i < 2; i++ {
+		require.NoError(t, <-appended)
+	}
+	require.Zero(t, log.unsynced)
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	for _, want := range []SyncPolicy{SyncOS, SyncAlways, SyncPeriodic} {
+		got, err := ParseSyncPolicy(string(want))
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+	_, err := ParseSyncPolicy("sometimes")
+	require.Error(t, err)
+}
+
+func testOffsetForTime(t *testing.T, log *Log) {
+	start := time.Unix(1000, 0)
+	for i := int64(0); i < 6; i++ {
+		_, err := log.Append(&api.Record{
+			Value:     []byte("hello world"),
+			Timestamp: timestamppb.New(start.Add(time.Duration(i) * time.Second)),
+		})
+		require.NoError(t, err)
+	}
+	require.True(t, len(log.segments) > 1)
+
+	n := log
+	for i := 0; i < 2; i++ {
+		if i == 1 {
+			// the time index must survive reopening the log
+			n = reopen(t, log)
+		}
+		for _, tt := range []struct {
+			t    time.Time
+			want uint64
+		}{
+			{t: start.Add(-time.Hour), want: 0},
+			{t: start, want: 0},
+			{t: start.Add(time.Millisecond), want: 1},
+			{t: start.Add(3 * time.Second), want: 3},
+			{t: start.Add(5 * time.Second), want: 5},
+			{t: start.Add(time.Hour), want: 6},
+		} {
+			off, err := n.OffsetForTime(tt.t)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, off, tt.t)
+		}
+	}
+}
+
+// reopen closes the log and opens it again from its directory.
+func reopen(t *testing.T, log *Log) *Log {
+	t.Helper()
+	require.NoError(t, log.Close())
+	n, err := New(log.Dir, log.Config)
+	require.NoError(t, err)
+	return n
+}
+
+func TestLogRetention(t *testing.T) {
+	for scenario, tt := range map[string]struct {
+		configure func(c *Config)
+		timestamp func(i int) time.Time
+	}{
+		"size": {
+			configure: func(c *Config) {
+				c.Segment.RetentionBytes = 64
+			},
+			timestamp: func(i int) time.Time {
+				return time.Now()
+			},
+		},
+		"age": {
+			configure: func(c *Config) {
+				c.Segment.RetentionAge = time.Hour
+			},
+			timestamp: func(i int) time.Time {
+				// only the last segment's records are recent
+				if i >= 4 {
+					return time.Now()
+				}
+				return time.Now().Add(-2 * time.Hour)
+			},
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log-retention-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := Config{}
+			c.Segment.MaxIndexBytes = entWidth * 2
+			tt.configure(&c)
+			log, err := New(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			for i := 0; i < 6; i++ {
+				_, err := log.Append(&api.Record{
+					Value:     []byte("hello world"),
+					Timestamp: timestamppb.New(tt.timestamp(i)),
+				})
+				require.NoError(t, err)
+			}
+			require.Equal(t, 3, len(log.segments))
+
+			removed, err := log.Clean()
+			require.NoError(t, err)
+			require.Equal(t, 2, len(removed))
+			require.Equal(t, uint64(0), removed[0].BaseOffset)
+			require.Equal(t, uint64(2), removed[0].NextOffset)
+			require.Equal(t, uint64(2), removed[1].BaseOffset)
+			require.Equal(t, uint64(4), removed[1].NextOffset)
+
+			lowest, err := log.LowestOffset()
+			require.NoError(t, err)
+			require.Equal(t, uint64(4), lowest)
+			_, err = log.Read(3)
+			require.Equal(t, api.ErrOffsetOutOfRange{Offset: 3}, err)
+			_, err = log.Read(4)
+			require.NoError(t, err)
+
+			// the active segment is never removed
+			removed, err = log.Clean()
+			require.NoError(t, err)
+			require.Empty(t, removed)
+		})
+	}
+}
+
+func TestLogCleaner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-cleaner-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth
+	c.Segment.RetentionBytes = 1
+	c.Segment.CleanupInterval = 10 * time.Millisecond
+	log, err := New(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		lowest, err := log.LowestOffset()
+		require.NoError(t, err)
+		return lowest == 2
+	}, time.Second, 10*time.Millisecond)
+}
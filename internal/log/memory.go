@@ -0,0 +1,388 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	api "github.com/dikaeinstein/proglog/api/v1"
+)
+
+// MemoryLog is a Storage that keeps records in memory, as they would be
+// stored in segments: records appended in a compressed batch are kept as
+// the batch. Nothing survives the process, it's meant for tests and
+// experiments.
+type MemoryLog struct {
+	mu sync.RWMutex
+	// records are the stored records in offset order.
+	records []*api.Record
+	// baseOffset is the lowest offset the log holds and nextOffset the
+	// offset the next record will be appended at.
+	baseOffset, nextOffset uint64
+	// appended is closed, and replaced, whenever records are appended to
+	// wake up WaitForOffset.
+	appended chan struct{}
+}
+
+// NewMemoryLog returns an empty log starting at the config's initial
+// offset.
+func NewMemoryLog(c Config) *MemoryLog {
+	return &MemoryLog{
+		baseOffset: c.Segment.InitialOffset,
+		nextOffset: c.Segment.InitialOffset,
+		appended:   make(chan struct{}),
+	}
+}
+
+// Append appends the record to the log and returns its offset. Records
+// without a timestamp are stamped with the current time.
+func (l *MemoryLog) Append(record *api.Record) (uint64, error) {
+	if record.Timestamp == nil {
+		record.Timestamp = timestamppb.Now()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	off := l.append(record, l.nextOffset)
+	l.notifyAppended()
+	return off, nil
+}
+
+// AppendBatch appends the records to the log at contiguous offsets and
+// returns the offsets of the first and last records.
+func (l *MemoryLog) AppendBatch(records []*api.Record) (
+	first, last uint64,
+	err error,
+) {
+	if len(records) == 0 {
+		return 0, 0, errEmptyBatch
+	}
+	stamp(records)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	first = l.nextOffset
+	for _, record := range records {
+		last = l.append(record, l.nextOffset)
+	}
+	l.notifyAppended()
+	return first, last, nil
+}
+
+// AppendCompressed appends the records to the log at contiguous offsets as
+// a single batch compressed with the given codec, like Log.AppendCompressed.
+func (l *MemoryLog) AppendCompressed(
+	records []*api.Record,
+	c api.Compression,
+) (first, last uint64, err error) {
+	if c == api.Compression_NONE {
+		return l.AppendBatch(records)
+	}
+	if len(records) == 0 {
+		return 0, 0, errEmptyBatch
+	}
+	stamp(records)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i, record := range records {
+		record.Offset = l.nextOffset + uint64(i)
+	}
+	batch, err := api.Compress(records, c)
+	if err != nil {
+		return 0, 0, err
+	}
+	l.records = append(l.records, batch)
+	l.nextOffset = batch.LastOffset + 1
+	l.notifyAppended()
+	return batch.Offset, batch.LastOffset, nil
+}
+
+// AppendAt appends the record at its own offset rather than the log's next
+// offset, leaving a gap in the log's offsets if it's past the next offset.
+func (l *MemoryLog) AppendAt(record *api.Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if record.Offset < l.nextOffset {
+		return fmt.Errorf(
+			"append at offset %d: log is at offset %d",
+			record.Offset,
+			l.nextOffset,
+		)
+	}
+	l.append(record, record.Offset)
+	l.notifyAppended()
+	return nil
+}
+
+// append stores a copy of the record at the given offset. It must be called
+// with the write lock held.
+func (l *MemoryLog) append(record *api.Record, off uint64) uint64 {
+	record.Offset = off
+	l.records = append(l.records, proto.Clone(record).(*api.Record))
+	l.nextOffset = off + 1
+	return off
+}
+
+// stamp stamps the records without a timestamp with the current time.
+func stamp(records []*api.Record) {
+	now := timestamppb.Now()
+	for _, record := range records {
+		if record.Timestamp == nil {
+			record.Timestamp = now
+		}
+	}
+}
+
+// notifyAppended wakes up the callers of WaitForOffset. It must be called
+// with the write lock held.
+func (l *MemoryLog) notifyAppended() {
+	close(l.appended)
+	l.appended = make(chan struct{})
+}
+
+// Read returns the record at the given offset, or the next record if there
+// is none at that offset, like Log.Read.
+func (l *MemoryLog) Read(off uint64) (*api.Record, error) {
+	stored, err := l.ReadRaw(off)
+	if err != nil {
+		return nil, err
+	}
+	records, err := api.Decompress(stored)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		if record.Offset >= off {
+			return record, nil
+		}
+	}
+	return nil, api.ErrOffsetOutOfRange{Offset: off}
+}
+
+// ReadRaw returns the record stored for the given offset, compressed
+// batches as they're stored, like Log.ReadRaw.
+func (l *MemoryLog) ReadRaw(off uint64) (*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	i := l.search(off)
+	if off < l.baseOffset || i == len(l.records) {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	return proto.Clone(l.records[i]).(*api.Record), nil
+}
+
+// search returns the index of the first stored record holding offsets at
+// or after off. It must be called with the lock held.
+func (l *MemoryLog) search(off uint64) int {
+	return sort.Search(len(l.records), func(i int) bool {
+		return lastOffset(l.records[i]) >= off
+	})
+}
+
+// lastOffset returns the offset of the last record the stored record holds,
+// which is past its own offset if it's a compressed batch.
+func lastOffset(stored *api.Record) uint64 {
+	if stored.Compression != api.Compression_NONE {
+		return stored.LastOffset
+	}
+	return stored.Offset
+}
+
+// ReadRange returns the records from offset from on, in order, see
+// Log.ReadRange.
+func (l *MemoryLog) ReadRange(
+	from uint64,
+	maxRecords int,
+	maxBytes uint64,
+) ([]*api.Record, error) {
+	return readRange(l.ReadRaw, from, maxRecords, maxBytes)
+}
+
+func (l *MemoryLog) LowestOffset() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.baseOffset, nil
+}
+
+func (l *MemoryLog) HighestOffset() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.nextOffset == 0 {
+		return 0, nil
+	}
+	return l.nextOffset - 1, nil
+}
+
+// HighWatermark returns the offset the next record will be appended at.
+func (l *MemoryLog) HighWatermark() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.nextOffset, nil
+}
+
+// OffsetForTime returns the offset of the first record appended at or after
+// t, or the offset the next record will be appended at if there's none.
+func (l *MemoryLog) OffsetForTime(t time.Time) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	ts := t.UnixNano()
+	for _, stored := range l.records {
+		// a batch is as recent as its most recent record
+		if appendTime(stored) < ts {
+			continue
+		}
+		records, err := api.Decompress(stored)
+		if err != nil {
+			return 0, err
+		}
+		for _, record := range records {
+			if appendTime(record) >= ts {
+				return record.Offset, nil
+			}
+		}
+	}
+	return l.nextOffset, nil
+}
+
+// WaitForOffset blocks until the log has a record at or past offset off,
+// or ctx is done, in which case it returns ctx's error.
+func (l *MemoryLog) WaitForOffset(ctx context.Context, off uint64) error {
+	for {
+		l.mu.RLock()
+		next := l.nextOffset
+		appended := l.appended
+		l.mu.RUnlock()
+		if off < next {
+			return nil
+		}
+		select {
+		case <-appended:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Truncate removes the records up to and including offset lowest.
+func (l *MemoryLog) Truncate(lowest uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	i := l.search(lowest + 1)
+	l.records = l.records[i:]
+	base := lowest + 1
+	if base > l.nextOffset {
+		base = l.nextOffset
+	}
+	if base > l.baseOffset {
+		l.baseOffset = base
+	}
+	return nil
+}
+
+// TruncateFrom removes the records from offset off on, so the next record
+// is appended at off. Records before off that were appended in a compressed
+// batch with records from off on are kept, uncompressed.
+func (l *MemoryLog) TruncateFrom(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if off >= l.nextOffset {
+		return nil
+	}
+	i := l.search(off)
+	var kept []*api.Record
+	if i < len(l.records) && l.records[i].Offset < off {
+		records, err := api.Decompress(l.records[i])
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if record.Offset < off {
+				kept = append(kept, record)
+			}
+		}
+	}
+	l.records = append(l.records[:i], kept...)
+	l.nextOffset = off
+	if off < l.baseOffset {
+		l.baseOffset = off
+	}
+	return nil
+}
+
+// Reader returns a reader of the log's records, each in a frame as it
+// would be in a store, compressed batches decompressed into a frame per
+// record like Log.Reader does.
+func (l *MemoryLog) Reader() io.Reader {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var buf bytes.Buffer
+	header := make([]byte, frameHeaderWidth)
+	for _, stored := range l.records {
+		records, err := api.Decompress(stored)
+		if err != nil {
+			return &errReader{err: err}
+		}
+		for _, record := range records {
+			p, err := proto.Marshal(record)
+			if err != nil {
+				return &errReader{err: err}
+			}
+			enc.PutUint64(header[:lenWidth], uint64(len(p)))
+			enc.PutUint32(header[lenWidth:], crc32.Checksum(p, crcTable))
+			buf.Write(header)
+			buf.Write(p)
+		}
+	}
+	return &buf
+}
+
+// errReader fails every read with its error.
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+// Reset empties the log, the next record to be appended at offset off.
+func (l *MemoryLog) Reset(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.records = nil
+	l.baseOffset = off
+	l.nextOffset = off
+	// the restored log may be past the offsets waited for
+	l.notifyAppended()
+	return nil
+}
+
+func (l *MemoryLog) Close() error {
+	return nil
+}
+
+// Delete drops the log's records.
+func (l *MemoryLog) Delete() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.records = nil
+	return nil
+}
@@ -0,0 +1,102 @@
+package log
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ObjectStore stores the files of segments offloaded from local disk, see
+// Config.Segment.ObjectStore. Object names are like file names in the log's
+// directory, prefixed with "topics/<topic>/" for the logs of named topics.
+type ObjectStore interface {
+	// Put stores the object read from r under the given name, replacing
+	// the object already stored under it. The object mustn't be visible
+	// until it's fully stored.
+	Put(name string, r io.Reader) error
+	// Get returns a reader of the object stored under the given name. It
+	// returns an error wrapping os.ErrNotExist if there's none.
+	Get(name string) (io.ReadCloser, error)
+	// Delete removes the object stored under the given name. Deleting an
+	// object that doesn't exist isn't an error.
+	Delete(name string) error
+	// List returns the names of every stored object.
+	List() ([]string, error)
+}
+
+// LocalObjectStore is an ObjectStore keeping objects as files in a
+// directory of the local filesystem, slashes in their names making
+// subdirectories.
+type LocalObjectStore struct {
+	Dir string
+}
+
+// NewLocalObjectStore returns a LocalObjectStore keeping objects in dir,
+// creating dir if needed.
+func NewLocalObjectStore(dir string) (*LocalObjectStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &LocalObjectStore{Dir: dir}, nil
+}
+
+// Put writes the object to a temporary file first and renames it into
+// place once fully written.
+func (o *LocalObjectStore) Put(name string, r io.Reader) error {
+	f, err := ioutil.TempFile(o.Dir, ".put-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	name = filepath.Join(o.Dir, filepath.FromSlash(name))
+	if err = os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+func (o *LocalObjectStore) Get(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(o.Dir, filepath.FromSlash(name)))
+}
+
+func (o *LocalObjectStore) Delete(name string) error {
+	err := os.Remove(filepath.Join(o.Dir, filepath.FromSlash(name)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// List skips the temporary files of objects being put.
+func (o *LocalObjectStore) List() ([]string, error) {
+	var names []string
+	err := filepath.Walk(o.Dir, func(
+		name string,
+		info os.FileInfo,
+		err error,
+	) error {
+		if err != nil || info.IsDir() || info.Name()[0] == '.' {
+			return err
+		}
+		rel, err := filepath.Rel(o.Dir, name)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	return names, err
+}
@@ -0,0 +1,40 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalObjectStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "object-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	objects, err := NewLocalObjectStore(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, objects.Put("0.store", bytes.NewReader(write)))
+	require.NoError(t, objects.Put("0.index", bytes.NewReader(nil)))
+	names, err := objects.List()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"0.store", "0.index"}, names)
+
+	r, err := objects.Get("0.store")
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, write, b)
+
+	require.NoError(t, objects.Delete("0.store"))
+	require.NoError(t, objects.Delete("0.store"))
+	_, err = objects.Get("0.store")
+	require.True(t, errors.Is(err, os.ErrNotExist))
+	names, err = objects.List()
+	require.NoError(t, err)
+	require.Equal(t, []string{"0.index"}, names)
+}
@@ -0,0 +1,454 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+
+	api "github.com/dikaeinstein/proglog/api/v1"
+)
+
+// partitionsDir is the directory the data of every partition but the first
+// is kept in.
+const partitionsDir = "partitions"
+
+// maintainInterval is how often a partitioned log reconciles the servers
+// and balances the leadership of its partitions, and has them follow the
+// controller's topics.
+const maintainInterval = time.Second
+
+// PartitionedLog splits every topic into partitions, each a DistributedLog
+// replicated by a Raft group of its own so that the partitions' leaders can
+// be spread across servers. The first partition controls the topics: they
+// are created and deleted through its Raft group and the other partitions
+// follow, see followTopics.
+type PartitionedLog struct {
+	partitions []*DistributedLog
+	logger     *zap.Logger
+	// closing is closed to stop maintain, which closes done once it has.
+	closing chan struct{}
+	done    chan struct{}
+
+	// mu guards members, the servers that joined by ID with their address,
+	// and left, the servers that left, see reconcile.
+	mu      sync.Mutex
+	members map[string]string
+	left    map[string]bool
+}
+
+// NewPartitionedLog sets up a partition for every stream layer, see
+// NewPartitionStreamLayer. The first partition's data is kept in dataDir,
+// where a DistributedLog's is, and partition p's in dataDir/partitions/p.
+// Partitions share the object store, if any, each under a prefix of its own.
+func NewPartitionedLog(
+	dataDir string,
+	config Config,
+	streamLayers []*StreamLayer,
+) (*PartitionedLog, error) {
+	if len(streamLayers) == 0 || len(streamLayers) > api.MaxPartitions {
+		return nil, fmt.Errorf(
+			"partitions: %d, want 1 to %d",
+			len(streamLayers), api.MaxPartitions,
+		)
+	}
+	pl := &PartitionedLog{
+		logger:  zap.L().Named("partitioned_log"),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+		members: make(map[string]string),
+		left:    make(map[string]bool),
+	}
+	dirs := make([]string, len(streamLayers))
+	// every partition's topics are set up before any Raft group starts
+	// applying records to them
+	for p, streamLayer := range streamLayers {
+		c := config
+		c.Raft.StreamLayer = streamLayer
+		dirs[p] = dataDir
+		if p > 0 {
+			dirs[p] = filepath.Join(dataDir, partitionsDir, strconv.Itoa(p))
+			if c.Segment.ObjectStore != nil {
+				c.Segment.ObjectStore = &prefixObjectStore{
+					ObjectStore: c.Segment.ObjectStore,
+					prefix:      fmt.Sprintf("%s/%d/", partitionsDir, p),
+				}
+			}
+		}
+		dl := &DistributedLog{config: c}
+		if err := dl.setupLog(dirs[p]); err != nil {
+			pl.closeTopics()
+			return nil, err
+		}
+		pl.partitions = append(pl.partitions, dl)
+	}
+	for _, dl := range pl.partitions[1:] {
+		dl.topics.controller = pl.partitions[0].topics
+	}
+	for p, dl := range pl.partitions {
+		if err := dl.setupRaft(dirs[p]); err != nil {
+			// the partitions before p are fully set up, the others only
+			// have their topics
+			for _, started := range pl.partitions[:p] {
+				started.Close()
+			}
+			for _, dl := range pl.partitions[p:] {
+				dl.topics.Close()
+			}
+			return nil, err
+		}
+	}
+	go pl.maintain()
+	return pl, nil
+}
+
+func (pl *PartitionedLog) closeTopics() {
+	for _, dl := range pl.partitions {
+		dl.topics.Close()
+	}
+}
+
+// Partitions returns the partitions in order.
+func (pl *PartitionedLog) Partitions() []*DistributedLog {
+	return pl.partitions
+}
+
+// Join adds the server to every partition's Raft group this server leads,
+// then hands over the leadership of the partitions the server is meant to
+// lead, see balance. It returns raft.ErrNotLeader if this server leads no
+// partition. Every server keeps track of the servers that joined, so that
+// the partitions it comes to lead get them too, see reconcile.
+func (pl *PartitionedLog) Join(id, addr string) error {
+	pl.mu.Lock()
+	pl.members[id] = addr
+	delete(pl.left, id)
+	pl.mu.Unlock()
+	return pl.eachLed(func(dl *DistributedLog) error {
+		return dl.Join(id, addr)
+	})
+}
+
+// Leave removes the server from every partition's Raft group this server
+// leads, like Join.
+func (pl *PartitionedLog) Leave(id string) error {
+	pl.mu.Lock()
+	delete(pl.members, id)
+	pl.left[id] = true
+	pl.mu.Unlock()
+	return pl.eachLed(func(dl *DistributedLog) error {
+		return dl.Leave(id)
+	})
+}
+
+func (pl *PartitionedLog) eachLed(fn func(dl *DistributedLog) error) error {
+	led := false
+	for _, dl := range pl.partitions {
+		err := fn(dl)
+		if err == raft.ErrNotLeader {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		led = true
+	}
+	if !led {
+		return raft.ErrNotLeader
+	}
+	pl.balance()
+	return nil
+}
+
+// reconcile adds the servers that joined to the Raft groups of the
+// partitions this server leads and removes the servers that left, in case
+// their leader missed them, say because the leadership was moving when
+// they did.
+func (pl *PartitionedLog) reconcile() {
+	pl.mu.Lock()
+	members := make(map[string]string, len(pl.members))
+	for id, addr := range pl.members {
+		members[id] = addr
+	}
+	left := make([]string, 0, len(pl.left))
+	for id := range pl.left {
+		left = append(left, id)
+	}
+	pl.mu.Unlock()
+	for p, dl := range pl.partitions {
+		if dl.raft.State() != raft.Leader {
+			continue
+		}
+		if err := reconcileServers(dl, members, left); err != nil {
+			pl.logger.Warn(
+				"failed to reconcile servers",
+				zap.Int("partition", p),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+func reconcileServers(
+	dl *DistributedLog,
+	members map[string]string,
+	left []string,
+) error {
+	configFuture := dl.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+	servers := make(map[string]string)
+	for _, server := range configFuture.Configuration().Servers {
+		servers[string(server.ID)] = string(server.Address)
+	}
+	for id, addr := range members {
+		if servers[id] == addr {
+			continue
+		}
+		if err := dl.Join(id, addr); err != nil {
+			return err
+		}
+	}
+	for _, id := range left {
+		if _, ok := servers[id]; !ok {
+			continue
+		}
+		if err := dl.Leave(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// balance hands the leadership of the partitions this server leads over to
+// the servers meant to lead them, so that the leaders are spread across
+// servers: partition p is meant to be led by the server p modulo the number
+// of servers, in the order of their IDs. Leadership that fails to move, say
+// because the server hasn't caught up yet, is left where it is until
+// maintain balances the partitions again.
+func (pl *PartitionedLog) balance() {
+	for p, dl := range pl.partitions {
+		if dl.raft.State() != raft.Leader {
+			continue
+		}
+		configFuture := dl.raft.GetConfiguration()
+		if err := configFuture.Error(); err != nil {
+			continue
+		}
+		var voters []raft.Server
+		for _, server := range configFuture.Configuration().Servers {
+			if server.Suffrage == raft.Voter {
+				voters = append(voters, server)
+			}
+		}
+		if len(voters) == 0 {
+			continue
+		}
+		sort.Slice(voters, func(i, j int) bool {
+			return voters[i].ID < voters[j].ID
+		})
+		want := voters[p%len(voters)]
+		if want.ID == dl.config.Raft.LocalID {
+			continue
+		}
+		err := dl.raft.LeadershipTransferToServer(want.ID, want.Address).Error()
+		if err != nil {
+			pl.logger.Warn(
+				"failed to transfer leadership",
+				zap.Int("partition", p),
+				zap.String("id", string(want.ID)),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+// maintain reconciles the partitions' servers and balances their
+// leadership every maintainInterval, and has the partitions follow the
+// controller's topics as well as whenever they change, until the log is
+// closed.
+func (pl *PartitionedLog) maintain() {
+	defer close(pl.done)
+	ticker := time.NewTicker(maintainInterval)
+	defer ticker.Stop()
+	for {
+		changed := pl.partitions[0].topics.changes()
+		select {
+		case <-pl.closing:
+			return
+		case <-ticker.C:
+			pl.reconcile()
+			pl.balance()
+		case <-changed:
+		}
+		pl.followTopics()
+	}
+}
+
+// followTopics has the partitions this server leads create the topics the
+// controller has and they don't, and delete the topics it doesn't have,
+// through their own Raft groups: a partition's replicas only change their
+// topics in the order of its Raft log, whatever their controller's
+// replicas are up to. Topics are only deleted once this server's controller
+// has applied every entry it knows to be committed, so that a lagging
+// controller doesn't have partitions delete topics it just doesn't have
+// yet.
+func (pl *PartitionedLog) followTopics() {
+	controller := pl.partitions[0]
+	for p, dl := range pl.partitions[1:] {
+		if dl.raft.State() != raft.Leader {
+			continue
+		}
+		if err := pl.follow(dl, caughtUp(controller)); err != nil {
+			pl.logger.Warn(
+				"failed to follow the controller's topics",
+				zap.Int("partition", p+1),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+func (pl *PartitionedLog) follow(dl *DistributedLog, deletes bool) error {
+	want, err := pl.partitions[0].topics.ListTopics()
+	if err != nil {
+		return err
+	}
+	have, err := dl.topics.ListTopics()
+	if err != nil {
+		return err
+	}
+	wanted := make(map[string]bool, len(want))
+	for _, topic := range want {
+		wanted[topic] = true
+	}
+	for _, topic := range have {
+		if wanted[topic] {
+			delete(wanted, topic)
+			continue
+		}
+		if !deletes {
+			continue
+		}
+		err = dl.DeleteTopic(topic)
+		if _, ok := err.(api.ErrTopicNotFound); err != nil && !ok {
+			return err
+		}
+	}
+	for _, topic := range want {
+		if !wanted[topic] {
+			continue
+		}
+		err = dl.CreateTopic(topic)
+		if _, ok := err.(api.ErrTopicExists); err != nil && !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// caughtUp reports whether the log has applied every entry it knows to be
+// committed.
+func caughtUp(dl *DistributedLog) bool {
+	commit, err := strconv.ParseUint(dl.raft.Stats()["commit_index"], 10, 64)
+	return err == nil && dl.raft.AppliedIndex() >= commit
+}
+
+// WaitForLeader waits for every partition to have a leader.
+func (pl *PartitionedLog) WaitForLeader(timeout time.Duration) error {
+	timeoutc := time.After(timeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-timeoutc:
+			return fmt.Errorf("timed out")
+		case <-ticker.C:
+			if pl.haveLeaders() {
+				return nil
+			}
+		}
+	}
+}
+
+func (pl *PartitionedLog) haveLeaders() bool {
+	for _, dl := range pl.partitions {
+		if dl.raft.Leader() == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// GetServers returns the servers of the first partition's Raft group, with
+// the partitions each leads. Every server replicates every partition.
+func (pl *PartitionedLog) GetServers() ([]*api.Server, error) {
+	servers, err := pl.partitions[0].GetServers()
+	if err != nil {
+		return nil, err
+	}
+	for p, dl := range pl.partitions {
+		leader := string(dl.raft.Leader())
+		for _, server := range servers {
+			if leader != "" && server.RpcAddr == leader {
+				server.LeaderPartitions = append(
+					server.LeaderPartitions,
+					uint32(p),
+				)
+			}
+		}
+	}
+	return servers, nil
+}
+
+func (pl *PartitionedLog) Close() error {
+	close(pl.closing)
+	<-pl.done
+	for _, dl := range pl.partitions {
+		if err := dl.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prefixObjectStore keeps a partition's objects apart from the other
+// partitions' in the object store they share.
+type prefixObjectStore struct {
+	ObjectStore
+	prefix string
+}
+
+func (o *prefixObjectStore) Put(name string, r io.Reader) error {
+	return o.ObjectStore.Put(o.prefix+name, r)
+}
+
+func (o *prefixObjectStore) Get(name string) (io.ReadCloser, error) {
+	return o.ObjectStore.Get(o.prefix + name)
+}
+
+func (o *prefixObjectStore) Delete(name string) error {
+	return o.ObjectStore.Delete(o.prefix + name)
+}
+
+// List returns the names of the objects under the prefix, without it.
+func (o *prefixObjectStore) List() ([]string, error) {
+	names, err := o.ObjectStore.List()
+	if err != nil {
+		return nil, err
+	}
+	var prefixed []string
+	for _, name := range names {
+		if strings.HasPrefix(name, o.prefix) {
+			prefixed = append(prefixed, strings.TrimPrefix(name, o.prefix))
+		}
+	}
+	return prefixed, nil
+}
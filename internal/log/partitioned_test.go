@@ -0,0 +1,115 @@
+package log
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/dikaeinstein/proglog/api/v1"
+)
+
+func TestPartitionedLogSetupFailure(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "partitioned-log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	listen := func(addrs []string) []*StreamLayer {
+		t.Helper()
+		var streamLayers []*StreamLayer
+		for p, addr := range addrs {
+			ln, err := net.Listen("tcp", addr)
+			require.NoError(t, err)
+			streamLayers = append(
+				streamLayers,
+				NewPartitionStreamLayer(ln, uint8(p), nil, nil),
+			)
+		}
+		return streamLayers
+	}
+	streamLayers := listen([]string{
+		"127.0.0.1:0", "127.0.0.1:0", "127.0.0.1:0",
+	})
+	var addrs []string
+	for _, streamLayer := range streamLayers {
+		addrs = append(addrs, streamLayer.Addr().String())
+	}
+	config := Config{}
+	config.Raft.LocalID = "0"
+	config.Raft.BindAddr = addrs[0]
+	config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+	config.Raft.ElectionTimeout = 50 * time.Millisecond
+	config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.Raft.CommitTimeout = 5 * time.Millisecond
+	config.Raft.Bootstrap = true
+
+	// partition 1's Raft group can't set up its directory
+	blocker := filepath.Join(dataDir, partitionsDir, "1", "raft")
+	require.NoError(t, os.MkdirAll(filepath.Dir(blocker), 0o755))
+	require.NoError(t, ioutil.WriteFile(blocker, nil, 0o644))
+	_, err = NewPartitionedLog(dataDir, config, streamLayers)
+	require.Error(t, err)
+	// the partitions that didn't start Raft leave their listeners be
+	for _, streamLayer := range streamLayers[1:] {
+		require.NoError(t, streamLayer.Close())
+	}
+
+	// partition 0's Raft group was shut down, which freed its listener
+	// and its stores
+	require.NoError(t, os.Remove(blocker))
+	pl, err := NewPartitionedLog(dataDir, config, listen(addrs))
+	require.NoError(t, err)
+	require.NoError(t, pl.WaitForLeader(3*time.Second))
+	require.NoError(t, pl.Close())
+}
+
+func TestPartitionedLogTopics(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "partitioned-log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	var streamLayers []*StreamLayer
+	for p := 0; p < 2; p++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		streamLayers = append(
+			streamLayers,
+			NewPartitionStreamLayer(ln, uint8(p), nil, nil),
+		)
+	}
+	config := Config{}
+	config.Raft.LocalID = "0"
+	config.Raft.BindAddr = streamLayers[0].Addr().String()
+	config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+	config.Raft.ElectionTimeout = 50 * time.Millisecond
+	config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.Raft.CommitTimeout = 5 * time.Millisecond
+	config.Raft.Bootstrap = true
+	pl, err := NewPartitionedLog(dataDir, config, streamLayers)
+	require.NoError(t, err)
+	defer pl.Close()
+	require.NoError(t, pl.WaitForLeader(3*time.Second))
+	controller, partition := pl.Partitions()[0], pl.Partitions()[1]
+
+	// the partition creates the topic through its own Raft group, as soon
+	// as records are produced to it if need be
+	require.NoError(t, controller.CreateTopic("orders"))
+	_, err = partition.Append("orders", &api.Record{Value: []byte("a")})
+	require.NoError(t, err)
+	topics, err := partition.ListTopics()
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders"}, topics)
+
+	// and deletes it through its Raft group once the controller has
+	require.NoError(t, controller.DeleteTopic("orders"))
+	require.Eventually(t, func() bool {
+		topics, err := partition.ListTopics()
+		return err == nil && len(topics) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = partition.Append("orders", &api.Record{Value: []byte("b")})
+	require.IsType(t, api.ErrTopicNotFound{}, err)
+}
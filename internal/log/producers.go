@@ -0,0 +1,101 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sort"
+
+	api "github.com/dikaeinstein/proglog/api/v1"
+)
+
+// snapshotProducerMagic starts the header written in front of a producer's
+// state in snapshots, see producers.Reader.
+var snapshotProducerMagic = []byte("plogprd1")
+
+// producerStateWidth is the width of a producer's state in snapshots: its
+// last sequence and the first and last offsets it got.
+const producerStateWidth = 24
+
+// producerState is the last request appended for a producer.
+type producerState struct {
+	sequence    uint64
+	first, last uint64
+}
+
+// producers tracks the last request of every producer so that retries of
+// it aren't appended again, see api.Producer. The fsm applies the requests,
+// one at a time, so producers aren't safe for concurrent use.
+type producers map[string]producerState
+
+// check returns the state of the producer's last request and whether the
+// request is a retry of it. Requests without a producer are never retries.
+func (p producers) check(producer *api.Producer) (
+	state producerState,
+	retry bool,
+	err error,
+) {
+	if producer.GetId() == "" {
+		return producerState{}, false, nil
+	}
+	state, ok := p[producer.Id]
+	switch {
+	case !ok || producer.Sequence > state.sequence:
+		return producerState{}, false, nil
+	case producer.Sequence == state.sequence:
+		return state, true, nil
+	}
+	return producerState{}, false, api.ErrStaleSequence{
+		Producer:     producer.Id,
+		Sequence:     producer.Sequence,
+		LastSequence: state.sequence,
+	}
+}
+
+// appended records the offsets the producer's request was appended at.
+func (p producers) appended(producer *api.Producer, first, last uint64) {
+	if producer.GetId() == "" {
+		return
+	}
+	p[producer.Id] = producerState{
+		sequence: producer.Sequence,
+		first:    first,
+		last:     last,
+	}
+}
+
+// Reader returns a reader of the producers' states, each preceded by a
+// header naming the producer, in the order of their names.
+func (p producers) Reader() io.Reader {
+	ids := make([]string, 0, len(p))
+	for id := range p {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var buf bytes.Buffer
+	b := make([]byte, producerStateWidth)
+	for _, id := range ids {
+		state := p[id]
+		enc.PutUint64(b[0:8], state.sequence)
+		enc.PutUint64(b[8:16], state.first)
+		enc.PutUint64(b[16:24], state.last)
+		buf.Write(namedHeader(snapshotProducerMagic, id))
+		buf.Write(b)
+	}
+	return &buf
+}
+
+// restore reads the producer's state from r, which is past the producer's
+// header.
+func (p producers) restore(r *bufio.Reader, id string) error {
+	b := make([]byte, producerStateWidth)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	p[id] = producerState{
+		sequence: enc.Uint64(b[0:8]),
+		first:    enc.Uint64(b[8:16]),
+		last:     enc.Uint64(b[16:24]),
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package log
+
+import (
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SegmentInfo describes one of the log's segments.
+type SegmentInfo struct {
+	BaseOffset uint64 `json:"base_offset"`
+	NextOffset uint64 `json:"next_offset"`
+	// StoreBytes is the size of the segment's store file.
+	StoreBytes uint64 `json:"store_bytes"`
+	// LastAppended is when the segment's newest record was appended.
+	LastAppended time.Time `json:"last_appended"`
+}
+
+// info describes the segment.
+func (s *segment) info() (SegmentInfo, error) {
+	lastAppended := time.Unix(0, s.maxTimestamp)
+	if s.maxTimestamp == 0 {
+		// records without append times, fall back to when the store
+		// was last written to
+		fi, err := os.Stat(s.store.Name())
+		if err != nil {
+			return SegmentInfo{}, err
+		}
+		lastAppended = fi.ModTime()
+	}
+	return SegmentInfo{
+		BaseOffset:   s.baseOffset,
+		NextOffset:   s.nextOffset,
+		StoreBytes:   s.store.size,
+		LastAppended: lastAppended,
+	}, nil
+}
+
+// Clean removes the sealed segments that are past the configured retention
+// limits and returns what it removed. Segments are removed oldest first, so
+// the log's lowest offset only moves forward and reading below it fails
+// with api.ErrOffsetOutOfRange. The active segment is never removed.
+// Offloaded segments count towards the limits and are removed from the
+// object store.
+func (l *Log) Clean() ([]SegmentInfo, error) {
+	l.maintenance.Lock()
+	defer l.maintenance.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var total uint64
+	for _, info := range l.remote {
+		total += info.StoreBytes
+	}
+	for _, s := range l.segments {
+		total += s.store.size
+	}
+	maxBytes := l.Config.Segment.RetentionBytes
+	maxAge := l.Config.Segment.RetentionAge
+
+	var removed []SegmentInfo
+	for len(l.remote) > 0 || len(l.segments) > 1 {
+		var info SegmentInfo
+		var err error
+		if len(l.remote) > 0 {
+			info = l.remote[0]
+		} else if info, err = l.segments[0].info(); err != nil {
+			return removed, err
+		}
+		var reason string
+		switch {
+		case maxBytes > 0 && total > maxBytes:
+			reason = "size"
+		case maxAge > 0 && time.Since(info.LastAppended) > maxAge:
+			reason = "age"
+		default:
+			return removed, nil
+		}
+		if err = l.removeOldest(); err != nil {
+			return removed, err
+		}
+		total -= info.StoreBytes
+		removed = append(removed, info)
+		l.logger.Info(
+			"removed segment",
+			zap.String("dir", l.Dir),
+			zap.String("reason", reason),
+			zap.Uint64("base_offset", info.BaseOffset),
+			zap.Uint64("next_offset", info.NextOffset),
+			zap.Uint64("store_bytes", info.StoreBytes),
+			zap.Time("last_appended", info.LastAppended),
+		)
+	}
+	return removed, nil
+}
+
+// removeOldest removes the log's oldest segment, locally and from the
+// object store. It must be called with the write lock held.
+func (l *Log) removeOldest() error {
+	if len(l.remote) > 0 {
+		if err := l.removeRemote(l.remote[0].BaseOffset); err != nil {
+			return err
+		}
+		l.remote = l.remote[1:]
+		return nil
+	}
+	s := l.segments[0]
+	if !s.offloaded.IsZero() {
+		if err := l.removeRemote(s.baseOffset); err != nil {
+			return err
+		}
+	}
+	if err := s.Remove(); err != nil {
+		return err
+	}
+	l.segments = l.segments[1:]
+	return nil
+}
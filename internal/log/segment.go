@@ -1,9 +1,14 @@
 package log
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"path"
+	"sort"
+	"time"
 
 	"google.golang.org/protobuf/proto"
 
@@ -13,8 +18,18 @@ import (
 type segment struct {
 	store                  *store
 	index                  *index
+	timeIndex              *timeIndex
 	baseOffset, nextOffset uint64
 	config                 Config
+	// maxTimestamp is the latest append time of the segment's records in
+	// nanoseconds since the Unix epoch.
+	maxTimestamp int64
+	// timeIndexBytes is the number of store bytes appended since the last
+	// time index entry was written.
+	timeIndexBytes uint64
+	// offloaded is when the segment was uploaded to the object store, or
+	// zero if it wasn't.
+	offloaded time.Time
 }
 
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
@@ -34,6 +49,9 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	if s.store, err = newStore(storeFile); err != nil {
 		return nil, err
 	}
+	if err = s.store.setupHeader(c.Segment.Keyring); err != nil {
+		return nil, err
+	}
 	indexFile, err := os.OpenFile(
 		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
 		os.O_RDWR|os.O_CREATE,
@@ -45,14 +63,212 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	if s.index, err = newIndex(indexFile, c); err != nil {
 		return nil, err
 	}
+	timeIndexFile, err := os.OpenFile(
+		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".timeindex")),
+		os.O_RDWR|os.O_CREATE|os.O_APPEND,
+		0o644,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if s.timeIndex, err = newTimeIndex(timeIndexFile); err != nil {
+		return nil, err
+	}
 	if off, _, err := s.index.Read(-1); err != nil {
 		s.nextOffset = baseOffset
 	} else {
 		s.nextOffset = baseOffset + uint64(off) + 1
 	}
+	s.loadMaxTimestamp()
 	return s, nil
 }
 
+// loadMaxTimestamp sets the segment's max timestamp from its time index and
+// its last record.
+func (s *segment) loadMaxTimestamp() {
+	s.maxTimestamp = 0
+	if ent, ok := s.timeIndex.Last(); ok {
+		s.maxTimestamp = ent.ts
+	}
+	if s.nextOffset == s.baseOffset {
+		return
+	}
+	if record, err := s.Read(s.nextOffset - 1); err == nil {
+		if ts := appendTime(record); ts > s.maxTimestamp {
+			s.maxTimestamp = ts
+		}
+	}
+}
+
+// appendTime returns the record's append time in nanoseconds since the Unix
+// epoch, or 0 if it has none.
+func appendTime(record *api.Record) int64 {
+	if record.Timestamp == nil {
+		return 0
+	}
+	return record.Timestamp.AsTime().UnixNano()
+}
+
+// errIndexFull is returned when opening a segment whose index can't hold
+// an entry for every frame in its store, which happens when it's opened
+// with a smaller MaxIndexBytes than it was written with.
+var errIndexFull = errors.New("index full, MaxIndexBytes too small for segment")
+
+// recovery describes what segment.recover had to repair.
+type recovery struct {
+	droppedEntries   uint64
+	reindexedEntries uint64
+	truncatedBytes   uint64
+	// unindexedBytes are the bytes past the last indexed frame of a sealed
+	// segment, which are kept rather than truncated.
+	unindexedBytes uint64
+}
+
+// recover brings the segment back to a consistent state after a crash. It
+// drops index entries that are out of order, and indexes the complete
+// frames past the last indexed one, which rebuilds a missing index from
+// scratch.
+//
+// Only the active segment can have been torn by a crash mid-append, so
+// only its store is repaired: index entries pointing at frames missing from
+// the store or failing their checksum are dropped, and the store is
+// truncated after the last indexed frame so partially written frames can't
+// be read back. A sealed segment's frames are left as they are, so that
+// reading a corrupt one reports it.
+func (s *segment) recover(active bool) (recovery, error) {
+	var r recovery
+	entries := s.index.size / entWidth
+	// the index file is only truncated to its real size on Close, so after a
+	// crash it ends with zeroed entries that break the ordering
+	var n uint64
+	var prevOff uint32
+	var prevPos uint64
+	for ; n < entries; n++ {
+		off, pos, err := s.index.Read(int64(n))
+		if err != nil {
+			return r, err
+		}
+		if n > 0 && (off <= prevOff || pos <= prevPos) {
+			break
+		}
+		prevOff, prevPos = off, pos
+	}
+	// the header, if any, is kept
+	storeEnd := s.store.start
+	if !active && n > 0 {
+		_, pos, err := s.index.Read(int64(n - 1))
+		if err != nil {
+			return r, err
+		}
+		// past a frame we can't find the end of there's nothing to
+		// reindex
+		storeEnd = s.store.size
+		if end, err := s.store.frameEnd(pos); err == nil {
+			storeEnd = end
+		} else if !errors.Is(err, errCorruptFrame) &&
+			!errors.Is(err, io.EOF) &&
+			!errors.Is(err, io.ErrUnexpectedEOF) {
+			return r, err
+		}
+	}
+	for ; active && n > 0; n-- {
+		_, pos, err := s.index.Read(int64(n - 1))
+		if err != nil {
+			return r, err
+		}
+		p, err := s.store.Read(pos)
+		if err == nil {
+			storeEnd = pos + s.store.frameSize(len(p))
+			break
+		}
+		if !errors.Is(err, errCorruptFrame) &&
+			!errors.Is(err, io.EOF) &&
+			!errors.Is(err, io.ErrUnexpectedEOF) {
+			return r, err
+		}
+	}
+	for i := n; i < entries; i++ {
+		off, pos, err := s.index.Read(int64(i))
+		if err != nil {
+			return r, err
+		}
+		if off != 0 || pos != 0 {
+			r.droppedEntries++
+		}
+	}
+	s.index.size = n * entWidth
+	for storeEnd < s.store.size {
+		end, ok, err := s.reindex(storeEnd)
+		if err != nil {
+			return r, err
+		}
+		if !ok {
+			break
+		}
+		storeEnd = end
+		r.reindexedEntries++
+	}
+	if !active {
+		r.unindexedBytes = s.store.size - storeEnd
+	} else if s.store.size > storeEnd {
+		r.truncatedBytes = s.store.size - storeEnd
+		if err := s.store.file.Truncate(int64(storeEnd)); err != nil {
+			return r, err
+		}
+		s.store.size = storeEnd
+	}
+	s.nextOffset = s.baseOffset
+	if off, _, err := s.index.Read(-1); err == nil {
+		s.nextOffset = s.baseOffset + uint64(off) + 1
+	}
+	if err := s.timeIndex.Truncate(
+		uint32(s.nextOffset - s.baseOffset),
+	); err != nil {
+		return r, err
+	}
+	s.loadMaxTimestamp()
+	return r, nil
+}
+
+// reindex indexes the frame at the given store position and returns the
+// position the frame ends at. ok is false if there's no complete frame there
+// or it doesn't hold the records that come after the indexed ones. It
+// returns errIndexFull if the index has no room for the frame's entry.
+func (s *segment) reindex(pos uint64) (end uint64, ok bool, err error) {
+	p, err := s.store.Read(pos)
+	if errors.Is(err, errCorruptFrame) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	record := &api.Record{}
+	if err = proto.Unmarshal(p, record); err != nil {
+		return 0, false, nil
+	}
+	// compressed batches are indexed by their last offset
+	off := record.Offset
+	if record.Compression != api.Compression_NONE {
+		off = record.LastOffset
+	}
+	if off < s.baseOffset || off-s.baseOffset > math.MaxUint32 {
+		return 0, false, nil
+	}
+	relOff := uint32(off - s.baseOffset)
+	if last, _, err := s.index.Read(-1); err == nil && relOff <= last {
+		return 0, false, nil
+	}
+	if err = s.index.Write(relOff, pos); err == io.EOF {
+		// the frame is complete, so it mustn't be truncated away
+		return 0, false, errIndexFull
+	} else if err != nil {
+		return 0, false, err
+	}
+	return pos + s.store.frameSize(len(p)), true, nil
+}
+
 // Append writes the record to the segment and returns the newly appended
 // record’s offset.
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
@@ -62,28 +278,181 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	if err != nil {
 		return 0, err
 	}
-	_, pos, err := s.store.Append(p)
+	n, pos, err := s.store.Append(p)
 	if err != nil {
 		return 0, err
 	}
-	if err = s.index.Write(
-		// index offsets are relative to base offset
-		uint32(s.nextOffset-uint64(s.baseOffset)),
-		pos,
-	); err != nil {
+	// index offsets are relative to base offset
+	relOff := uint32(s.nextOffset - uint64(s.baseOffset))
+	if err = s.index.Write(relOff, pos); err != nil {
+		return 0, err
+	}
+	if err = s.indexTime(relOff, appendTime(record), n); err != nil {
 		return 0, err
 	}
 	s.nextOffset++
 	return cur, nil
 }
 
-// Read returns the record for the given offset
+// AppendBatch writes as many of the records as fit in the segment, at
+// contiguous offsets, and returns how many it wrote. The records' frames
+// are written to the store in one go. At least one record is written
+// unless the segment is already maxed.
+func (s *segment) AppendBatch(records []*api.Record) (int, error) {
+	storeSize, indexSize := s.store.size, s.index.size
+	var frames [][]byte
+	for _, record := range records {
+		if storeSize >= s.config.Segment.MaxStoreBytes ||
+			indexSize >= s.config.Segment.MaxIndexBytes ||
+			uint64(len(s.index.mmap)) < indexSize+entWidth {
+			break
+		}
+		record.Offset = s.nextOffset + uint64(len(frames))
+		p, err := proto.Marshal(record)
+		if err != nil {
+			return 0, err
+		}
+		frames = append(frames, p)
+		storeSize += s.store.frameSize(len(p))
+		indexSize += entWidth
+	}
+	if len(frames) == 0 {
+		return 0, nil
+	}
+	_, positions, err := s.store.AppendBatch(frames)
+	if err != nil {
+		return 0, err
+	}
+	for i, pos := range positions {
+		relOff := uint32(s.nextOffset - s.baseOffset)
+		if err = s.index.Write(relOff, pos); err != nil {
+			return 0, err
+		}
+		if err = s.indexTime(
+			relOff,
+			appendTime(records[i]),
+			s.store.frameSize(len(frames[i])),
+		); err != nil {
+			return 0, err
+		}
+		s.nextOffset++
+	}
+	return len(frames), nil
+}
+
+// AppendCompressed writes the records, at contiguous offsets, as a single
+// batch compressed with the given codec and returns the offset of the last
+// record. The batch is indexed by its last record's offset so that
+// index.Find returns it for every offset in the batch.
+func (s *segment) AppendCompressed(
+	records []*api.Record,
+	c api.Compression,
+) (offset uint64, err error) {
+	for i, record := range records {
+		record.Offset = s.nextOffset + uint64(i)
+	}
+	batch, err := api.Compress(records, c)
+	if err != nil {
+		return 0, err
+	}
+	p, err := proto.Marshal(batch)
+	if err != nil {
+		return 0, err
+	}
+	n, pos, err := s.store.Append(p)
+	if err != nil {
+		return 0, err
+	}
+	relOff := uint32(batch.LastOffset - s.baseOffset)
+	if err = s.index.Write(relOff, pos); err != nil {
+		return 0, err
+	}
+	if err = s.indexTime(relOff, appendTime(batch), n); err != nil {
+		return 0, err
+	}
+	s.nextOffset = batch.LastOffset + 1
+	return batch.LastOffset, nil
+}
+
+// indexTime tracks the segment's max timestamp and writes a time index entry
+// for the first record and then every TimeIndexIntervalBytes store bytes.
+func (s *segment) indexTime(relOff uint32, ts int64, n uint64) error {
+	if ts > s.maxTimestamp {
+		s.maxTimestamp = ts
+	}
+	_, ok := s.timeIndex.Last()
+	s.timeIndexBytes += n
+	if ok && s.timeIndexBytes < s.config.Segment.TimeIndexIntervalBytes {
+		return nil
+	}
+	s.timeIndexBytes = 0
+	return s.timeIndex.Write(relOff, s.maxTimestamp)
+}
+
+// OffsetForTime returns the offset of the segment's first record appended at
+// or after ts. ok is false if every record was appended before ts.
+func (s *segment) OffsetForTime(ts int64) (off uint64, ok bool, err error) {
+	if s.maxTimestamp < ts {
+		return 0, false, nil
+	}
+	off = s.baseOffset
+	if relOff, found := s.timeIndex.Lookup(ts); found {
+		off = s.baseOffset + uint64(relOff) + 1
+	}
+	for off < s.nextOffset {
+		record, err := s.Read(off)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		if appendTime(record) >= ts {
+			return record.Offset, true, nil
+		}
+		off = record.Offset + 1
+	}
+	return 0, false, nil
+}
+
+// Read returns the record for the given offset. If the segment was compacted
+// and no longer holds that offset, it returns the segment's next record
+// instead, or io.EOF if there's none. Records appended in a compressed
+// batch are decompressed.
 func (s *segment) Read(off uint64) (*api.Record, error) {
-	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	stored, err := s.ReadRaw(off)
+	if err != nil {
+		return nil, err
+	}
+	records, err := api.Decompress(stored)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		if record.Offset >= off {
+			return record, nil
+		}
+	}
+	return nil, io.EOF
+}
+
+// ReadRaw returns the record stored for the given offset, like Read, but
+// returns compressed batches as they're stored rather than the record in
+// them. A record that fails its checksum is reported as an
+// api.ErrCorruptRecord.
+func (s *segment) ReadRaw(off uint64) (*api.Record, error) {
+	relOff, pos, err := s.index.Find(uint32(off - s.baseOffset))
 	if err != nil {
 		return nil, err
 	}
 	p, err := s.store.Read(pos)
+	if errors.Is(err, errCorruptFrame) {
+		return nil, api.ErrCorruptRecord{
+			Offset:     s.baseOffset + uint64(relOff),
+			BaseOffset: s.baseOffset,
+			Position:   pos,
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -93,6 +462,75 @@ func (s *segment) Read(off uint64) (*api.Record, error) {
 	return record, err
 }
 
+// Truncate removes the segment's records from offset off on, so the next
+// record is appended at off. Records before off that were appended in a
+// compressed batch with records from off on are appended again, one by one.
+func (s *segment) Truncate(off uint64) error {
+	if off >= s.nextOffset {
+		return nil
+	}
+	relOff := uint32(off - s.baseOffset)
+	entries := s.index.size / entWidth
+	n := uint64(sort.Search(int(entries), func(j int) bool {
+		out, _, _ := s.index.Read(int64(j))
+		return out >= relOff
+	}))
+	var kept []*api.Record
+	if n < entries {
+		_, pos, err := s.index.Read(int64(n))
+		if err != nil {
+			return err
+		}
+		stored, err := s.ReadRaw(off)
+		if err != nil {
+			return err
+		}
+		if stored.Compression != api.Compression_NONE {
+			records, err := api.Decompress(stored)
+			if err != nil {
+				return err
+			}
+			for _, record := range records {
+				if record.Offset < off {
+					kept = append(kept, record)
+				}
+			}
+		}
+		if err = s.store.Truncate(pos); err != nil {
+			return err
+		}
+		s.index.Truncate(n)
+	}
+	if err := s.timeIndex.Truncate(relOff); err != nil {
+		return err
+	}
+	s.timeIndexBytes = 0
+	s.maxTimestamp = 0
+	if ent, ok := s.timeIndex.Last(); ok {
+		s.maxTimestamp = ent.ts
+	}
+	for _, record := range kept {
+		s.nextOffset = record.Offset
+		if _, err := s.Append(record); err != nil {
+			return err
+		}
+	}
+	s.nextOffset = off
+	s.loadMaxTimestamp()
+	return nil
+}
+
+// Sync commits the segment's store and index to stable storage.
+func (s *segment) Sync() error {
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	if err := s.timeIndex.Sync(); err != nil {
+		return err
+	}
+	return s.index.Sync()
+}
+
 // IsMaxed returns whether the segment has reached its max size, either by
 // writing too much to the store or the index.
 func (s *segment) IsMaxed() bool {
@@ -112,6 +550,9 @@ func (s *segment) Remove() error {
 	if err := os.Remove(s.store.Name()); err != nil {
 		return err
 	}
+	if err := os.Remove(s.timeIndex.Name()); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -122,6 +563,9 @@ func (s *segment) Close() error {
 	if err := s.store.Close(); err != nil {
 		return err
 	}
+	if err := s.timeIndex.Close(); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -0,0 +1,85 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	api "github.com/dikaeinstein/proglog/api/v1"
+)
+
+// Storage keeps a log's records: a topic's, or Raft's logs. Log keeps them
+// in segment files and MemoryLog in memory, see Config.Engine.
+type Storage interface {
+	Append(record *api.Record) (uint64, error)
+	AppendBatch(records []*api.Record) (first, last uint64, err error)
+	AppendCompressed(records []*api.Record, c api.Compression) (
+		first, last uint64,
+		err error,
+	)
+	// AppendAt appends the record at its own offset, which must not be
+	// lower than the next offset.
+	AppendAt(record *api.Record) error
+	Read(off uint64) (*api.Record, error)
+	ReadRaw(off uint64) (*api.Record, error)
+	ReadRange(from uint64, maxRecords int, maxBytes uint64) (
+		[]*api.Record,
+		error,
+	)
+	LowestOffset() (uint64, error)
+	HighestOffset() (uint64, error)
+	HighWatermark() (uint64, error)
+	OffsetForTime(t time.Time) (uint64, error)
+	WaitForOffset(ctx context.Context, off uint64) error
+	// Truncate removes records up to and including offset lowest, as far
+	// as the storage can, and TruncateFrom removes records from offset off
+	// on.
+	Truncate(lowest uint64) error
+	TruncateFrom(off uint64) error
+	// Reader returns a reader of the records framed as in a store.
+	Reader() io.Reader
+	// Reset empties the storage, the next record to be appended at offset
+	// off.
+	Reset(off uint64) error
+	Close() error
+	// Delete closes the storage and removes its records for good.
+	Delete() error
+}
+
+// Engine names a Storage implementation.
+type Engine string
+
+const (
+	// EngineSegment keeps records in segment files, see Log.
+	EngineSegment Engine = "segment"
+	// EngineMemory keeps records in memory, see MemoryLog. They're lost
+	// when the process exits, and the segment settings of Config don't
+	// apply.
+	EngineMemory Engine = "memory"
+)
+
+// ParseEngine returns the Engine named by s.
+func ParseEngine(s string) (Engine, error) {
+	switch e := Engine(s); e {
+	case EngineSegment, EngineMemory:
+		return e, nil
+	}
+	return "", fmt.Errorf("unknown storage engine: %q", s)
+}
+
+// NewStorage opens the storage the config's engine keeps in dir. The memory
+// engine doesn't use dir.
+func NewStorage(dir string, c Config) (Storage, error) {
+	switch c.Engine {
+	case EngineMemory:
+		return NewMemoryLog(c), nil
+	case EngineSegment, "":
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+		return New(dir, c)
+	}
+	return nil, fmt.Errorf("unknown storage engine: %q", c.Engine)
+}
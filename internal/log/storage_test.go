@@ -0,0 +1,182 @@
+package log
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/dikaeinstein/proglog/api/v1"
+)
+
+func TestStorageImplementation(t *testing.T) {
+	// won't compile if Log or MemoryLog does not implement Storage
+	var _ Storage = (*Log)(nil)
+	var _ Storage = (*MemoryLog)(nil)
+}
+
+func TestStorage(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, s Storage){
+		"append and read":   testStorageAppendRead,
+		"truncate":          testStorageTruncate,
+		"truncate from":     testStorageTruncateFrom,
+		"reset and restore": testStorageResetRestore,
+	} {
+		for _, engine := range []Engine{EngineSegment, EngineMemory} {
+			t.Run(string(engine)+"/"+scenario, func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "storage-test")
+				require.NoError(t, err)
+				defer os.RemoveAll(dir)
+				c := Config{Engine: engine}
+				c.Segment.MaxStoreBytes = 64
+				c.Segment.InitialOffset = 1
+				s, err := NewStorage(filepath.Join(dir, "log"), c)
+				require.NoError(t, err)
+				defer s.Close()
+				fn(t, s)
+			})
+		}
+	}
+	_, err := NewStorage("", Config{Engine: "tape"})
+	require.Error(t, err)
+}
+
+// appendStorage appends a record, a compressed batch of three records and
+// another record at offsets 1 to 5.
+func appendStorage(t *testing.T, s Storage) {
+	t.Helper()
+	off, err := s.Append(&api.Record{Value: []byte("one")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	first, last, err := s.AppendCompressed([]*api.Record{
+		{Value: []byte("two")},
+		{Value: []byte("three")},
+		{Value: []byte("four")},
+	}, api.Compression_GZIP)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), first)
+	require.Equal(t, uint64(4), last)
+	first, last, err = s.AppendBatch([]*api.Record{{Value: []byte("five")}})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), first)
+	require.Equal(t, uint64(5), last)
+}
+
+func requireOffsets(t *testing.T, s Storage, lowest, highWatermark uint64) {
+	t.Helper()
+	off, err := s.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, lowest, off)
+	off, err = s.HighWatermark()
+	require.NoError(t, err)
+	require.Equal(t, highWatermark, off)
+}
+
+func testStorageAppendRead(t *testing.T, s Storage) {
+	start := time.Now()
+	appendStorage(t, s)
+	requireOffsets(t, s, 1, 6)
+	highest, err := s.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), highest)
+
+	record, err := s.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, []byte("three"), record.Value)
+	require.Equal(t, uint64(3), record.Offset)
+	raw, err := s.ReadRaw(3)
+	require.NoError(t, err)
+	require.Equal(t, api.Compression_GZIP, raw.Compression)
+	require.Equal(t, uint64(4), raw.LastOffset)
+	_, err = s.Read(6)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 6}, err)
+	_, err = s.Read(0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, err)
+
+	records, err := s.ReadRange(3, 2, 0)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(records))
+	require.Equal(t, []byte("four"), records[1].Value)
+
+	off, err := s.OffsetForTime(start)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	off, err = s.OffsetForTime(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+
+	// records read can't change the stored ones
+	record, err = s.Read(5)
+	require.NoError(t, err)
+	record.Value = []byte("changed")
+	record, err = s.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, []byte("five"), record.Value)
+}
+
+func testStorageTruncate(t *testing.T, s Storage) {
+	appendStorage(t, s)
+	require.NoError(t, s.Truncate(4))
+	requireOffsets(t, s, 5, 6)
+	_, err := s.Read(4)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 4}, err)
+	record, err := s.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, []byte("five"), record.Value)
+}
+
+func testStorageTruncateFrom(t *testing.T, s Storage) {
+	appendStorage(t, s)
+	require.NoError(t, s.TruncateFrom(4))
+	requireOffsets(t, s, 1, 4)
+	record, err := s.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, []byte("three"), record.Value)
+	_, err = s.Read(4)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 4}, err)
+	off, err := s.Append(&api.Record{Value: []byte("new four")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+
+	require.NoError(t, s.TruncateFrom(1))
+	requireOffsets(t, s, 1, 1)
+	off, err = s.Append(&api.Record{Value: []byte("new one")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
+
+func testStorageResetRestore(t *testing.T, s Storage) {
+	appendStorage(t, s)
+	snapshot, err := ioutil.ReadAll(s.Reader())
+	require.NoError(t, err)
+
+	require.NoError(t, s.Reset(10))
+	requireOffsets(t, s, 10, 10)
+	require.Error(t, s.AppendAt(&api.Record{Offset: 9}))
+	require.NoError(t, s.AppendAt(&api.Record{Offset: 12}))
+	requireOffsets(t, s, 10, 13)
+
+	// a snapshot of either engine restores into the other
+	c := Config{Engine: EngineMemory}
+	if _, ok := s.(*MemoryLog); ok {
+		c.Engine = EngineSegment
+	}
+	dir, err := ioutil.TempDir("", "storage-restore-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topics, err := NewTopics(dir, c)
+	require.NoError(t, err)
+	defer topics.Close()
+	f := &fsm{topics: topics}
+	require.NoError(t, f.Restore(ioutil.NopCloser(bytes.NewReader(snapshot))))
+	hw, err := topics.HighWatermark("")
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), hw)
+	record, err := topics.Read("", 4)
+	require.NoError(t, err)
+	require.Equal(t, []byte("four"), record.Value)
+}
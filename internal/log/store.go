@@ -2,20 +2,50 @@ package log
 
 import (
 	"bufio"
+	"crypto/cipher"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"sync"
 )
 
-var enc = binary.BigEndian
+var (
+	enc      = binary.BigEndian
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
 
-const lenWidth = 8
+const (
+	lenWidth = 8
+	crcWidth = 4
+	// frameHeaderWidth is the number of bytes written in front of every
+	// record: its length followed by its CRC32C checksum.
+	frameHeaderWidth = lenWidth + crcWidth
+)
+
+var (
+	// errCorruptFrame is returned when a frame read from the store fails its
+	// checksum or is not fully contained in the store.
+	errCorruptFrame = errors.New("corrupt frame")
+	// errStoreFormat is returned when opening a store without a header.
+	// There's no migration from that format: the data has to be re-produced
+	// to a new log.
+	errStoreFormat = errors.New(
+		"store has no header, it was written in an unsupported format",
+	)
+)
 
 type store struct {
 	file *os.File
 	mu   sync.Mutex
 	buf  *bufio.Writer
 	size uint64
+	// start is the position of the first frame, past the store's header.
+	start uint64
+	// aead encrypts the frames' payloads, nil if they're plaintext.
+	aead cipher.AEAD
 }
 
 func newStore(f *os.File) (*store, error) {
@@ -31,28 +61,128 @@ func newStore(f *os.File) (*store, error) {
 	}, nil
 }
 
-// Append persists the given bytes to the store. It also writes the length
-// of the record so that, when we read the record, we know how many bytes to read.
+// setupHeader reads the store's header and sets the store up to encrypt
+// and decrypt frames with the key whose ID is in it. A new store gets a
+// header for the keyring's active key, or an empty key ID if there's no
+// keyring. Stores without a header were written by older versions, whose
+// frames have no checksum, and are rejected.
+func (s *store) setupHeader(k *Keyring) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.size == 0 {
+		var keyID string
+		if k != nil {
+			aead, err := k.aead(k.Active)
+			if err != nil {
+				return err
+			}
+			keyID, s.aead = k.Active, aead
+		}
+		header := storeHeader(keyID)
+		if _, err := s.buf.Write(header); err != nil {
+			return err
+		}
+		if err := s.buf.Flush(); err != nil {
+			return err
+		}
+		s.size = uint64(len(header))
+		s.start = s.size
+		return nil
+	}
+	keyID, ok, err := readStoreHeader(bufio.NewReader(
+		io.NewSectionReader(s.file, 0, int64(s.size)),
+	))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s: %w", s.file.Name(), errStoreFormat)
+	}
+	s.start = uint64(len(storeHeader(keyID)))
+	if keyID == "" {
+		return nil
+	}
+	s.aead, err = k.aead(keyID)
+	return err
+}
+
+// Append persists the given bytes to the store, encrypted if the store is.
+// It also writes the length and the checksum of the record so that, when we
+// read the record, we know how many bytes to read and can tell whether they
+// were corrupted.
 func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.aead != nil {
+		if p, err = seal(s.aead, p); err != nil {
+			return 0, 0, err
+		}
+	}
 	pos = s.size
 	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
 		return 0, 0, err
 	}
+	if err := binary.Write(s.buf, enc, crc32.Checksum(p, crcTable)); err != nil {
+		return 0, 0, err
+	}
 	w, err := s.buf.Write(p)
 	if err != nil {
 		return 0, 0, err
 	}
-	w += lenWidth
+	w += frameHeaderWidth
 	s.size += uint64(w)
 	return uint64(w), pos, nil
 }
 
+// AppendBatch persists the given records with a single write to the buffer,
+// framing and encrypting each like Append does. It returns the number of
+// bytes written and the position of each record.
+func (s *store) AppendBatch(ps [][]byte) (n uint64, pos []uint64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.aead != nil {
+		sealed := make([][]byte, len(ps))
+		for i, p := range ps {
+			if sealed[i], err = seal(s.aead, p); err != nil {
+				return 0, nil, err
+			}
+		}
+		ps = sealed
+	}
+	for _, p := range ps {
+		n += frameHeaderWidth + uint64(len(p))
+	}
+	b := make([]byte, n)
+	pos = make([]uint64, len(ps))
+	var off uint64
+	for i, p := range ps {
+		pos[i] = s.size + off
+		enc.PutUint64(b[off:], uint64(len(p)))
+		enc.PutUint32(b[off+lenWidth:], crc32.Checksum(p, crcTable))
+		copy(b[off+frameHeaderWidth:], p)
+		off += frameHeaderWidth + uint64(len(p))
+	}
+	if _, err := s.buf.Write(b); err != nil {
+		return 0, nil, err
+	}
+	s.size += n
+	return n, pos, nil
+}
+
+// frameSize returns the size of the frame a payload of n bytes is stored in.
+func (s *store) frameSize(n int) uint64 {
+	if s.aead != nil {
+		n += s.aead.NonceSize() + s.aead.Overhead()
+	}
+	return frameHeaderWidth + uint64(n)
+}
+
 // Read returns the record stored at the given position. First it flushes the
 // writer buffer. It finds out how many bytes it has to read then it fetches
-// and return the record.
+// the record and verifies its checksum before returning it.
 func (s *store) Read(pos uint64) ([]byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -60,17 +190,47 @@ func (s *store) Read(pos uint64) ([]byte, error) {
 	if err := s.buf.Flush(); err != nil {
 		return nil, err
 	}
-	size := make([]byte, lenWidth)
-	if _, err := s.file.ReadAt(size, int64(pos)); err != nil {
+	header := make([]byte, frameHeaderWidth)
+	if _, err := s.file.ReadAt(header, int64(pos)); err != nil {
 		return nil, err
 	}
-	b := make([]byte, enc.Uint64(size))
-	if _, err := s.file.ReadAt(b, int64(pos+lenWidth)); err != nil {
+	size := enc.Uint64(header[:lenWidth])
+	if size > s.size-pos-frameHeaderWidth {
+		return nil, errCorruptFrame
+	}
+	b := make([]byte, size)
+	if _, err := s.file.ReadAt(b, int64(pos+frameHeaderWidth)); err != nil {
 		return nil, err
 	}
+	if crc32.Checksum(b, crcTable) != enc.Uint32(header[lenWidth:]) {
+		return nil, errCorruptFrame
+	}
+	if s.aead != nil {
+		return unseal(s.aead, b)
+	}
 	return b, nil
 }
 
+// frameEnd returns the position the frame at the given position ends at,
+// going by its length without verifying its checksum.
+func (s *store) frameEnd(pos uint64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.buf.Flush(); err != nil {
+		return 0, err
+	}
+	header := make([]byte, lenWidth)
+	if _, err := s.file.ReadAt(header, int64(pos)); err != nil {
+		return 0, err
+	}
+	size := enc.Uint64(header)
+	if pos+frameHeaderWidth > s.size || size > s.size-pos-frameHeaderWidth {
+		return 0, errCorruptFrame
+	}
+	return pos + frameHeaderWidth + size, nil
+}
+
 // ReadAt reads len(p) bytes into p beginning at the off offset in the
 // store’s file. It implements io.ReaderAt on the store type.
 func (s *store) ReadAt(p []byte, off int64) (int, error) {
@@ -83,6 +243,26 @@ func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	return s.file.ReadAt(p, off)
 }
 
+// Flush writes any buffered data to the underlying file.
+func (s *store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.buf.Flush()
+}
+
+// Sync writes any buffered data to the underlying file and commits the file
+// to stable storage.
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
 // Close persists any buffered data before closing the file.
 func (s *store) Close() error {
 	s.mu.Lock()
@@ -95,6 +275,22 @@ func (s *store) Close() error {
 	return s.file.Close()
 }
 
+// Truncate removes the frames from the given position on, which must be a
+// frame's position or the end of the store.
+func (s *store) Truncate(pos uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if err := s.file.Truncate(int64(pos)); err != nil {
+		return err
+	}
+	s.size = pos
+	return nil
+}
+
 // Name returns the store's file path.
 func (s *store) Name() string {
 	return s.file.Name()
@@ -11,7 +11,7 @@ import (
 
 var (
 	write = []byte("hello world")
-	width = uint64(len(write)) + lenWidth
+	width = uint64(len(write)) + frameHeaderWidth
 )
 
 func TestStoreAppendRead(t *testing.T) {
@@ -47,6 +47,55 @@ func TestStoreClose(t *testing.T) {
 	require.True(t, afterSize > beforeSize)
 }
 
+func TestStoreAppendBatch(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_append_batch_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	_, _, err = s.Append(write)
+	require.NoError(t, err)
+	n, pos, err := s.AppendBatch([][]byte{write, write})
+	require.NoError(t, err)
+	require.Equal(t, width*2, n)
+	require.Equal(t, []uint64{width, width * 2}, pos)
+	testRead(t, s)
+}
+
+func TestStoreCorruptFrame(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_corrupt_frame_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	testAppend(t, s)
+
+	// flip a bit in the second record's payload
+	_, err = s.Read(0)
+	require.NoError(t, err)
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, int64(width+frameHeaderWidth))
+	require.NoError(t, err)
+	b[0] ^= 0x01
+	_, err = f.WriteAt(b, int64(width+frameHeaderWidth))
+	require.NoError(t, err)
+
+	_, err = s.Read(0)
+	require.NoError(t, err)
+	_, err = s.Read(width)
+	require.ErrorIs(t, err, errCorruptFrame)
+
+	// a length running past the end of the store is corrupt as well
+	b = make([]byte, lenWidth)
+	enc.PutUint64(b, width*10)
+	_, err = f.WriteAt(b, int64(width*2))
+	require.NoError(t, err)
+	_, err = s.Read(width * 2)
+	require.ErrorIs(t, err, errCorruptFrame)
+}
+
 func testAppend(t *testing.T, s *store) {
 	t.Helper()
 	for i := uint64(1); i < 4; i++ {
@@ -70,12 +119,12 @@ func testRead(t *testing.T, s *store) {
 func testReadAt(t *testing.T, s *store) {
 	t.Helper()
 	for i, off := uint64(1), int64(0); i < 4; i++ {
-		b := make([]byte, lenWidth)
+		b := make([]byte, frameHeaderWidth)
 		n, err := s.ReadAt(b, off)
 		require.NoError(t, err)
-		require.Equal(t, lenWidth, n)
+		require.Equal(t, frameHeaderWidth, n)
 		off += int64(n)
-		size := enc.Uint64(b)
+		size := enc.Uint64(b[:lenWidth])
 		b = make([]byte, size)
 		n, err = s.ReadAt(b, off)
 		require.NoError(t, err)
@@ -0,0 +1,460 @@
+package log
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	api "github.com/dikaeinstein/proglog/api/v1"
+)
+
+// cacheDir is the directory, inside the log's directory, offloaded segments
+// are fetched to when they're read.
+const cacheDir = "cache"
+
+// segmentExts are the extensions of a segment's files. The info object is
+// uploaded last and deleted first, an offloaded segment exists only while
+// its info object does.
+var segmentExts = []string{".index", ".timeindex", ".store"}
+
+const infoExt = ".info"
+
+func objectName(baseOffset uint64, ext string) string {
+	return fmt.Sprintf("%d%s", baseOffset, ext)
+}
+
+// loadRemote finds the segments offloaded to the object store. Those older
+// than the local segments are only readable remotely, the others are local
+// segments that don't need uploading again.
+func (l *Log) loadRemote() error {
+	names, err := l.Config.Segment.ObjectStore.List()
+	if err != nil {
+		return err
+	}
+	local := make(map[uint64]*segment, len(l.segments))
+	for _, s := range l.segments {
+		local[s.baseOffset] = s
+	}
+	var remote []SegmentInfo
+	for _, name := range names {
+		if filepath.Ext(name) != infoExt {
+			continue
+		}
+		info, err := l.getInfo(name)
+		if err != nil {
+			return err
+		}
+		if s, ok := local[info.BaseOffset]; ok {
+			// we don't know when it was uploaded, so keep it locally
+			// for another LocalRetention
+			s.offloaded = time.Now()
+			continue
+		}
+		if len(l.segments) > 0 && info.BaseOffset > l.segments[0].baseOffset {
+			// left behind by compaction
+			continue
+		}
+		remote = append(remote, info)
+	}
+	sort.Slice(remote, func(i, j int) bool {
+		return remote[i].BaseOffset < remote[j].BaseOffset
+	})
+	l.remote = remote
+	return nil
+}
+
+func (l *Log) getInfo(name string) (SegmentInfo, error) {
+	var info SegmentInfo
+	r, err := l.Config.Segment.ObjectStore.Get(name)
+	if err != nil {
+		return info, err
+	}
+	defer r.Close()
+	err = json.NewDecoder(r).Decode(&info)
+	return info, err
+}
+
+// Offload uploads the sealed segments that haven't been yet to the
+// configured ObjectStore, then removes the local copies of those uploaded
+// more than LocalRetention ago. Offloaded segments are still read from, by
+// fetching them back into a local cache. Segments are removed locally
+// oldest first, so that only the log's newest segments are local.
+func (l *Log) Offload() error {
+	l.maintenance.Lock()
+	defer l.maintenance.Unlock()
+
+	// sealed segments aren't written to, so only maintenance, which we're
+	// holding the lock for, can change them
+	l.mu.RLock()
+	sealed := make([]*segment, len(l.segments)-1)
+	copy(sealed, l.segments)
+	l.mu.RUnlock()
+
+	for _, s := range sealed {
+		if !s.offloaded.IsZero() {
+			continue
+		}
+		if err := l.upload(s); err != nil {
+			return err
+		}
+		s.offloaded = time.Now()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for len(l.segments) > 1 {
+		s := l.segments[0]
+		if s.offloaded.IsZero() ||
+			time.Since(s.offloaded) < l.Config.Segment.LocalRetention {
+			return nil
+		}
+		info, err := s.info()
+		if err != nil {
+			return err
+		}
+		if err = s.Remove(); err != nil {
+			return err
+		}
+		l.segments = l.segments[1:]
+		l.remote = append(l.remote, info)
+		l.logger.Info(
+			"offloaded segment",
+			zap.String("dir", l.Dir),
+			zap.Uint64("base_offset", info.BaseOffset),
+			zap.Uint64("next_offset", info.NextOffset),
+			zap.Uint64("store_bytes", info.StoreBytes),
+		)
+	}
+	return nil
+}
+
+// upload puts the segment's files in the object store.
+func (l *Log) upload(s *segment) error {
+	if err := s.Sync(); err != nil {
+		return err
+	}
+	info, err := s.info()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	objects := l.Config.Segment.ObjectStore
+	for _, file := range []struct {
+		ext string
+		r   io.Reader
+	}{
+		// the index file is larger than its entries while it's open
+		{".index", io.NewSectionReader(s.index.file, 0, int64(s.index.size))},
+		{".timeindex", io.NewSectionReader(
+			s.timeIndex.file,
+			0,
+			int64(uint64(len(s.timeIndex.entries))*timeEntWidth),
+		)},
+		{".store", io.NewSectionReader(s.store, 0, int64(s.store.size))},
+		{infoExt, bytes.NewReader(b)},
+	} {
+		if err = objects.Put(
+			objectName(s.baseOffset, file.ext),
+			file.r,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeRemote deletes the segment's objects from the object store, if it
+// was offloaded.
+func (l *Log) removeRemote(baseOffset uint64) error {
+	objects := l.Config.Segment.ObjectStore
+	if objects == nil {
+		return nil
+	}
+	if err := objects.Delete(objectName(baseOffset, infoExt)); err != nil {
+		return err
+	}
+	for _, ext := range segmentExts {
+		if err := objects.Delete(objectName(baseOffset, ext)); err != nil {
+			return err
+		}
+	}
+	return l.cache.evict(baseOffset)
+}
+
+// removeAllRemote deletes every object from the object store.
+func (l *Log) removeAllRemote() error {
+	objects := l.Config.Segment.ObjectStore
+	if objects == nil {
+		return nil
+	}
+	names, err := objects.List()
+	if err != nil {
+		return err
+	}
+	// delete the info objects first so that no segment is left half
+	// deleted
+	sort.SliceStable(names, func(i, j int) bool {
+		return strings.HasSuffix(names[i], infoExt) &&
+			!strings.HasSuffix(names[j], infoExt)
+	})
+	for _, name := range names {
+		if err = objects.Delete(name); err != nil {
+			return err
+		}
+	}
+	l.remote = nil
+	return nil
+}
+
+// readRemote reads the given offset from the given offloaded segments. It
+// returns io.EOF if the offset is past them.
+func (l *Log) readRemote(
+	remote []SegmentInfo,
+	off uint64,
+	read func(s *segment, off uint64) (*api.Record, error),
+) (*api.Record, error) {
+	for _, info := range remote {
+		if info.NextOffset <= off {
+			continue
+		}
+		if off < info.BaseOffset {
+			// the offsets between segments were compacted away
+			off = info.BaseOffset
+		}
+		var record *api.Record
+		err := l.cache.with(info, func(s *segment) error {
+			var err error
+			record, err = read(s, off)
+			return err
+		})
+		if err == io.EOF {
+			// the rest of the segment was compacted away
+			continue
+		}
+		return record, err
+	}
+	return nil, io.EOF
+}
+
+// offsetForTimeRemote returns the offset of the first record appended at or
+// after ts in the given offloaded segments, skipping those below from. ok
+// is false if there's none.
+func (l *Log) offsetForTimeRemote(
+	remote []SegmentInfo,
+	from uint64,
+	ts int64,
+) (off uint64, ok bool, err error) {
+	for _, info := range remote {
+		if info.NextOffset <= from || info.LastAppended.UnixNano() < ts {
+			continue
+		}
+		if err = l.cache.with(info, func(s *segment) error {
+			var err error
+			off, ok, err = s.OffsetForTime(ts)
+			return err
+		}); err != nil || ok {
+			return off, ok, err
+		}
+	}
+	return 0, false, nil
+}
+
+// remoteReader lazily reads the store of an offloaded segment.
+type remoteReader struct {
+	objects ObjectStore
+	name    string
+	r       io.ReadCloser
+}
+
+func (r *remoteReader) Read(p []byte) (int, error) {
+	if r.r == nil {
+		var err error
+		if r.r, err = r.objects.Get(r.name); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		r.r.Close()
+	}
+	return n, err
+}
+
+// segmentCache keeps the offloaded segments that were read on local disk.
+// Once their stores take up more than maxBytes, the least recently read
+// are removed.
+type segmentCache struct {
+	mu       sync.Mutex
+	dir      string
+	config   Config
+	maxBytes uint64
+	size     uint64
+	lru      *list.List
+	entries  map[uint64]*list.Element
+	fetches  map[uint64]*segmentFetch
+}
+
+// segmentFetch is an offloaded segment being fetched. Reads of the segment
+// wait for it rather than fetching the segment again.
+type segmentFetch struct {
+	done    chan struct{}
+	err     error
+	evicted bool
+}
+
+func newSegmentCache(dir string, c Config) (*segmentCache, error) {
+	// whatever was cached before may be stale
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &segmentCache{
+		dir:      dir,
+		config:   c,
+		maxBytes: c.Segment.RemoteCacheBytes,
+		lru:      list.New(),
+		entries:  make(map[uint64]*list.Element),
+		fetches:  make(map[uint64]*segmentFetch),
+	}, nil
+}
+
+// with calls fn with the offloaded segment, fetching it first if it isn't
+// cached. The segment mustn't be used once fn returns. The cache isn't
+// locked while fetching, so reads of other segments don't wait for it.
+func (c *segmentCache) with(info SegmentInfo, fn func(*segment) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		if e, ok := c.entries[info.BaseOffset]; ok {
+			c.lru.MoveToFront(e)
+			return fn(e.Value.(*segment))
+		}
+		f, ok := c.fetches[info.BaseOffset]
+		if !ok {
+			break
+		}
+		c.mu.Unlock()
+		<-f.done
+		c.mu.Lock()
+		if f.err != nil {
+			return f.err
+		}
+		// the fetched segment may have been evicted since, if so fetch it
+		// again
+	}
+
+	f := &segmentFetch{done: make(chan struct{})}
+	c.fetches[info.BaseOffset] = f
+	c.mu.Unlock()
+	s, err := c.fetch(info)
+	c.mu.Lock()
+	delete(c.fetches, info.BaseOffset)
+	f.err = err
+	close(f.done)
+	if err != nil {
+		return err
+	}
+	if f.evicted {
+		// the segment was removed while we fetched it, so serve this read
+		// and drop it
+		if err = fn(s); err != nil {
+			s.Remove()
+			return err
+		}
+		return s.Remove()
+	}
+	c.entries[info.BaseOffset] = c.lru.PushFront(s)
+	c.size += s.store.size
+	for c.size > c.maxBytes && c.lru.Len() > 1 {
+		if err = c.remove(c.lru.Back()); err != nil {
+			return err
+		}
+	}
+	return fn(s)
+}
+
+func (c *segmentCache) fetch(info SegmentInfo) (*segment, error) {
+	for _, ext := range segmentExts {
+		if err := c.download(objectName(info.BaseOffset, ext)); err != nil {
+			return nil, err
+		}
+	}
+	s, err := newSegment(c.dir, info.BaseOffset, c.config)
+	if err != nil {
+		return nil, err
+	}
+	// compaction may have removed the segment's last records
+	s.nextOffset = info.NextOffset
+	return s, nil
+}
+
+func (c *segmentCache) download(name string) error {
+	r, err := c.config.Segment.ObjectStore.Get(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.Create(filepath.Join(c.dir, name))
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// evict removes the segment from the cache, if it's cached.
+func (c *segmentCache) evict(baseOffset uint64) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f, ok := c.fetches[baseOffset]; ok {
+		f.evicted = true
+	}
+	if e, ok := c.entries[baseOffset]; ok {
+		return c.remove(e)
+	}
+	return nil
+}
+
+func (c *segmentCache) remove(e *list.Element) error {
+	s := c.lru.Remove(e).(*segment)
+	delete(c.entries, s.baseOffset)
+	c.size -= s.store.size
+	return s.Remove()
+}
+
+// Close removes the cached segments.
+func (c *segmentCache) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.lru.Len() > 0 {
+		if err := c.remove(c.lru.Back()); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(c.dir)
+}
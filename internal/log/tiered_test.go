@@ -0,0 +1,302 @@
+package log
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/dikaeinstein/proglog/api/v1"
+)
+
+func TestLogOffload(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, log *Log, objects *LocalObjectStore,
+	){
+		"reads offloaded segments":          testOffloadRead,
+		"keeps local copies for a while":    testOffloadLocalRetention,
+		"cleans offloaded segments":         testOffloadClean,
+		"continues from offloaded segments": testOffloadLostDisk,
+		"resets offloaded segments":         testOffloadReset,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "tiered-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			objects, err := NewLocalObjectStore(filepath.Join(dir, "objects"))
+			require.NoError(t, err)
+			c := Config{}
+			c.Segment.MaxIndexBytes = entWidth * 2
+			c.Segment.ObjectStore = objects
+			c.Segment.OffloadInterval = time.Hour
+			logDir := filepath.Join(dir, "log")
+			require.NoError(t, os.MkdirAll(logDir, 0o755))
+			log, err := New(logDir, c)
+			require.NoError(t, err)
+			fn(t, log, objects)
+		})
+	}
+}
+
+// appendOffloaded appends 7 records, which leaves 3 sealed segments, and
+// offloads the sealed segments.
+func appendOffloaded(t *testing.T, log *Log) {
+	t.Helper()
+	for i := 0; i < 7; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Offload())
+}
+
+func requireReadable(t *testing.T, log *Log, from, to uint64) {
+	t.Helper()
+	for off := from; off < to; off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+		require.Equal(t, []byte("hello world"), record.Value)
+	}
+}
+
+func testOffloadRead(t *testing.T, log *Log, objects *LocalObjectStore) {
+	appendOffloaded(t, log)
+	require.Equal(t, 1, len(log.segments))
+	require.Equal(t, 3, len(log.remote))
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), lowest)
+	requireReadable(t, log, 0, 7)
+
+	// only the most recently read segment is cached
+	cached, err := filepath.Glob(filepath.Join(log.Dir, cacheDir, "*.store"))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(cached))
+
+	// the reader reads offloaded segments too
+	b, err := ioutil.ReadAll(log.Reader())
+	require.NoError(t, err)
+	var n uint64
+	for len(b) > 0 {
+		size := enc.Uint64(b[:lenWidth])
+		record := &api.Record{}
+		require.NoError(t, proto.Unmarshal(
+			b[frameHeaderWidth:frameHeaderWidth+size],
+			record,
+		))
+		require.Equal(t, n, record.Offset)
+		n++
+		b = b[frameHeaderWidth+size:]
+	}
+	require.Equal(t, uint64(7), n)
+
+	off, err := log.OffsetForTime(time.Unix(0, 0))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	log = reopen(t, log)
+	requireReadable(t, log, 0, 7)
+	off, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), off)
+	require.NoError(t, log.Close())
+}
+
+func testOffloadLocalRetention(
+	t *testing.T,
+	log *Log,
+	objects *LocalObjectStore,
+) {
+	log.Config.Segment.LocalRetention = time.Hour
+	appendOffloaded(t, log)
+	require.Equal(t, 4, len(log.segments))
+	require.Equal(t, 0, len(log.remote))
+	names, err := objects.List()
+	require.NoError(t, err)
+	// every sealed segment has an index, time index, store and info
+	require.Equal(t, 12, len(names))
+
+	log.Config.Segment.LocalRetention = 0
+	require.NoError(t, log.Offload())
+	require.Equal(t, 1, len(log.segments))
+	require.Equal(t, 3, len(log.remote))
+	requireReadable(t, log, 0, 7)
+	require.NoError(t, log.Close())
+}
+
+func testOffloadClean(t *testing.T, log *Log, objects *LocalObjectStore) {
+	appendOffloaded(t, log)
+	info := log.remote[0]
+	log.Config.Segment.RetentionBytes = log.activeSegment.store.size +
+		log.remote[1].StoreBytes + log.remote[2].StoreBytes
+	removed, err := log.Clean()
+	require.NoError(t, err)
+	require.Equal(t, []SegmentInfo{info}, removed)
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), lowest)
+	_, err = log.Read(0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, err)
+	requireReadable(t, log, 2, 7)
+	names, err := objects.List()
+	require.NoError(t, err)
+	require.Equal(t, 8, len(names))
+	require.NoError(t, log.Close())
+}
+
+func testOffloadLostDisk(t *testing.T, log *Log, objects *LocalObjectStore) {
+	appendOffloaded(t, log)
+	require.NoError(t, log.Remove())
+	require.NoError(t, os.MkdirAll(log.Dir, 0o755))
+
+	log, err := New(log.Dir, log.Config)
+	require.NoError(t, err)
+	requireReadable(t, log, 0, 6)
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+	require.NoError(t, log.Close())
+}
+
+func testOffloadReset(t *testing.T, log *Log, objects *LocalObjectStore) {
+	appendOffloaded(t, log)
+	require.NoError(t, log.Reset(0))
+	names, err := objects.List()
+	require.NoError(t, err)
+	require.Equal(t, 0, len(names))
+	_, err = log.Read(0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, err)
+	require.NoError(t, log.Close())
+}
+
+// blockingObjectStore blocks getting the objects of the segment at base
+// offset 0 until unblocked, counting the gets.
+type blockingObjectStore struct {
+	ObjectStore
+	blocked   chan struct{}
+	unblocked chan struct{}
+	gets      int32
+}
+
+func (o *blockingObjectStore) Get(name string) (io.ReadCloser, error) {
+	if strings.HasPrefix(name, "0.") {
+		if atomic.AddInt32(&o.gets, 1) == 1 {
+			close(o.blocked)
+		}
+		<-o.unblocked
+	}
+	return o.ObjectStore.Get(name)
+}
+
+func TestLogOffloadSlowFetch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tiered-slow-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	objects, err := NewLocalObjectStore(filepath.Join(dir, "objects"))
+	require.NoError(t, err)
+	blocking := &blockingObjectStore{
+		ObjectStore: objects,
+		blocked:     make(chan struct{}),
+		unblocked:   make(chan struct{}),
+	}
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.Segment.ObjectStore = blocking
+	c.Segment.OffloadInterval = time.Hour
+	c.Segment.RemoteCacheBytes = 1 << 20
+	log, err := New(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	appendOffloaded(t, log)
+
+	reads := make(chan *api.Record, 2)
+	errs := make(chan error, 2)
+	for _, off := range []uint64{0, 1} {
+		go func(off uint64) {
+			record, err := log.Read(off)
+			errs <- err
+			reads <- record
+		}(off)
+	}
+	<-blocking.blocked
+
+	// neither appends nor reads of other segments wait for the fetch
+	done := make(chan error)
+	go func() {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		for off := uint64(2); err == nil && off < 8; off++ {
+			_, err = log.Read(off)
+		}
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("blocked behind the fetch")
+	}
+
+	close(blocking.unblocked)
+	offsets := map[uint64]bool{}
+	for i := 0; i < 2; i++ {
+		require.NoError(t, <-errs)
+		offsets[(<-reads).Offset] = true
+	}
+	require.Equal(t, map[uint64]bool{0: true, 1: true}, offsets)
+	// the segment was fetched once for both reads
+	require.Equal(t, int32(len(segmentExts)), atomic.LoadInt32(&blocking.gets))
+}
+
+func TestLogOffloadSlowOffsetForTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tiered-slow-time-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	objects, err := NewLocalObjectStore(filepath.Join(dir, "objects"))
+	require.NoError(t, err)
+	blocking := &blockingObjectStore{
+		ObjectStore: objects,
+		blocked:     make(chan struct{}),
+		unblocked:   make(chan struct{}),
+	}
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.Segment.ObjectStore = blocking
+	c.Segment.OffloadInterval = time.Hour
+	log, err := New(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	appendOffloaded(t, log)
+
+	offs := make(chan uint64, 1)
+	errs := make(chan error, 1)
+	go func() {
+		off, err := log.OffsetForTime(time.Unix(0, 0))
+		errs <- err
+		offs <- off
+	}()
+	<-blocking.blocked
+
+	// appends don't wait for the fetch
+	done := make(chan error)
+	go func() {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("blocked behind the fetch")
+	}
+
+	close(blocking.unblocked)
+	require.NoError(t, <-errs)
+	require.Equal(t, uint64(0), <-offs)
+}
@@ -0,0 +1,110 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+const (
+	tsWidth      uint64 = 8
+	timeEntWidth        = offWidth + tsWidth
+)
+
+// timeEntry maps a relative offset to the largest timestamp of the records
+// appended to the segment up to and including that offset.
+type timeEntry struct {
+	off uint32
+	ts  int64
+}
+
+// timeIndex is a sparse index from append time to offset. Its entries are
+// few enough to keep in memory, so the file is only ever appended to.
+type timeIndex struct {
+	file    *os.File
+	entries []timeEntry
+}
+
+// newTimeIndex loads the time index stored in the given file. A partially
+// written entry at the end of the file is discarded.
+func newTimeIndex(f *os.File) (*timeIndex, error) {
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	t := &timeIndex{file: f}
+	n := uint64(len(b)) / timeEntWidth
+	for i := uint64(0); i < n; i++ {
+		ent := b[i*timeEntWidth : (i+1)*timeEntWidth]
+		t.entries = append(t.entries, timeEntry{
+			off: enc.Uint32(ent[:offWidth]),
+			ts:  int64(enc.Uint64(ent[offWidth:])),
+		})
+	}
+	if uint64(len(b)) != n*timeEntWidth {
+		if err = f.Truncate(int64(n * timeEntWidth)); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Write appends an entry for the given relative offset and timestamp.
+func (t *timeIndex) Write(off uint32, ts int64) error {
+	b := make([]byte, timeEntWidth)
+	enc.PutUint32(b[:offWidth], off)
+	enc.PutUint64(b[offWidth:], uint64(ts))
+	if _, err := t.file.Write(b); err != nil {
+		return err
+	}
+	t.entries = append(t.entries, timeEntry{off: off, ts: ts})
+	return nil
+}
+
+// Lookup returns the relative offset of the latest entry whose timestamp is
+// before ts. Every record up to and including that offset was appended
+// before ts. ok is false if there's no such entry.
+func (t *timeIndex) Lookup(ts int64) (off uint32, ok bool) {
+	i := sort.Search(len(t.entries), func(i int) bool {
+		return t.entries[i].ts >= ts
+	})
+	if i == 0 {
+		return 0, false
+	}
+	return t.entries[i-1].off, true
+}
+
+// Last returns the index's last entry. ok is false if the index is empty.
+func (t *timeIndex) Last() (ent timeEntry, ok bool) {
+	if len(t.entries) == 0 {
+		return timeEntry{}, false
+	}
+	return t.entries[len(t.entries)-1], true
+}
+
+// Truncate removes the entries for relative offsets at or after off.
+func (t *timeIndex) Truncate(off uint32) error {
+	i := sort.Search(len(t.entries), func(i int) bool {
+		return t.entries[i].off >= off
+	})
+	if i == len(t.entries) {
+		return nil
+	}
+	t.entries = t.entries[:i]
+	return t.file.Truncate(int64(uint64(i) * timeEntWidth))
+}
+
+// Sync commits the index file to stable storage.
+func (t *timeIndex) Sync() error {
+	return t.file.Sync()
+}
+
+// Close closes the index file.
+func (t *timeIndex) Close() error {
+	return t.file.Close()
+}
+
+// Name returns the index's file path.
+func (t *timeIndex) Name() string {
+	return t.file.Name()
+}
@@ -0,0 +1,68 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeIndex(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "time_index_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	idx, err := newTimeIndex(f)
+	require.NoError(t, err)
+	require.Equal(t, f.Name(), idx.Name())
+
+	_, ok := idx.Lookup(10)
+	require.False(t, ok)
+	_, ok = idx.Last()
+	require.False(t, ok)
+
+	entries := []timeEntry{
+		{off: 0, ts: 10},
+		{off: 5, ts: 20},
+		{off: 9, ts: 30},
+	}
+	for _, ent := range entries {
+		require.NoError(t, idx.Write(ent.off, ent.ts))
+	}
+	for _, tt := range []struct {
+		ts  int64
+		off uint32
+		ok  bool
+	}{
+		{ts: 5, ok: false},
+		{ts: 10, ok: false},
+		{ts: 11, off: 0, ok: true},
+		{ts: 25, off: 5, ok: true},
+		{ts: 31, off: 9, ok: true},
+	} {
+		off, ok := idx.Lookup(tt.ts)
+		require.Equal(t, tt.ok, ok, tt.ts)
+		require.Equal(t, tt.off, off, tt.ts)
+	}
+	require.NoError(t, idx.Close())
+
+	// a torn entry at the end of the file is dropped when reopening
+	f, err = os.OpenFile(f.Name(), os.O_RDWR|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 1})
+	require.NoError(t, err)
+	_, err = f.Seek(0, 0)
+	require.NoError(t, err)
+	idx, err = newTimeIndex(f)
+	require.NoError(t, err)
+	require.Equal(t, entries, idx.entries)
+	fi, err := f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(len(entries))*int64(timeEntWidth), fi.Size())
+
+	require.NoError(t, idx.Truncate(5))
+	last, ok := idx.Last()
+	require.True(t, ok)
+	require.Equal(t, entries[0], last)
+	require.NoError(t, idx.Close())
+}
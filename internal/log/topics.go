@@ -0,0 +1,509 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/dikaeinstein/proglog/api/v1"
+)
+
+// topicsDir is the directory the logs of named topics are kept in.
+const topicsDir = "topics"
+
+// snapshotTopicMagic starts the header written in front of a named topic's
+// records in snapshots, see Topics.Reader.
+var snapshotTopicMagic = []byte("plogtop1")
+
+// Topics are named logs, each in a directory of its own unless the storage
+// engine keeps them in memory. The default topic, named "", always exists;
+// it's where records produced without a topic go.
+type Topics struct {
+	Dir    string
+	Config Config
+
+	mu   sync.RWMutex
+	logs map[string]Storage
+	// controller, if set, holds the topics of the first partition of a
+	// partitioned log, which decide what topics exist. The other
+	// partitions only create and delete topics through their own Raft
+	// groups, following the controller's, see PartitionedLog.followTopics,
+	// and read the topics they don't have yet as empty.
+	controller *Topics
+	// changed is closed, and replaced, whenever a topic is created or
+	// deleted to wake up the waits on topics read as empty.
+	changed chan struct{}
+
+	// indexes are the topics' transaction indexes and keys their key
+	// indexes, guarded by mu like logs.
+	indexes map[string]*transactionIndex
+	keys    map[string]*keyIndex
+	// transactions map the open transactions to when this node saw them
+	// begin, and are saved to the transactions file as they change.
+	// Producing in a transaction holds txmu's read lock, ending one its
+	// write lock. It's taken before mu.
+	txmu         sync.RWMutex
+	transactions map[string]time.Time
+}
+
+// NewTopics opens the topics in dir. The default topic's log is in dir/log
+// and the other topics' logs are in dir/topics/<topic>.
+func NewTopics(dir string, c Config) (*Topics, error) {
+	t := &Topics{
+		Dir:          dir,
+		Config:       c,
+		logs:         make(map[string]Storage),
+		indexes:      make(map[string]*transactionIndex),
+		keys:         make(map[string]*keyIndex),
+		transactions: make(map[string]time.Time),
+		changed:      make(chan struct{}),
+	}
+	if _, err := t.open(""); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(filepath.Join(dir, topicsDir))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		t.Close()
+		return nil, err
+	}
+	for _, file := range files {
+		if !file.IsDir() || !api.ValidTopic(file.Name()) {
+			continue
+		}
+		if _, err = t.open(file.Name()); err != nil {
+			t.Close()
+			return nil, err
+		}
+	}
+	// the transactions left open stay open, whether the logs have records
+	// of them or not
+	now := time.Now()
+	for _, x := range t.indexes {
+		for id := range x.open {
+			t.transactions[id] = now
+		}
+	}
+	if err = t.loadTransactions(); err != nil {
+		t.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// open opens the topic's log, creating it if needed. The caller must hold
+// the lock unless the topics are being set up.
+func (t *Topics) open(topic string) (Storage, error) {
+	dir := t.dir(topic)
+	c := t.Config
+	if c.Segment.ObjectStore != nil {
+		c.Segment.ObjectStore = &topicObjectStore{
+			ObjectStore: c.Segment.ObjectStore,
+			topic:       topic,
+		}
+	}
+	l, err := NewStorage(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	x, err := loadTransactionIndex(dir, l)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	t.logs[topic] = l
+	t.indexes[topic] = x
+	t.keys[topic] = newKeyIndex()
+	t.notifyChanged()
+	return l, nil
+}
+
+// notifyChanged wakes up the waits on topics read as empty. The caller must
+// hold the lock unless the topics are being set up.
+func (t *Topics) notifyChanged() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// changes returns a channel closed when a topic is next created or
+// deleted.
+func (t *Topics) changes() <-chan struct{} {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.changed
+}
+
+// dir returns the directory of the topic's log.
+func (t *Topics) dir(topic string) string {
+	if topic == "" {
+		return filepath.Join(t.Dir, "log")
+	}
+	return filepath.Join(t.Dir, topicsDir, topic)
+}
+
+// Topic returns the topic's log.
+func (t *Topics) Topic(topic string) (Storage, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	l, ok := t.logs[topic]
+	if !ok {
+		return nil, api.ErrTopicNotFound{Topic: topic}
+	}
+	return l, nil
+}
+
+// lookup returns the topic's log and transaction index to read from. A
+// partition's topics the controller has but the partition doesn't yet read
+// as an empty log, and changed is then closed when a topic is next created
+// or deleted. It's nil otherwise.
+func (t *Topics) lookup(topic string) (
+	l Storage,
+	x *transactionIndex,
+	changed <-chan struct{},
+	err error,
+) {
+	t.mu.RLock()
+	l, ok := t.logs[topic]
+	x, changed = t.indexes[topic], t.changed
+	t.mu.RUnlock()
+	if ok {
+		return l, x, nil, nil
+	}
+	if t.controller == nil {
+		return nil, nil, nil, api.ErrTopicNotFound{Topic: topic}
+	}
+	if _, err = t.controller.Topic(topic); err != nil {
+		return nil, nil, nil, err
+	}
+	return NewMemoryLog(t.Config), newTransactionIndex(), changed, nil
+}
+
+// CreateTopic creates the topic with an empty log.
+func (t *Topics) CreateTopic(topic string) error {
+	if !api.ValidTopic(topic) {
+		return api.ErrInvalidTopic{Topic: topic}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.logs[topic]; ok {
+		return api.ErrTopicExists{Topic: topic}
+	}
+	_, err := t.open(topic)
+	return err
+}
+
+// DeleteTopic removes the topic's log, including the segments offloaded to
+// the object store. The default topic can't be deleted.
+func (t *Topics) DeleteTopic(topic string) error {
+	if topic == "" {
+		return api.ErrInvalidTopic{Topic: topic}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := t.logs[topic]
+	if !ok {
+		return api.ErrTopicNotFound{Topic: topic}
+	}
+	delete(t.logs, topic)
+	delete(t.indexes, topic)
+	delete(t.keys, topic)
+	t.notifyChanged()
+	return l.Delete()
+}
+
+// ListTopics returns the names of the topics, sorted, the default topic
+// excluded.
+func (t *Topics) ListTopics() ([]string, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	topics := make([]string, 0, len(t.logs)-1)
+	for topic := range t.logs {
+		if topic != "" {
+			topics = append(topics, topic)
+		}
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+func (t *Topics) Append(topic string, record *api.Record) (uint64, error) {
+	l, err := t.Topic(topic)
+	if err != nil {
+		return 0, err
+	}
+	off, err := l.Append(record)
+	if err != nil {
+		return 0, err
+	}
+	t.indexKeys(topic, off, []*api.Record{record})
+	return off, nil
+}
+
+func (t *Topics) AppendCompressed(
+	topic string,
+	records []*api.Record,
+	c api.Compression,
+) (first, last uint64, err error) {
+	l, err := t.Topic(topic)
+	if err != nil {
+		return 0, 0, err
+	}
+	if first, last, err = l.AppendCompressed(records, c); err != nil {
+		return 0, 0, err
+	}
+	t.indexKeys(topic, first, records)
+	return first, last, nil
+}
+
+// Produce appends the request's record, compressed if the request says
+// so, in the request's transaction if any. Producers and expected offsets
+// are ignored: only DistributedLog keeps retries of producers' requests
+// from being appended again and checks conditional appends, in the order
+// of Raft's log, see KeyOffset.
+func (t *Topics) Produce(req *api.ProduceRequest) (uint64, error) {
+	records := []*api.Record{req.Record}
+	first, _, err := t.produce(
+		req.Topic,
+		req.Transaction,
+		records,
+		func(l Storage) (first, last uint64, err error) {
+			if req.Compression != api.Compression_NONE {
+				return l.AppendCompressed(records, req.Compression)
+			}
+			first, err = l.Append(req.Record)
+			return first, first, err
+		},
+	)
+	return first, err
+}
+
+// ProduceBatch appends the request's records, see Produce.
+func (t *Topics) ProduceBatch(req *api.ProduceBatchRequest) (
+	first, last uint64,
+	err error,
+) {
+	return t.produce(
+		req.Topic,
+		req.Transaction,
+		req.Records,
+		func(l Storage) (first, last uint64, err error) {
+			return l.AppendCompressed(req.Records, req.Compression)
+		},
+	)
+}
+
+func (t *Topics) Read(topic string, off uint64) (*api.Record, error) {
+	l, _, _, err := t.lookup(topic)
+	if err != nil {
+		return nil, err
+	}
+	return l.Read(off)
+}
+
+func (t *Topics) ReadRaw(topic string, off uint64) (*api.Record, error) {
+	l, _, _, err := t.lookup(topic)
+	if err != nil {
+		return nil, err
+	}
+	return l.ReadRaw(off)
+}
+
+func (t *Topics) ReadRange(
+	topic string,
+	from uint64,
+	maxRecords int,
+	maxBytes uint64,
+) ([]*api.Record, error) {
+	l, _, _, err := t.lookup(topic)
+	if err != nil {
+		return nil, err
+	}
+	return l.ReadRange(from, maxRecords, maxBytes)
+}
+
+func (t *Topics) HighWatermark(topic string) (uint64, error) {
+	l, _, _, err := t.lookup(topic)
+	if err != nil {
+		return 0, err
+	}
+	return l.HighWatermark()
+}
+
+func (t *Topics) LowestOffset(topic string) (uint64, error) {
+	l, _, _, err := t.lookup(topic)
+	if err != nil {
+		return 0, err
+	}
+	return l.LowestOffset()
+}
+
+func (t *Topics) OffsetForTime(topic string, ts time.Time) (uint64, error) {
+	l, _, _, err := t.lookup(topic)
+	if err != nil {
+		return 0, err
+	}
+	return l.OffsetForTime(ts)
+}
+
+func (t *Topics) WaitForOffset(
+	ctx context.Context,
+	topic string,
+	off uint64,
+) error {
+	for {
+		l, _, changed, err := t.lookup(topic)
+		if err != nil {
+			return err
+		}
+		if changed == nil {
+			return l.WaitForOffset(ctx, off)
+		}
+		if err = waitChanged(ctx, changed); err != nil {
+			return err
+		}
+	}
+}
+
+// waitChanged blocks until the topics have changed, see Topics.lookup, or
+// ctx is done, in which case it returns ctx's error.
+func waitChanged(ctx context.Context, changed <-chan struct{}) error {
+	select {
+	case <-changed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Reader returns a reader of every topic's records, see Log.Reader. The
+// default topic's come first, then every other topic's preceded by a header
+// naming the topic.
+func (t *Topics) Reader() io.Reader {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	readers := []io.Reader{t.logs[""].Reader()}
+	var topics []string
+	for topic := range t.logs {
+		if topic != "" {
+			topics = append(topics, topic)
+		}
+	}
+	sort.Strings(topics)
+	for _, topic := range topics {
+		readers = append(
+			readers,
+			bytes.NewReader(namedHeader(snapshotTopicMagic, topic)),
+			t.logs[topic].Reader(),
+		)
+	}
+	return io.MultiReader(readers...)
+}
+
+// restore returns the topic's log emptied, creating the topic if needed.
+// The log starts at the given offset. The records restored to it must be
+// indexed with indexTransactions.
+func (t *Topics) restore(topic string, off uint64) (Storage, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := t.logs[topic]
+	if !ok {
+		var err error
+		if l, err = t.open(topic); err != nil {
+			return nil, err
+		}
+	}
+	// wake up the reads waiting on the replaced index
+	x := t.indexes[topic]
+	x.mu.Lock()
+	x.notifyEnded()
+	x.mu.Unlock()
+	t.indexes[topic] = newTransactionIndex()
+	t.keys[topic] = newKeyIndex()
+	return l, l.Reset(off)
+}
+
+// Close closes the topics' logs, checkpointing their transaction indexes
+// unless they're kept in memory.
+func (t *Topics) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for topic, l := range t.logs {
+		if t.Config.Engine != EngineMemory {
+			if err := t.checkpoint(topic, l); err != nil {
+				return err
+			}
+		}
+		if err := l.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkpoint checkpoints the topic's transaction index, see
+// transactionsCheckpoint.
+func (t *Topics) checkpoint(topic string, l Storage) error {
+	lowest, err := l.LowestOffset()
+	if err != nil {
+		return err
+	}
+	hw, err := l.HighWatermark()
+	if err != nil {
+		return err
+	}
+	return t.indexes[topic].checkpoint(t.dir(topic), lowest, hw)
+}
+
+// topicObjectStore keeps a topic's objects apart from the other topics' in
+// the object store they share. The default topic's objects are named as
+// they would be in an object store of its own.
+type topicObjectStore struct {
+	ObjectStore
+	topic string
+}
+
+func (o *topicObjectStore) name(name string) string {
+	if o.topic == "" {
+		return name
+	}
+	return topicsDir + "/" + o.topic + "/" + name
+}
+
+func (o *topicObjectStore) Put(name string, r io.Reader) error {
+	return o.ObjectStore.Put(o.name(name), r)
+}
+
+func (o *topicObjectStore) Get(name string) (io.ReadCloser, error) {
+	return o.ObjectStore.Get(o.name(name))
+}
+
+func (o *topicObjectStore) Delete(name string) error {
+	return o.ObjectStore.Delete(o.name(name))
+}
+
+// List returns the names of the topic's objects only.
+func (o *topicObjectStore) List() ([]string, error) {
+	names, err := o.ObjectStore.List()
+	if err != nil {
+		return nil, err
+	}
+	prefix := o.name("")
+	var topicNames []string
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		name = strings.TrimPrefix(name, prefix)
+		if !strings.Contains(name, "/") {
+			topicNames = append(topicNames, name)
+		}
+	}
+	return topicNames, nil
+}
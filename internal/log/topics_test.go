@@ -0,0 +1,235 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/dikaeinstein/proglog/api/v1"
+)
+
+func TestTopics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topics-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	objects, err := NewLocalObjectStore(filepath.Join(dir, "objects"))
+	require.NoError(t, err)
+
+	c := Config{}
+	c.Segment.ObjectStore = objects
+	topics, err := NewTopics(dir, c)
+	require.NoError(t, err)
+
+	require.NoError(t, topics.CreateTopic("orders"))
+	require.NoError(t, topics.CreateTopic("payments"))
+	require.IsType(t, api.ErrTopicExists{}, topics.CreateTopic("orders"))
+	require.IsType(t, api.ErrInvalidTopic{}, topics.CreateTopic("../log"))
+	require.IsType(t, api.ErrInvalidTopic{}, topics.CreateTopic(""))
+
+	// every topic has offsets of its own
+	for _, topic := range []string{"", "orders", "orders", "payments"} {
+		_, err = topics.Append(topic, &api.Record{Value: []byte(topic)})
+		require.NoError(t, err)
+	}
+	off, err := topics.Append("orders", &api.Record{Value: []byte("orders")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	record, err := topics.Read("payments", 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("payments"), record.Value)
+	_, err = topics.Append("refunds", &api.Record{})
+	require.IsType(t, api.ErrTopicNotFound{}, err)
+
+	// the objects of named topics are kept apart from the default topic's
+	o := &topicObjectStore{ObjectStore: objects, topic: "orders"}
+	require.NoError(t, o.Put("0.store", bytes.NewReader([]byte("x"))))
+	names, err := (&topicObjectStore{ObjectStore: objects}).List()
+	require.NoError(t, err)
+	require.Empty(t, names)
+	names, err = o.List()
+	require.NoError(t, err)
+	require.Equal(t, []string{"0.store"}, names)
+
+	require.NoError(t, topics.DeleteTopic("orders"))
+	require.IsType(t, api.ErrTopicNotFound{}, topics.DeleteTopic("orders"))
+	require.IsType(t, api.ErrInvalidTopic{}, topics.DeleteTopic(""))
+	names, err = o.List()
+	require.NoError(t, err)
+	require.Empty(t, names)
+	require.NoError(t, topics.Close())
+
+	topics, err = NewTopics(dir, c)
+	require.NoError(t, err)
+	defer topics.Close()
+	list, err := topics.ListTopics()
+	require.NoError(t, err)
+	require.Equal(t, []string{"payments"}, list)
+	off, err = topics.HighWatermark("")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
+
+func TestTopicsSnapshotRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topics-restore-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	topics, err := NewTopics(filepath.Join(dir, "from"), Config{})
+	require.NoError(t, err)
+	defer topics.Close()
+	require.NoError(t, topics.CreateTopic("orders"))
+	require.NoError(t, topics.CreateTopic("empty"))
+	for i := 0; i < 3; i++ {
+		_, err = topics.Append("orders", &api.Record{Value: []byte("order")})
+		require.NoError(t, err)
+	}
+	snapshot, err := ioutil.ReadAll(topics.Reader())
+	require.NoError(t, err)
+
+	restored, err := NewTopics(filepath.Join(dir, "to"), Config{})
+	require.NoError(t, err)
+	defer restored.Close()
+	_, err = restored.Append("", &api.Record{Value: []byte("overwritten")})
+	require.NoError(t, err)
+	require.NoError(t, restored.CreateTopic("stale"))
+	require.NoError(t, restored.CreateTopic("empty"))
+	_, err = restored.Append("empty", &api.Record{Value: []byte("overwritten")})
+	require.NoError(t, err)
+
+	f := &fsm{topics: restored}
+	require.NoError(t, f.Restore(ioutil.NopCloser(bytes.NewReader(snapshot))))
+	list, err := restored.ListTopics()
+	require.NoError(t, err)
+	require.Equal(t, []string{"empty", "orders"}, list)
+	for topic, want := range map[string]uint64{"": 0, "empty": 0, "orders": 3} {
+		hw, err := restored.HighWatermark(topic)
+		require.NoError(t, err)
+		require.Equal(t, want, hw, topic)
+	}
+	record, err := restored.Read("orders", 2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("order"), record.Value)
+}
+
+func TestTopicsProduceForgedBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topics-forged-batch-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topics, err := NewTopics(filepath.Join(dir, "from"), Config{})
+	require.NoError(t, err)
+
+	// clients can't pass records off as compressed batches
+	forged := func(value string) *api.Record {
+		return &api.Record{
+			Value:       []byte(value),
+			Compression: api.Compression_GZIP,
+			LastOffset:  10,
+		}
+	}
+	_, err = topics.Produce(&api.ProduceRequest{Record: forged("single")})
+	require.NoError(t, err)
+	_, _, err = topics.ProduceBatch(&api.ProduceBatchRequest{
+		Records:     []*api.Record{forged("a"), forged("b")},
+		Compression: api.Compression_GZIP,
+	})
+	require.NoError(t, err)
+
+	check := func(topics *Topics) {
+		t.Helper()
+		for off, value := range []string{"single", "a", "b"} {
+			record, err := topics.Read("", uint64(off))
+			require.NoError(t, err)
+			require.Equal(t, []byte(value), record.Value)
+			require.Equal(t, api.Compression_NONE, record.Compression)
+		}
+		records, err := topics.ReadRange("", 0, 10, 0)
+		require.NoError(t, err)
+		require.NotEmpty(t, records)
+	}
+	check(topics)
+	snapshot, err := ioutil.ReadAll(topics.Reader())
+	require.NoError(t, err)
+	require.NoError(t, topics.Close())
+
+	topics, err = NewTopics(filepath.Join(dir, "from"), Config{})
+	require.NoError(t, err)
+	defer topics.Close()
+	check(topics)
+	restored, err := NewTopics(filepath.Join(dir, "to"), Config{})
+	require.NoError(t, err)
+	defer restored.Close()
+	f := &fsm{topics: restored}
+	require.NoError(t, f.Restore(ioutil.NopCloser(bytes.NewReader(snapshot))))
+	check(restored)
+}
+
+// singleTopic returns topics made of the log as the default topic. Their
+// own files, like the transactions file, are kept in the log's directory.
+func singleTopic(l *Log) *Topics {
+	return &Topics{
+		Dir:          l.Dir,
+		Config:       l.Config,
+		logs:         map[string]Storage{"": l},
+		indexes:      map[string]*transactionIndex{"": newTransactionIndex()},
+		keys:         map[string]*keyIndex{"": newKeyIndex()},
+		transactions: make(map[string]time.Time),
+		changed:      make(chan struct{}),
+	}
+}
+
+func TestPartitionTopics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partition-topics-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	controller, err := NewTopics(filepath.Join(dir, "0"), Config{})
+	require.NoError(t, err)
+	defer controller.Close()
+	partition, err := NewTopics(filepath.Join(dir, "1"), Config{})
+	require.NoError(t, err)
+	defer partition.Close()
+	partition.controller = controller
+
+	// topics the controller has read as empty until the partition creates
+	// them, records can't be appended to them before
+	_, err = partition.HighWatermark("orders")
+	require.IsType(t, api.ErrTopicNotFound{}, err)
+	require.NoError(t, controller.CreateTopic("orders"))
+	hw, err := partition.HighWatermark("orders")
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), hw)
+	_, err = partition.Read("orders", 0)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	_, err = partition.Append("orders", &api.Record{})
+	require.IsType(t, api.ErrTopicNotFound{}, err)
+	list, err := partition.ListTopics()
+	require.NoError(t, err)
+	require.Empty(t, list)
+
+	// waits for records wake up once the partition has the topic
+	waited := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		waited <- partition.WaitForOffset(ctx, "orders", 0)
+	}()
+	require.NoError(t, partition.CreateTopic("orders"))
+	_, err = partition.Append("orders", &api.Record{})
+	require.NoError(t, err)
+	require.NoError(t, <-waited)
+
+	// deleting the controller's topic leaves the partition's to delete
+	require.NoError(t, controller.DeleteTopic("orders"))
+	list, err = partition.ListTopics()
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders"}, list)
+	require.NoError(t, partition.DeleteTopic("orders"))
+	_, err = partition.Read("orders", 0)
+	require.IsType(t, api.ErrTopicNotFound{}, err)
+}
@@ -0,0 +1,658 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/dikaeinstein/proglog/api/v1"
+)
+
+// snapshotTransactionMagic starts the header naming an open transaction in
+// snapshots, see Topics.transactionsReader.
+var snapshotTransactionMagic = []byte("plogtxn1")
+
+// transactionsCheckpoint is the file in a topic's log directory its
+// transaction index is checkpointed to when the topics are closed, so that
+// opening them again only reads the records appended since, see
+// loadTransactionIndex. It's removed once read: a log that wasn't closed
+// cleanly may have lost records the checkpoint has seen, and is read in
+// full.
+const transactionsCheckpoint = "transactions.checkpoint"
+
+// transactionsFile is the file in the topics' directory the open
+// transactions are written to whenever one begins or ends, a header naming
+// each like in snapshots. It keeps the transactions that were begun but
+// not produced in yet, which no log has records of, open once the topics
+// are opened again.
+const transactionsFile = "transactions"
+
+// The checkpoint starts with a header followed by the offset it was taken
+// at, then has a header per open transaction followed by the offset of its
+// first record, and one per aborted range followed by the range's offsets.
+var (
+	checkpointMagic        = []byte("plogtxc1")
+	checkpointOpenMagic    = []byte("plogtxo1")
+	checkpointAbortedMagic = []byte("plogtxa1")
+)
+
+// offsetRange is a range of offsets, first and last included.
+type offsetRange struct {
+	first, last uint64
+}
+
+// transactionIndex tracks the transactions a topic's records were produced
+// in, as read committed reads need them: the open transactions, which they
+// don't read past, and the aborted ones, whose records they skip. It's
+// built from the topic's records, markers included, so it can be rebuilt
+// from them.
+type transactionIndex struct {
+	mu sync.RWMutex
+	// open maps the open transactions to the offset of their first record
+	// in the topic, or the offset the topic was at when they first
+	// produced to it.
+	open map[string]uint64
+	// aborted maps the aborted transactions to the offsets of their records
+	// in the topic, from the first to the abort marker. There's a range
+	// per time a transaction with that name was aborted.
+	aborted map[string][]offsetRange
+	// ended is closed, and replaced, whenever a transaction ends to wake up
+	// waitForStableOffset.
+	ended chan struct{}
+}
+
+func newTransactionIndex() *transactionIndex {
+	return &transactionIndex{
+		open:    make(map[string]uint64),
+		aborted: make(map[string][]offsetRange),
+		ended:   make(chan struct{}),
+	}
+}
+
+// loadTransactionIndex returns the index of the transactions of the log in
+// dir, starting from its checkpoint if there's a usable one and reading the
+// records appended since. Otherwise it reads every record the log holds.
+func loadTransactionIndex(dir string, l Storage) (*transactionIndex, error) {
+	name := filepath.Join(dir, transactionsCheckpoint)
+	x, from, err := readTransactionsCheckpoint(name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err = os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	hw, err := l.HighWatermark()
+	if err != nil {
+		return nil, err
+	}
+	if x == nil || from > hw {
+		// the log lost records past the checkpoint
+		x, from = newTransactionIndex(), 0
+	}
+	return x, x.scan(l, from)
+}
+
+// scan indexes the log's records from offset off on.
+func (x *transactionIndex) scan(l Storage, off uint64) error {
+	lowest, err := l.LowestOffset()
+	if err != nil {
+		return err
+	}
+	if off < lowest {
+		off = lowest
+	}
+	hw, err := l.HighWatermark()
+	if err != nil {
+		return err
+	}
+	for off < hw {
+		stored, err := l.ReadRaw(off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			break
+		} else if err != nil {
+			return err
+		}
+		records, err := api.Decompress(stored)
+		if err != nil {
+			return err
+		}
+		x.observe(records...)
+		off = lastOffset(stored) + 1
+	}
+	return nil
+}
+
+// readTransactionsCheckpoint returns the index checkpointed to the file and
+// the offset it was taken at. The index is nil if the file isn't a
+// checkpoint, or a complete one.
+func readTransactionsCheckpoint(name string) (*transactionIndex, uint64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	b := make([]byte, 16)
+	_, ok, err := readNamedHeader(br, checkpointMagic)
+	if err != nil || !ok {
+		return nil, 0, nil
+	}
+	if _, err = io.ReadFull(br, b[0:8]); err != nil {
+		return nil, 0, nil
+	}
+	from := enc.Uint64(b)
+	x := newTransactionIndex()
+	for {
+		id, ok, err := readNamedHeader(br, checkpointOpenMagic)
+		if err != nil {
+			return nil, 0, nil
+		}
+		if ok {
+			if _, err = io.ReadFull(br, b[0:8]); err != nil {
+				return nil, 0, nil
+			}
+			x.open[id] = enc.Uint64(b)
+			continue
+		}
+		id, ok, err = readNamedHeader(br, checkpointAbortedMagic)
+		if err != nil {
+			return nil, 0, nil
+		}
+		if ok {
+			if _, err = io.ReadFull(br, b); err != nil {
+				return nil, 0, nil
+			}
+			x.aborted[id] = append(x.aborted[id], offsetRange{
+				first: enc.Uint64(b[0:8]),
+				last:  enc.Uint64(b[8:16]),
+			})
+			continue
+		}
+		if _, err = br.Peek(1); err == io.EOF {
+			return x, from, nil
+		}
+		return nil, 0, nil
+	}
+}
+
+// checkpoint writes the index of the log's records below offset hw to the
+// checkpoint file in dir. The index may have seen records past hw, which
+// are seen again when the log is opened. Aborted ranges below the log's
+// lowest offset are left out, their records are gone.
+func (x *transactionIndex) checkpoint(dir string, lowest, hw uint64) error {
+	x.mu.RLock()
+	var buf bytes.Buffer
+	b := make([]byte, 16)
+	buf.Write(namedHeader(checkpointMagic, ""))
+	enc.PutUint64(b, hw)
+	buf.Write(b[0:8])
+	for id, first := range x.open {
+		buf.Write(namedHeader(checkpointOpenMagic, id))
+		enc.PutUint64(b, first)
+		buf.Write(b[0:8])
+	}
+	for id, ranges := range x.aborted {
+		for _, r := range ranges {
+			if r.last < lowest {
+				continue
+			}
+			buf.Write(namedHeader(checkpointAbortedMagic, id))
+			enc.PutUint64(b[0:8], r.first)
+			enc.PutUint64(b[8:16], r.last)
+			buf.Write(b)
+		}
+	}
+	x.mu.RUnlock()
+
+	// the checkpoint is complete or not there at all
+	name := filepath.Join(dir, transactionsCheckpoint)
+	if err := ioutil.WriteFile(name+".tmp", buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// observe indexes the appended records, in offset order.
+func (x *transactionIndex) observe(records ...*api.Record) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, record := range records {
+		id := record.Transaction
+		if id == "" {
+			continue
+		}
+		first, open := x.open[id]
+		switch {
+		case record.Control == api.Control_CONTROL_NONE:
+			if !open {
+				x.open[id] = record.Offset
+			}
+		case open:
+			delete(x.open, id)
+			if record.Control == api.Control_CONTROL_ABORT {
+				x.aborted[id] = append(
+					x.aborted[id],
+					offsetRange{first: first, last: record.Offset},
+				)
+			}
+			x.notifyEnded()
+		}
+	}
+}
+
+// begin marks the transaction open from offset off on, unless it's open
+// already. Producing in a transaction marks it before appending its
+// records so that they're never read as committed.
+func (x *transactionIndex) begin(id string, off uint64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, ok := x.open[id]; !ok {
+		x.open[id] = off
+	}
+}
+
+func (x *transactionIndex) isOpen(id string) bool {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	_, ok := x.open[id]
+	return ok
+}
+
+// notifyEnded wakes up the callers of waitForStableOffset. It must be
+// called with the write lock held.
+func (x *transactionIndex) notifyEnded() {
+	close(x.ended)
+	x.ended = make(chan struct{})
+}
+
+// stableOffset returns the last stable offset of a topic at high watermark
+// hw: the offset of the first record of its oldest open transaction, or hw
+// if none is open. Read committed reads don't read past it.
+func (x *transactionIndex) stableOffset(hw uint64) uint64 {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	stable := hw
+	for _, first := range x.open {
+		if first < stable {
+			stable = first
+		}
+	}
+	return stable
+}
+
+// visible returns whether read committed reads get the record, which is
+// below the stable offset, or the compressed batch of records.
+func (x *transactionIndex) visible(record *api.Record) (bool, error) {
+	if record.Compression != api.Compression_NONE {
+		// a batch's records are produced together, in one transaction
+		records, err := api.Decompress(record)
+		if err != nil || len(records) == 0 {
+			return false, err
+		}
+		record = records[0]
+	}
+	if record.Control != api.Control_CONTROL_NONE {
+		return false, nil
+	}
+	if record.Transaction == "" {
+		return true, nil
+	}
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	for _, r := range x.aborted[record.Transaction] {
+		if r.first <= record.Offset && record.Offset <= r.last {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// waitForStableOffset blocks until the stable offset of the log's topic is
+// past offset off, or ctx is done, in which case it returns ctx's error.
+func (x *transactionIndex) waitForStableOffset(
+	ctx context.Context,
+	l Storage,
+	off uint64,
+) error {
+	for {
+		x.mu.RLock()
+		var stable uint64
+		var open bool
+		for _, first := range x.open {
+			if !open || first < stable {
+				stable = first
+			}
+			open = true
+		}
+		ended := x.ended
+		x.mu.RUnlock()
+		if !open {
+			// it's the high watermark
+			return l.WaitForOffset(ctx, off)
+		}
+		if off < stable {
+			return nil
+		}
+		select {
+		case <-ended:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// BeginTransaction opens the transaction, see api.BeginTransactionRequest.
+func (t *Topics) BeginTransaction(id string) error {
+	t.txmu.Lock()
+	defer t.txmu.Unlock()
+	if _, ok := t.transactions[id]; ok {
+		return api.ErrTransactionExists{Transaction: id}
+	}
+	t.transactions[id] = time.Now()
+	if err := t.saveTransactions(); err != nil {
+		delete(t.transactions, id)
+		return err
+	}
+	return nil
+}
+
+// CommitTransaction ends the transaction, appending a commit marker to
+// every topic it produced to.
+func (t *Topics) CommitTransaction(id string) error {
+	return t.endTransaction(&api.Record{
+		Transaction: id,
+		Control:     api.Control_CONTROL_COMMIT,
+	})
+}
+
+// AbortTransaction ends the transaction, appending an abort marker to every
+// topic it produced to.
+func (t *Topics) AbortTransaction(id string) error {
+	return t.endTransaction(&api.Record{
+		Transaction: id,
+		Control:     api.Control_CONTROL_ABORT,
+	})
+}
+
+// endTransaction ends the marker's transaction, appending a copy of the
+// marker to every topic the transaction produced to.
+func (t *Topics) endTransaction(marker *api.Record) error {
+	t.txmu.Lock()
+	defer t.txmu.Unlock()
+	id := marker.Transaction
+	if _, ok := t.transactions[id]; !ok {
+		return api.ErrTransactionNotFound{Transaction: id}
+	}
+	delete(t.transactions, id)
+	if err := t.saveTransactions(); err != nil {
+		return err
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	topics := make([]string, 0, len(t.indexes))
+	for topic, x := range t.indexes {
+		if x.isOpen(id) {
+			topics = append(topics, topic)
+		}
+	}
+	sort.Strings(topics)
+	for _, topic := range topics {
+		m := proto.Clone(marker).(*api.Record)
+		off, err := t.logs[topic].Append(m)
+		if err != nil {
+			return err
+		}
+		m.Offset = off
+		t.indexes[topic].observe(m)
+	}
+	return nil
+}
+
+// produce appends the records, produced in the transaction if it's set,
+// with appendTo.
+func (t *Topics) produce(
+	topic, transaction string,
+	records []*api.Record,
+	appendTo func(l Storage) (first, last uint64, err error),
+) (first, last uint64, err error) {
+	// clients don't get to forge transactions, their markers or compressed
+	// batches, only AppendCompressed makes those
+	for _, record := range records {
+		record.Transaction = transaction
+		record.Control = api.Control_CONTROL_NONE
+		record.Compression = api.Compression_NONE
+		record.LastOffset = 0
+	}
+	l, err := t.Topic(topic)
+	if err != nil {
+		return 0, 0, err
+	}
+	if transaction != "" {
+		t.txmu.RLock()
+		defer t.txmu.RUnlock()
+		if _, ok := t.transactions[transaction]; !ok {
+			return 0, 0, api.ErrTransactionNotFound{Transaction: transaction}
+		}
+		hw, err := l.HighWatermark()
+		if err != nil {
+			return 0, 0, err
+		}
+		t.index(topic).begin(transaction, hw)
+	}
+	if first, last, err = appendTo(l); err != nil {
+		return 0, 0, err
+	}
+	t.indexKeys(topic, first, records)
+	return first, last, nil
+}
+
+// index returns the topic's transaction index.
+func (t *Topics) index(topic string) *transactionIndex {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.indexes[topic]
+}
+
+// LastStableOffset returns the offset read committed reads of the topic
+// stop at, see transactionIndex.stableOffset.
+func (t *Topics) LastStableOffset(topic string) (uint64, error) {
+	l, x, _, err := t.lookup(topic)
+	if err != nil {
+		return 0, err
+	}
+	hw, err := l.HighWatermark()
+	if err != nil {
+		return 0, err
+	}
+	return x.stableOffset(hw), nil
+}
+
+// ReadCommitted is like Read, but skips the records of aborted transactions
+// and transactions' markers, and doesn't read past the last stable offset.
+// When there's nothing left to read before it the offset in the returned
+// ErrOffsetOutOfRange is the offset to read from next, past the skipped
+// records.
+func (t *Topics) ReadCommitted(topic string, off uint64) (*api.Record, error) {
+	return t.readCommitted(topic, off, Storage.Read)
+}
+
+// ReadRawCommitted is ReadCommitted for ReadRaw.
+func (t *Topics) ReadRawCommitted(topic string, off uint64) (
+	*api.Record,
+	error,
+) {
+	return t.readCommitted(topic, off, Storage.ReadRaw)
+}
+
+func (t *Topics) readCommitted(
+	topic string,
+	off uint64,
+	read func(l Storage, off uint64) (*api.Record, error),
+) (*api.Record, error) {
+	l, x, _, err := t.lookup(topic)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		hw, err := l.HighWatermark()
+		if err != nil {
+			return nil, err
+		}
+		stable := x.stableOffset(hw)
+		if off >= stable {
+			return nil, api.ErrOffsetOutOfRange{Offset: off}
+		}
+		record, err := read(l, off)
+		if err != nil {
+			return nil, err
+		}
+		if record.Offset >= stable {
+			return nil, api.ErrOffsetOutOfRange{Offset: off}
+		}
+		ok, err := x.visible(record)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return record, nil
+		}
+		off = lastOffset(record) + 1
+	}
+}
+
+// WaitForStableOffset blocks until the last stable offset of the topic is
+// past offset off, or ctx is done, in which case it returns ctx's error.
+func (t *Topics) WaitForStableOffset(
+	ctx context.Context,
+	topic string,
+	off uint64,
+) error {
+	for {
+		l, x, changed, err := t.lookup(topic)
+		if err != nil {
+			return err
+		}
+		if changed == nil {
+			return x.waitForStableOffset(ctx, l, off)
+		}
+		if err = waitChanged(ctx, changed); err != nil {
+			return err
+		}
+	}
+}
+
+// expiredTransactions returns the transactions that have been open for
+// longer than timeout, as far as this node has seen, sorted.
+func (t *Topics) expiredTransactions(timeout time.Duration) []string {
+	t.txmu.RLock()
+	defer t.txmu.RUnlock()
+	var ids []string
+	for id, begun := range t.transactions {
+		if time.Since(begun) > timeout {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// transactionsReader returns a reader of a header per open transaction,
+// naming it.
+func (t *Topics) transactionsReader() io.Reader {
+	t.txmu.RLock()
+	defer t.txmu.RUnlock()
+	return bytes.NewReader(t.transactionHeaders())
+}
+
+// transactionHeaders returns a header per open transaction, sorted. The
+// caller must hold txmu.
+func (t *Topics) transactionHeaders() []byte {
+	ids := make([]string, 0, len(t.transactions))
+	for id := range t.transactions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var buf bytes.Buffer
+	for _, id := range ids {
+		buf.Write(namedHeader(snapshotTransactionMagic, id))
+	}
+	return buf.Bytes()
+}
+
+// saveTransactions writes the open transactions to the transactions file,
+// unless the storage engine keeps nothing on disk. The caller must hold
+// txmu's write lock.
+func (t *Topics) saveTransactions() error {
+	if t.Config.Engine == EngineMemory {
+		return nil
+	}
+	// the file is complete or not there at all
+	name := filepath.Join(t.Dir, transactionsFile)
+	err := ioutil.WriteFile(name+".tmp", t.transactionHeaders(), 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// loadTransactions reads the open transactions back from the transactions
+// file, see saveTransactions.
+func (t *Topics) loadTransactions() error {
+	f, err := os.Open(filepath.Join(t.Dir, transactionsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	now := time.Now()
+	for {
+		id, ok, err := readNamedHeader(br, snapshotTransactionMagic)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		t.transactions[id] = now
+	}
+	if _, err = br.Peek(1); err != io.EOF {
+		return fmt.Errorf("%s: corrupt transactions file", f.Name())
+	}
+	return nil
+}
+
+// clearTransactions forgets the open transactions, before they're restored
+// from a snapshot with restoreTransaction.
+func (t *Topics) clearTransactions() error {
+	t.txmu.Lock()
+	defer t.txmu.Unlock()
+	t.transactions = make(map[string]time.Time)
+	return t.saveTransactions()
+}
+
+func (t *Topics) restoreTransaction(id string) error {
+	t.txmu.Lock()
+	defer t.txmu.Unlock()
+	t.transactions[id] = time.Now()
+	return t.saveTransactions()
+}
+
+// indexTransactions indexes the records restored to the topic, see
+// transactionIndex.observe.
+func (t *Topics) indexTransactions(topic string, records []*api.Record) {
+	t.index(topic).observe(records...)
+}
@@ -0,0 +1,304 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/dikaeinstein/proglog/api/v1"
+)
+
+func TestTransactions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transactions-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topics, err := NewTopics(dir, Config{})
+	require.NoError(t, err)
+	require.NoError(t, topics.CreateTopic("audit"))
+
+	produce := func(topic, transaction, value string) uint64 {
+		t.Helper()
+		off, err := topics.Produce(&api.ProduceRequest{
+			Record:      &api.Record{Value: []byte(value)},
+			Topic:       topic,
+			Transaction: transaction,
+		})
+		require.NoError(t, err)
+		return off
+	}
+	readCommitted := func(topic string, off uint64) []string {
+		t.Helper()
+		var values []string
+		for {
+			record, err := topics.ReadCommitted(topic, off)
+			if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+				return values
+			}
+			require.NoError(t, err)
+			values = append(values, string(record.Value))
+			off = record.Offset + 1
+		}
+	}
+
+	_, err = topics.Produce(&api.ProduceRequest{
+		Record:      &api.Record{},
+		Transaction: "order",
+	})
+	require.Equal(t, api.ErrTransactionNotFound{Transaction: "order"}, err)
+	require.NoError(t, topics.BeginTransaction("order"))
+	require.Equal(
+		t,
+		api.ErrTransactionExists{Transaction: "order"},
+		topics.BeginTransaction("order"),
+	)
+	produce("", "", "before")
+	produce("", "order", "order")
+	produce("audit", "order", "order audit")
+	produce("", "", "after")
+
+	// read committed reads stop at the open transaction's first record
+	require.Equal(t, []string{"before"}, readCommitted("", 0))
+	require.Empty(t, readCommitted("audit", 0))
+	stable, err := topics.LastStableOffset("")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), stable)
+	record, err := topics.Read("", 1)
+	require.NoError(t, err)
+	require.Equal(t, "order", record.Transaction)
+
+	require.NoError(t, topics.CommitTransaction("order"))
+	require.Equal(
+		t,
+		api.ErrTransactionNotFound{Transaction: "order"},
+		topics.CommitTransaction("order"),
+	)
+	require.Equal(t, []string{"before", "order", "after"}, readCommitted("", 0))
+	require.Equal(t, []string{"order audit"}, readCommitted("audit", 0))
+	marker, err := topics.Read("audit", 1)
+	require.NoError(t, err)
+	require.Equal(t, api.Control_CONTROL_COMMIT, marker.Control)
+	require.Equal(t, "order", marker.Transaction)
+
+	// aborted transactions' records are skipped, names can be reused
+	require.NoError(t, topics.BeginTransaction("order"))
+	off := produce("", "order", "aborted")
+	first, last, err := topics.ProduceBatch(&api.ProduceBatchRequest{
+		Records:     []*api.Record{{Value: []byte("a")}, {Value: []byte("b")}},
+		Compression: api.Compression_GZIP,
+		Transaction: "order",
+	})
+	require.NoError(t, err)
+	require.Equal(t, off+1, first)
+	require.NoError(t, topics.AbortTransaction("order"))
+	produce("", "", "last")
+	require.Equal(t, []string{"last"}, readCommitted("", off))
+	record, err = topics.ReadRawCommitted("", first)
+	require.NoError(t, err)
+	require.Equal(t, last+2, record.Offset)
+	require.Equal(t, []byte("last"), record.Value)
+
+	// clients can't forge markers
+	forged, err := topics.Produce(&api.ProduceRequest{Record: &api.Record{
+		Value:       []byte("forged"),
+		Transaction: "order",
+		Control:     api.Control_CONTROL_ABORT,
+	}})
+	require.NoError(t, err)
+	record, err = topics.ReadCommitted("", forged)
+	require.NoError(t, err)
+	require.Equal(t, api.Control_CONTROL_NONE, record.Control)
+	require.Empty(t, record.Transaction)
+
+	// the transactions are rebuilt from the records
+	require.NoError(t, topics.BeginTransaction("open"))
+	produce("audit", "open", "open")
+	require.NoError(t, topics.Close())
+	topics, err = NewTopics(dir, Config{})
+	require.NoError(t, err)
+	defer topics.Close()
+	require.Equal(t, []string{"order audit"}, readCommitted("audit", 0))
+	require.Equal(t, []string{"last", "forged"}, readCommitted("", off))
+	require.NoError(t, topics.CommitTransaction("open"))
+	require.Equal(t, []string{"order audit", "open"}, readCommitted("audit", 0))
+}
+
+func TestTransactionsSnapshotRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transactions-restore-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topics, err := NewTopics(filepath.Join(dir, "from"), Config{})
+	require.NoError(t, err)
+	defer topics.Close()
+
+	for _, id := range []string{"aborted", "open", "empty"} {
+		require.NoError(t, topics.BeginTransaction(id))
+	}
+	for _, id := range []string{"aborted", "open"} {
+		_, err = topics.Produce(&api.ProduceRequest{
+			Record:      &api.Record{Value: []byte(id)},
+			Transaction: id,
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, topics.AbortTransaction("aborted"))
+	f := &fsm{topics: topics}
+	snap, err := f.Snapshot()
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(snap.(*snapshot).reader)
+	require.NoError(t, err)
+
+	restored, err := NewTopics(filepath.Join(dir, "to"), Config{})
+	require.NoError(t, err)
+	defer restored.Close()
+	require.NoError(t, restored.BeginTransaction("stale"))
+	f = &fsm{topics: restored}
+	require.NoError(t, f.Restore(ioutil.NopCloser(bytes.NewReader(b))))
+	require.Equal(
+		t,
+		api.ErrTransactionNotFound{Transaction: "stale"},
+		restored.AbortTransaction("stale"),
+	)
+	_, err = restored.ReadCommitted("", 0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 1}, err)
+	require.NoError(t, restored.CommitTransaction("open"))
+	require.NoError(t, restored.CommitTransaction("empty"))
+	record, err := restored.ReadCommitted("", 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("open"), record.Value)
+	hw, err := restored.HighWatermark("")
+	require.NoError(t, err)
+	// the empty transaction produced nothing, it has no marker
+	require.Equal(t, uint64(4), hw)
+}
+
+func TestWaitForStableOffset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transactions-wait-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topics, err := NewTopics(dir, Config{})
+	require.NoError(t, err)
+	defer topics.Close()
+
+	require.NoError(t, topics.BeginTransaction("order"))
+	_, err = topics.Produce(&api.ProduceRequest{
+		Record:      &api.Record{Value: []byte("order")},
+		Transaction: "order",
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.Equal(
+		t,
+		context.DeadlineExceeded,
+		topics.WaitForStableOffset(ctx, "", 0),
+	)
+
+	done := make(chan error)
+	go func() {
+		done <- topics.WaitForStableOffset(context.Background(), "", 0)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, topics.CommitTransaction("order"))
+	select {
+	case err = <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("commit didn't wake up the wait")
+	}
+}
+
+func TestTransactionsCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transactions-checkpoint-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topics, err := NewTopics(dir, Config{})
+	require.NoError(t, err)
+
+	for _, id := range []string{"aborted", "open"} {
+		require.NoError(t, topics.BeginTransaction(id))
+		_, err = topics.Produce(&api.ProduceRequest{
+			Record:      &api.Record{Value: []byte(id)},
+			Transaction: id,
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, topics.AbortTransaction("aborted"))
+	require.NoError(t, topics.Close())
+
+	name := filepath.Join(dir, "log", transactionsCheckpoint)
+	x, from, err := readTransactionsCheckpoint(name)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), from)
+	require.Equal(t, map[string]uint64{"open": 1}, x.open)
+	require.Equal(
+		t,
+		map[string][]offsetRange{"aborted": {{first: 0, last: 2}}},
+		x.aborted,
+	)
+
+	// the checkpoint is read, and removed, when the topics are opened
+	ghost := newTransactionIndex()
+	ghost.open["ghost"] = 0
+	require.NoError(t, ghost.checkpoint(filepath.Join(dir, "log"), 0, 3))
+	topics, err = NewTopics(dir, Config{})
+	require.NoError(t, err)
+	_, err = os.Stat(name)
+	require.True(t, os.IsNotExist(err))
+	stable, err := topics.LastStableOffset("")
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), stable)
+	require.NoError(t, topics.AbortTransaction("ghost"))
+	require.NoError(t, topics.Close())
+
+	// a checkpoint past the log's end is stale, the log is read in full
+	ghost.open["ghost"] = 0
+	require.NoError(t, ghost.checkpoint(filepath.Join(dir, "log"), 0, 100))
+	topics, err = NewTopics(dir, Config{})
+	require.NoError(t, err)
+	defer topics.Close()
+	require.Equal(
+		t,
+		api.ErrTransactionNotFound{Transaction: "ghost"},
+		topics.AbortTransaction("ghost"),
+	)
+	require.NoError(t, topics.CommitTransaction("open"))
+	record, err := topics.ReadCommitted("", 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("open"), record.Value)
+}
+
+func TestTransactionsBegunReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transactions-begun-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topics, err := NewTopics(dir, Config{})
+	require.NoError(t, err)
+	for _, id := range []string{"begun", "ended"} {
+		require.NoError(t, topics.BeginTransaction(id))
+	}
+	require.NoError(t, topics.CommitTransaction("ended"))
+	require.NoError(t, topics.Close())
+
+	// no log has a record of the begun transaction, it stays open anyway
+	topics, err = NewTopics(dir, Config{})
+	require.NoError(t, err)
+	defer topics.Close()
+	_, err = topics.Produce(&api.ProduceRequest{
+		Record:      &api.Record{Value: []byte("begun")},
+		Transaction: "begun",
+	})
+	require.NoError(t, err)
+	require.NoError(t, topics.CommitTransaction("begun"))
+	require.Equal(
+		t,
+		api.ErrTransactionNotFound{Transaction: "ended"},
+		topics.CommitTransaction("ended"),
+	)
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DiskGuard rejects writes while the disk a directory is on fills up, so
+// that they fail up front rather than deep in the log once the disk is
+// full. Writes are rejected once the used share of the disk reaches the
+// high watermark and accepted again once it's below the low watermark.
+type DiskGuard struct {
+	Dir           string
+	HighWatermark float64
+	LowWatermark  float64
+
+	logger *zap.Logger
+	// usage returns the used share of the disk dir is on.
+	usage func(dir string) (float64, error)
+
+	mu        sync.Mutex
+	used      float64
+	exhausted bool
+	watchers  []func(allowed bool)
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewDiskGuard returns a guard for the disk dir is on. The watermarks are
+// shares of the disk, from 0 to 1, and the low watermark can't be above the
+// high one. The disk is checked right away, then every interval until the
+// guard is closed.
+func NewDiskGuard(
+	dir string,
+	highWatermark, lowWatermark float64,
+	interval time.Duration,
+) (*DiskGuard, error) {
+	return newDiskGuard(dir, highWatermark, lowWatermark, interval, diskUsage)
+}
+
+func newDiskGuard(
+	dir string,
+	highWatermark, lowWatermark float64,
+	interval time.Duration,
+	usage func(dir string) (float64, error),
+) (*DiskGuard, error) {
+	if highWatermark <= 0 || highWatermark > 1 ||
+		lowWatermark <= 0 || lowWatermark > highWatermark {
+		return nil, fmt.Errorf(
+			"disk watermarks: high %g, low %g, want 0 < low <= high <= 1",
+			highWatermark, lowWatermark,
+		)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("disk check interval: %s", interval)
+	}
+	g := &DiskGuard{
+		Dir:           dir,
+		HighWatermark: highWatermark,
+		LowWatermark:  lowWatermark,
+		logger:        zap.L().Named("disk_guard"),
+		usage:         usage,
+		done:          make(chan struct{}),
+	}
+	if err := g.check(); err != nil {
+		return nil, err
+	}
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-g.done:
+				return
+			case <-ticker.C:
+				if err := g.check(); err != nil {
+					g.logger.Error(
+						"failed to check disk usage",
+						zap.String("dir", g.Dir),
+						zap.Error(err),
+					)
+				}
+			}
+		}
+	}()
+	return g, nil
+}
+
+// diskUsage returns the used share of the disk dir is on, counting the
+// space reserved for root as used.
+func diskUsage(dir string) (float64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return 0, err
+	}
+	if fs.Blocks == 0 {
+		return 0, nil
+	}
+	return 1 - float64(fs.Bavail)/float64(fs.Blocks), nil
+}
+
+// check measures the disk usage and rejects or accepts writes from then on
+// if it crossed a watermark.
+func (g *DiskGuard) check() error {
+	used, err := g.usage(g.Dir)
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.used = used
+	exhausted := g.exhausted
+	switch {
+	case !exhausted && used >= g.HighWatermark:
+		exhausted = true
+	case exhausted && used < g.LowWatermark:
+		exhausted = false
+	}
+	if exhausted == g.exhausted {
+		return nil
+	}
+	g.exhausted = exhausted
+	if exhausted {
+		g.logger.Warn(
+			"disk usage above the high watermark, rejecting writes",
+			zap.String("dir", g.Dir),
+			zap.Float64("used", used),
+		)
+	} else {
+		g.logger.Info(
+			"disk usage below the low watermark, accepting writes",
+			zap.String("dir", g.Dir),
+			zap.Float64("used", used),
+		)
+	}
+	for _, fn := range g.watchers {
+		fn(!exhausted)
+	}
+	return nil
+}
+
+// AllowWrite returns an error with a ResourceExhausted status while writes
+// are rejected.
+func (g *DiskGuard) AllowWrite() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.exhausted {
+		return nil
+	}
+	return status.Errorf(
+		codes.ResourceExhausted,
+		"disk is %.1f%% used, writes are rejected until it's below %.1f%%",
+		g.used*100,
+		g.LowWatermark*100,
+	)
+}
+
+// Watch calls fn with whether writes are allowed now and whenever that
+// changes.
+func (g *DiskGuard) Watch(fn func(allowed bool)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.watchers = append(g.watchers, fn)
+	fn(!g.exhausted)
+}
+
+// Close stops checking the disk.
+func (g *DiskGuard) Close() error {
+	close(g.done)
+	g.wg.Wait()
+	return nil
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeDisk reports the disk usage it's set to.
+type fakeDisk struct {
+	mu   sync.Mutex
+	used float64
+}
+
+func (d *fakeDisk) set(used float64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.used = used
+}
+
+func (d *fakeDisk) usage(string) (float64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.used, nil
+}
+
+func TestDiskGuard(t *testing.T) {
+	disk := &fakeDisk{used: 0.5}
+	g, err := newDiskGuard("", 0.9, 0.8, time.Hour, disk.usage)
+	require.NoError(t, err)
+	defer g.Close()
+	var allowed []bool
+	g.Watch(func(a bool) {
+		allowed = append(allowed, a)
+	})
+	require.NoError(t, g.AllowWrite())
+
+	disk.set(0.95)
+	require.NoError(t, g.check())
+	require.Equal(t, codes.ResourceExhausted, status.Code(g.AllowWrite()))
+
+	// writes stay rejected between the watermarks
+	disk.set(0.85)
+	require.NoError(t, g.check())
+	require.Equal(t, codes.ResourceExhausted, status.Code(g.AllowWrite()))
+
+	disk.set(0.7)
+	require.NoError(t, g.check())
+	require.NoError(t, g.AllowWrite())
+
+	// and stay accepted between them
+	disk.set(0.85)
+	require.NoError(t, g.check())
+	require.NoError(t, g.AllowWrite())
+	require.Equal(t, []bool{true, false, true}, allowed)
+}
+
+func TestDiskGuardChecksInterval(t *testing.T) {
+	disk := &fakeDisk{used: 0.5}
+	g, err := newDiskGuard("", 0.9, 0.8, time.Millisecond, disk.usage)
+	require.NoError(t, err)
+	defer g.Close()
+	disk.set(0.95)
+	require.Eventually(t, func() bool {
+		return g.AllowWrite() != nil
+	}, time.Second, time.Millisecond)
+}
+
+func TestNewDiskGuard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk-guard-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	used, err := diskUsage(dir)
+	require.NoError(t, err)
+	require.True(t, used >= 0 && used <= 1, used)
+	_, err = diskUsage("/does/not/exist")
+	require.Error(t, err)
+
+	g, err := NewDiskGuard(dir, 1, 1, time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, g.Close())
+
+	for _, watermarks := range [][2]float64{{0, 0}, {0.9, 0.95}, {1.5, 0.9}} {
+		_, err = NewDiskGuard(dir, watermarks[0], watermarks[1], time.Hour)
+		require.Error(t, err, watermarks)
+	}
+	_, err = NewDiskGuard(dir, 0.9, 0.8, 0)
+	require.Error(t, err)
+}
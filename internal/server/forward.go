@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+
+	api "github.com/dikaeinstein/proglog/api/v1"
+)
+
+// forwardedMetadataKey marks the requests a follower forwarded to its
+// leader, so that they aren't forwarded again if the leadership moved in
+// the meantime. Its value is the subject of the client the follower got
+// the request from.
+const forwardedMetadataKey = "proglog-forwarded"
+
+// Forwarder connects followers to their leader to forward it the produce
+// requests they got, see PeerForwarder.
+type Forwarder interface {
+	// Client returns a client of the server at addr.
+	Client(addr string) (api.LogClient, error)
+}
+
+// PeerForwarder is a Forwarder that connects to leaders with the TLS config
+// servers use to connect to their peers, keeping a connection per leader
+// until it's closed. The leader authorizes the forwarded requests against
+// the subject of the client the follower got them from, which it trusts
+// the follower with: the peer config's identity must be allowed to
+// forward, and should be kept for the servers' use.
+type PeerForwarder struct {
+	opts []grpc.DialOption
+
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+// NewPeerForwarder returns a forwarder that connects to leaders with
+// tlsConfig, or without TLS if it's nil.
+func NewPeerForwarder(tlsConfig *tls.Config) *PeerForwarder {
+	opt := grpc.WithInsecure()
+	if tlsConfig != nil {
+		opt = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+	}
+	return &PeerForwarder{
+		opts:  []grpc.DialOption{opt},
+		conns: make(map[string]*grpc.ClientConn),
+	}
+}
+
+func (f *PeerForwarder) Client(addr string) (api.LogClient, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	conn, ok := f.conns[addr]
+	if !ok {
+		var err error
+		conn, err = grpc.Dial(addr, f.opts...)
+		if err != nil {
+			return nil, err
+		}
+		f.conns[addr] = conn
+	}
+	return api.NewLogClient(conn), nil
+}
+
+// Close closes the connections to the leaders.
+func (f *PeerForwarder) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var err error
+	for addr, conn := range f.conns {
+		if cerr := conn.Close(); err == nil {
+			err = cerr
+		}
+		delete(f.conns, addr)
+	}
+	return err
+}
+
+// leaderClient returns a client of the leader, and the context to call it
+// with, to forward it a produce request that failed with err on this
+// follower. It returns err as is when the request can't be forwarded:
+// forwarding is disabled, the leader is unknown or the request was
+// forwarded already.
+func (srv *grpcServer) leaderClient(ctx context.Context, err error) (
+	api.LogClient,
+	context.Context,
+	error,
+) {
+	notLeader, ok := err.(api.ErrNotLeader)
+	if !ok || srv.Forwarder == nil || notLeader.Leader == "" ||
+		forwarded(ctx) {
+		return nil, nil, err
+	}
+	client, cerr := srv.Forwarder.Client(notLeader.Leader)
+	if cerr != nil {
+		return nil, nil, cerr
+	}
+	ctx = metadata.AppendToOutgoingContext(
+		ctx,
+		forwardedMetadataKey,
+		subject(ctx),
+	)
+	return client, ctx, nil
+}
+
+func forwarded(ctx context.Context) bool {
+	_, ok := forwardedSubject(ctx)
+	return ok
+}
+
+// forwardedSubject returns the subject of the client a forwarded request is
+// from, and whether it was forwarded.
+func forwardedSubject(ctx context.Context) (string, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", false
+	}
+	values := md.Get(forwardedMetadataKey)
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
+
+// produceSubject returns the subject produce requests are authorized
+// against: the client's, which for a forwarded request is the subject the
+// follower forwarded it for, provided the follower is allowed to forward.
+func (srv *grpcServer) produceSubject(ctx context.Context) (string, error) {
+	forwardedFor, ok := forwardedSubject(ctx)
+	if !ok {
+		return subject(ctx), nil
+	}
+	err := srv.Authorizer.Authorize(subject(ctx), objectWildcard, forwardAction)
+	if err != nil {
+		return "", err
+	}
+	return forwardedFor, nil
+}
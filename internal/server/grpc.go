@@ -24,15 +24,45 @@ import (
 	api "github.com/dikaeinstein/proglog/api/v1"
 )
 
+// Records are authorized against their topic, and topics are created and
+// deleted by name. Listing topics and forwarding requests on behalf of
+// clients are authorized against objectWildcard.
 const (
 	objectWildcard = "*"
 	produceAction  = "produce"
 	consumeAction  = "consume"
+	createAction   = "create"
+	deleteAction   = "delete"
+	listAction     = "list"
+	forwardAction  = "forward"
 )
 
 type CommitLog interface {
-	Append(*api.Record) (uint64, error)
-	Read(offset uint64) (*api.Record, error)
+	Produce(req *api.ProduceRequest) (uint64, error)
+	ProduceBatch(req *api.ProduceBatchRequest) (first, last uint64, err error)
+	Read(topic string, offset uint64) (*api.Record, error)
+	ReadRaw(topic string, offset uint64) (*api.Record, error)
+	ReadRange(topic string, from uint64, maxRecords int, maxBytes uint64) ([]*api.Record, error)
+	HighWatermark(topic string) (uint64, error)
+	LowestOffset(topic string) (uint64, error)
+	OffsetForTime(topic string, t time.Time) (uint64, error)
+	CreateTopic(topic string) error
+	DeleteTopic(topic string) error
+	ListTopics() ([]string, error)
+	WaitForOffset(ctx context.Context, topic string, off uint64) error
+	BeginTransaction(id string) error
+	CommitTransaction(id string) error
+	AbortTransaction(id string) error
+	ReadCommitted(topic string, offset uint64) (*api.Record, error)
+	ReadRawCommitted(topic string, offset uint64) (*api.Record, error)
+	WaitForStableOffset(ctx context.Context, topic string, off uint64) error
+}
+
+// LeaderVerifier is implemented by the commit logs whose followers may lag
+// behind their leader, see log.DistributedLog.VerifyLeader. Reads from
+// commit logs that don't implement it are always linearizable.
+type LeaderVerifier interface {
+	VerifyLeader() error
 }
 
 type Authorizer interface {
@@ -43,15 +73,49 @@ type GetServerer interface {
 	GetServers() ([]*api.Server, error)
 }
 
+// WriteGuard rejects writes while the server can't take them, see
+// DiskGuard.
+type WriteGuard interface {
+	// AllowWrite returns an error while writes are rejected.
+	AllowWrite() error
+	// Watch calls fn with whether writes are allowed now and whenever that
+	// changes.
+	Watch(fn func(allowed bool))
+}
+
+// ProduceHealthService is the service health checks report as not serving
+// while the WriteGuard rejects produce requests. Consume requests are still
+// served then.
+const ProduceHealthService = "log.v1.Log.Produce"
+
 type Config struct {
 	CommitLog
+	// Partitions, if set, are the logs of the topics' partitions, in order.
+	// Topics are created, deleted and listed through the first. Otherwise
+	// CommitLog is the only partition.
+	Partitions []CommitLog
 	Authorizer
 	GetServerer
+	// ConsumeStreamMaxWait is the longest ConsumeStream waits for a record
+	// to be appended before checking the log again, say because retention
+	// removed the offset it waits for. Defaults to a second.
+	ConsumeStreamMaxWait time.Duration
+	// WriteGuard, if set, decides whether produce requests are accepted.
+	WriteGuard WriteGuard
+	// Forwarder, if set, forwards the produce requests that reach a
+	// follower to its leader and relays the leader's response. Otherwise
+	// they fail with api.ErrNotLeader, naming the leader.
+	Forwarder Forwarder
 }
 
+// defaultConsumeStreamMaxWait is the default ConsumeStreamMaxWait.
+const defaultConsumeStreamMaxWait = time.Second
+
 type grpcServer struct {
 	api.UnimplementedLogServer
 	*Config
+	partitions           []CommitLog
+	consumeStreamMaxWait time.Duration
 }
 
 func NewGRPCServer(config *Config, grpcOpts ...grpc.ServerOption) (*grpc.Server, error) {
@@ -89,6 +153,19 @@ func NewGRPCServer(config *Config, grpcOpts ...grpc.ServerOption) (*grpc.Server,
 	gsrv := grpc.NewServer(grpcOpts...)
 	hsrv := health.NewServer()
 	hsrv.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	hsrv.SetServingStatus(
+		ProduceHealthService,
+		healthpb.HealthCheckResponse_SERVING,
+	)
+	if config.WriteGuard != nil {
+		config.WriteGuard.Watch(func(allowed bool) {
+			st := healthpb.HealthCheckResponse_SERVING
+			if !allowed {
+				st = healthpb.HealthCheckResponse_NOT_SERVING
+			}
+			hsrv.SetServingStatus(ProduceHealthService, st)
+		})
+	}
 	healthpb.RegisterHealthServer(gsrv, hsrv)
 
 	srv, err := newgrpcServer(config)
@@ -103,31 +180,115 @@ func NewGRPCServer(config *Config, grpcOpts ...grpc.ServerOption) (*grpc.Server,
 
 func newgrpcServer(config *Config) (*grpcServer, error) {
 	srv := &grpcServer{
-		Config: config,
+		Config:     config,
+		partitions: config.Partitions,
+	}
+	if len(srv.partitions) == 0 {
+		srv.partitions = []CommitLog{config.CommitLog}
+	}
+	srv.consumeStreamMaxWait = config.ConsumeStreamMaxWait
+	if srv.consumeStreamMaxWait == 0 {
+		srv.consumeStreamMaxWait = defaultConsumeStreamMaxWait
 	}
 
 	return srv, nil
 }
 
 func (srv *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
-	if err := srv.Authorizer.Authorize(subject(ctx), objectWildcard, produceAction); err != nil {
+	sub, err := srv.produceSubject(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := srv.Authorizer.Authorize(sub, req.Topic, produceAction); err != nil {
+		return nil, err
+	}
+	if err := srv.allowWrite(); err != nil {
+		return nil, err
+	}
+
+	partition, log, err := srv.producePartition(req.Partition, req.Record.GetKey())
+	if err != nil {
+		return nil, err
+	}
+
+	offset, err := log.Produce(req)
+	if err != nil {
+		leader, ctx, err := srv.leaderClient(ctx, err)
+		if err != nil {
+			return nil, err
+		}
+		req.Partition = &partition
+		return leader.Produce(ctx, req)
+	}
+
+	return &api.ProduceResponse{Offset: offset, Partition: partition}, nil
+}
+
+func (srv *grpcServer) ProduceBatch(ctx context.Context, req *api.ProduceBatchRequest) (*api.ProduceBatchResponse, error) {
+	sub, err := srv.produceSubject(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := srv.Authorizer.Authorize(sub, req.Topic, produceAction); err != nil {
+		return nil, err
+	}
+	if len(req.Records) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "no records to produce")
+	}
+	if err := srv.allowWrite(); err != nil {
 		return nil, err
 	}
 
-	offset, err := srv.CommitLog.Append(req.Record)
+	partition, log, err := srv.producePartition(req.Partition, req.Records[0].GetKey())
 	if err != nil {
 		return nil, err
 	}
 
-	return &api.ProduceResponse{Offset: offset}, nil
+	first, last, err := log.ProduceBatch(req)
+	if err != nil {
+		leader, ctx, err := srv.leaderClient(ctx, err)
+		if err != nil {
+			return nil, err
+		}
+		req.Partition = &partition
+		return leader.ProduceBatch(ctx, req)
+	}
+
+	return &api.ProduceBatchResponse{
+		FirstOffset: first,
+		LastOffset:  last,
+		Partition:   partition,
+	}, nil
 }
 
 func (srv *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
-	if err := srv.Authorizer.Authorize(subject(ctx), objectWildcard, consumeAction); err != nil {
+	if err := srv.Authorizer.Authorize(subject(ctx), req.Topic, consumeAction); err != nil {
 		return nil, err
 	}
 
-	record, err := srv.CommitLog.Read(req.Offset)
+	log, err := srv.partition(req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	if err = srv.consistent(ctx, log, req); err != nil {
+		return nil, err
+	}
+	offset, err := srv.offset(req)
+	if err != nil {
+		return nil, err
+	}
+
+	read := log.Read
+	if req.Compressed {
+		read = log.ReadRaw
+	}
+	if req.Isolation == api.Isolation_READ_COMMITTED {
+		read = log.ReadCommitted
+		if req.Compressed {
+			read = log.ReadRawCommitted
+		}
+	}
+	record, err := read(req.Topic, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -135,6 +296,129 @@ func (srv *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*a
 	return &api.ConsumeResponse{Record: record}, nil
 }
 
+// defaultConsumeBatchBytes bounds the records returned by ConsumeBatch when
+// the request doesn't, well under gRPC's default max message size.
+const defaultConsumeBatchBytes = 1 << 20
+
+func (srv *grpcServer) ConsumeBatch(ctx context.Context, req *api.ConsumeBatchRequest) (*api.ConsumeBatchResponse, error) {
+	if err := srv.Authorizer.Authorize(subject(ctx), req.Topic, consumeAction); err != nil {
+		return nil, err
+	}
+
+	log, err := srv.partition(req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	maxBytes := req.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = defaultConsumeBatchBytes
+	}
+	records, err := log.ReadRange(req.Topic, req.Offset, int(req.MaxRecords), maxBytes)
+	_, outOfRange := err.(api.ErrOffsetOutOfRange)
+	if err != nil && !outOfRange {
+		return nil, err
+	}
+	hw, herr := log.HighWatermark(req.Topic)
+	if herr != nil {
+		return nil, herr
+	}
+	// consumers that caught up get no records rather than an error, offsets
+	// removed by retention are still out of range
+	if outOfRange && req.Offset < hw {
+		return nil, err
+	}
+
+	res := &api.ConsumeBatchResponse{
+		Records:       records,
+		NextOffset:    req.Offset,
+		HighWatermark: hw,
+	}
+	if len(records) > 0 {
+		res.NextOffset = records[len(records)-1].Offset + 1
+	}
+	return res, nil
+}
+
+// defaultMinOffsetMaxWait bounds how long consume requests with the min
+// offset consistency wait when their deadline doesn't.
+const defaultMinOffsetMaxWait = 10 * time.Second
+
+// consistent waits until the partition's log is as up to date as the
+// consume request requires, see api.Consistency.
+func (srv *grpcServer) consistent(
+	ctx context.Context,
+	log CommitLog,
+	req *api.ConsumeRequest,
+) error {
+	switch req.Consistency {
+	case api.Consistency_CONSISTENCY_LINEARIZABLE:
+		if v, ok := log.(LeaderVerifier); ok {
+			return v.VerifyLeader()
+		}
+	case api.Consistency_CONSISTENCY_MIN_OFFSET:
+		ctx, cancel := context.WithTimeout(ctx, defaultMinOffsetMaxWait)
+		defer cancel()
+		err := log.WaitForOffset(ctx, req.Topic, req.MinOffset)
+		if err == context.DeadlineExceeded {
+			return status.Errorf(
+				codes.DeadlineExceeded,
+				"no record at or past offset %d yet",
+				req.MinOffset,
+			)
+		}
+		return err
+	}
+	return nil
+}
+
+// offset returns the offset the consume request starts from.
+func (srv *grpcServer) offset(req *api.ConsumeRequest) (uint64, error) {
+	if req.StartTime == nil {
+		return req.Offset, nil
+	}
+	if err := req.StartTime.CheckValid(); err != nil {
+		return 0, status.Error(codes.InvalidArgument, err.Error())
+	}
+	log, err := srv.partition(req.Partition)
+	if err != nil {
+		return 0, err
+	}
+	return log.OffsetForTime(req.Topic, req.StartTime.AsTime())
+}
+
+// partition returns the log of the topics' partition.
+func (srv *grpcServer) partition(partition uint32) (CommitLog, error) {
+	if partition >= uint32(len(srv.partitions)) {
+		return nil, api.ErrPartitionOutOfRange{
+			Partition:  partition,
+			Partitions: uint32(len(srv.partitions)),
+		}
+	}
+	return srv.partitions[partition], nil
+}
+
+// producePartition returns the partition records are produced to: the one
+// requested, if any, or the one the key hashes to.
+func (srv *grpcServer) producePartition(requested *uint32, key []byte) (
+	uint32,
+	CommitLog,
+	error,
+) {
+	partition := api.Partition(key, uint32(len(srv.partitions)))
+	if requested != nil {
+		partition = *requested
+	}
+	log, err := srv.partition(partition)
+	return partition, log, err
+}
+
+func (srv *grpcServer) allowWrite() error {
+	if srv.WriteGuard == nil {
+		return nil
+	}
+	return srv.WriteGuard.AllowWrite()
+}
+
 func (srv *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 	for {
 		req, err := stream.Recv()
@@ -153,15 +437,73 @@ func (srv *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 }
 
 func (srv *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	if req.Consistency != api.Consistency_CONSISTENCY_DEFAULT {
+		if err := srv.Authorizer.Authorize(subject(stream.Context()), req.Topic, consumeAction); err != nil {
+			return err
+		}
+		log, err := srv.partition(req.Partition)
+		if err != nil {
+			return err
+		}
+		if err = srv.consistent(stream.Context(), log, req); err != nil {
+			return err
+		}
+		// the stream's later reads are from a log at least as up to date
+		req.Consistency = api.Consistency_CONSISTENCY_DEFAULT
+	}
+	if req.StartTime != nil {
+		if err := srv.Authorizer.Authorize(subject(stream.Context()), req.Topic, consumeAction); err != nil {
+			return err
+		}
+		offset, err := srv.offset(req)
+		if err != nil {
+			return err
+		}
+		req.Offset = offset
+		req.StartTime = nil
+	}
 	for {
 		select {
 		case <-stream.Context().Done():
 			return nil
 		default:
 			res, err := srv.Consume(stream.Context(), req)
-			switch err.(type) {
+			switch oerr := err.(type) {
 			case nil:
 			case api.ErrOffsetOutOfRange:
+				// read committed reads skip the records of aborted
+				// transactions, the offset is past them
+				if oerr.Offset > req.Offset {
+					req.Offset = oerr.Offset
+				}
+				// wait for offsets past the end of the log to be
+				// written, offsets removed by retention never will be
+				log, lerr := srv.partition(req.Partition)
+				if lerr != nil {
+					return lerr
+				}
+				lowest, lerr := log.LowestOffset(req.Topic)
+				if lerr != nil {
+					return lerr
+				}
+				if req.Offset < lowest {
+					return err
+				}
+				ctx, cancel := context.WithTimeout(
+					stream.Context(),
+					srv.consumeStreamMaxWait,
+				)
+				wait := log.WaitForOffset
+				if req.Isolation == api.Isolation_READ_COMMITTED {
+					wait = log.WaitForStableOffset
+				}
+				err = wait(ctx, req.Topic, req.Offset)
+				cancel()
+				if err != nil &&
+					err != context.DeadlineExceeded &&
+					err != context.Canceled {
+					return err
+				}
 				continue
 			default:
 				return err
@@ -169,11 +511,112 @@ func (srv *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_Con
 			if err = stream.Send(res); err != nil {
 				return err
 			}
-			req.Offset++
+			// the record may be past the requested offset if the log
+			// was compacted, and a compressed batch holds records up to
+			// its last offset
+			req.Offset = res.Record.Offset + 1
+			if res.Record.Compression != api.Compression_NONE {
+				req.Offset = res.Record.LastOffset + 1
+			}
 		}
 	}
 }
 
+func (srv *grpcServer) CreateTopic(ctx context.Context, req *api.CreateTopicRequest) (*api.CreateTopicResponse, error) {
+	if err := srv.Authorizer.Authorize(subject(ctx), req.Topic, createAction); err != nil {
+		return nil, err
+	}
+
+	if err := srv.partitions[0].CreateTopic(req.Topic); err != nil {
+		return nil, err
+	}
+
+	return &api.CreateTopicResponse{}, nil
+}
+
+func (srv *grpcServer) DeleteTopic(ctx context.Context, req *api.DeleteTopicRequest) (*api.DeleteTopicResponse, error) {
+	if err := srv.Authorizer.Authorize(subject(ctx), req.Topic, deleteAction); err != nil {
+		return nil, err
+	}
+
+	if err := srv.partitions[0].DeleteTopic(req.Topic); err != nil {
+		return nil, err
+	}
+
+	return &api.DeleteTopicResponse{}, nil
+}
+
+func (srv *grpcServer) ListTopics(ctx context.Context, req *api.ListTopicsRequest) (*api.ListTopicsResponse, error) {
+	if err := srv.Authorizer.Authorize(subject(ctx), objectWildcard, listAction); err != nil {
+		return nil, err
+	}
+
+	topics, err := srv.partitions[0].ListTopics()
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.ListTopicsResponse{Topics: topics}, nil
+}
+
+// BeginTransaction opens a transaction. Transactions produce to any topic,
+// beginning and ending them needs the permission to produce to every topic.
+func (srv *grpcServer) BeginTransaction(ctx context.Context, req *api.BeginTransactionRequest) (*api.BeginTransactionResponse, error) {
+	if err := srv.Authorizer.Authorize(subject(ctx), objectWildcard, produceAction); err != nil {
+		return nil, err
+	}
+	if req.Transaction == "" {
+		return nil, status.Error(codes.InvalidArgument, "no transaction to begin")
+	}
+	if err := srv.allowWrite(); err != nil {
+		return nil, err
+	}
+
+	log, err := srv.partition(req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	if err = log.BeginTransaction(req.Transaction); err != nil {
+		return nil, err
+	}
+
+	return &api.BeginTransactionResponse{}, nil
+}
+
+// CommitTransaction commits a transaction. Like AbortTransaction, it isn't
+// rejected while writes are, so that open transactions can end.
+func (srv *grpcServer) CommitTransaction(ctx context.Context, req *api.CommitTransactionRequest) (*api.CommitTransactionResponse, error) {
+	if err := srv.Authorizer.Authorize(subject(ctx), objectWildcard, produceAction); err != nil {
+		return nil, err
+	}
+
+	log, err := srv.partition(req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	if err = log.CommitTransaction(req.Transaction); err != nil {
+		return nil, err
+	}
+
+	return &api.CommitTransactionResponse{}, nil
+}
+
+func (srv *grpcServer) AbortTransaction(ctx context.Context, req *api.AbortTransactionRequest) (*api.AbortTransactionResponse, error) {
+	if err := srv.Authorizer.Authorize(subject(ctx), objectWildcard, produceAction); err != nil {
+		return nil, err
+	}
+
+	log, err := srv.partition(req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	if err = log.AbortTransaction(req.Transaction); err != nil {
+		return nil, err
+	}
+
+	return &api.AbortTransactionResponse{}, nil
+}
+
 func (s *grpcServer) GetServers(
 	ctx context.Context, req *api.GetServersRequest,
 ) (
@@ -183,7 +626,10 @@ func (s *grpcServer) GetServers(
 	if err != nil {
 		return nil, err
 	}
-	return &api.GetServersResponse{Servers: servers}, nil
+	return &api.GetServersResponse{
+		Servers:    servers,
+		Partitions: uint32(len(s.partitions)),
+	}, nil
 }
 
 func authenticate(ctx context.Context) (context.Context, error) {
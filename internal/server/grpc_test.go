@@ -6,16 +6,22 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
 	"go.opencensus.io/examples/exporter"
 	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	api "github.com/dikaeinstein/proglog/api/v1"
 	"github.com/dikaeinstein/proglog/internal/auth"
@@ -52,7 +58,14 @@ func TestServer(t *testing.T) {
 		"produce/consume a message to/from the log succeeeds": testProduceConsume,
 		"produce/consume stream succeeds":                     testProduceConsumeStream,
 		"consume past log boundary fails":                     testConsumePastBoundary,
+		"consume from a start time succeeds":                  testConsumeStartTime,
+		"produce/consume compressed batches succeeds":         testProduceConsumeCompressed,
+		"consume batch succeeds":                              testConsumeBatch,
 		"unauthorized fails":                                  testUnauthorized,
+		"produce/consume to/from topics succeeds":             testTopics,
+		"topics are authorized separately":                    testTopicAuthorization,
+		"read committed consume skips uncommitted records":    testReadCommitted,
+		"consume with a min offset waits for the record":      testConsumeMinOffset,
 	}
 
 	for scenario, fn := range scenarios {
@@ -124,7 +137,7 @@ func setupTest(t *testing.T, fn func(*Config)) (
 	dir, err := ioutil.TempDir("", "server-test")
 	require.NoError(t, err)
 
-	clog, err := log.New(dir, log.Config{})
+	clog, err := log.NewTopics(dir, log.Config{})
 	require.NoError(t, err)
 
 	authorizer := auth.New(config.ACLModelFile, config.ACLPolicyFile)
@@ -181,6 +194,11 @@ func testProduceConsume(
 	ctx := context.Background()
 	want := &api.Record{
 		Value: []byte("hello world"),
+		Key:   []byte("greeting"),
+		Headers: []*api.Header{
+			{Key: "content-type", Value: []byte("text/plain")},
+			{Key: "trace-id", Value: []byte("42")},
+		},
 	}
 	produce, err := client.Produce(
 		ctx,
@@ -197,6 +215,11 @@ func testProduceConsume(
 
 	require.Equal(t, want.Value, consume.Record.Value)
 	require.Equal(t, want.Offset, consume.Record.Offset)
+	require.Equal(t, want.Key, consume.Record.Key)
+	require.Equal(t, len(want.Headers), len(consume.Record.Headers))
+	for i, header := range want.Headers {
+		require.True(t, proto.Equal(header, consume.Record.Headers[i]))
+	}
 }
 
 func testConsumePastBoundary(
@@ -227,6 +250,140 @@ func testConsumePastBoundary(
 	}
 }
 
+func testConsumeBatch(
+	t *testing.T,
+	client api.LogClient,
+	_ api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+	_, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records: []*api.Record{
+			{Value: []byte("first")},
+			{Value: []byte("second")},
+			{Value: []byte("third")},
+		},
+	})
+	require.NoError(t, err)
+
+	res, err := client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{
+		Offset:     0,
+		MaxRecords: 2,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res.Records))
+	require.Equal(t, []byte("second"), res.Records[1].Value)
+	require.Equal(t, uint64(2), res.NextOffset)
+	require.Equal(t, uint64(3), res.HighWatermark)
+
+	res, err = client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{
+		Offset: res.NextOffset,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res.Records))
+	require.Equal(t, []byte("third"), res.Records[0].Value)
+	require.Equal(t, uint64(3), res.NextOffset)
+
+	// caught up
+	res, err = client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{
+		Offset: res.NextOffset,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 0, len(res.Records))
+	require.Equal(t, uint64(3), res.NextOffset)
+	require.Equal(t, uint64(3), res.HighWatermark)
+}
+
+func testConsumeStartTime(
+	t *testing.T,
+	client api.LogClient,
+	_ api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+	produce := func(value string) uint64 {
+		res, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value)},
+		})
+		require.NoError(t, err)
+		return res.Offset
+	}
+	produce("before")
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	want := produce("after")
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		StartTime: timestamppb.New(start),
+	})
+	require.NoError(t, err)
+	require.Equal(t, want, consume.Record.Offset)
+	require.Equal(t, []byte("after"), consume.Record.Value)
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+		StartTime: timestamppb.New(start),
+	})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, want, res.Record.Offset)
+}
+
+func testProduceConsumeCompressed(
+	t *testing.T,
+	client api.LogClient,
+	_ api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record:      &api.Record{Value: []byte(`{"first": true}`)},
+		Compression: api.Compression_GZIP,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.Offset)
+
+	batch, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records: []*api.Record{
+			{Value: []byte(`{"second": true}`)},
+			{Value: []byte(`{"third": true}`)},
+		},
+		Compression: api.Compression_FLATE,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), batch.FirstOffset)
+	require.Equal(t, uint64(2), batch.LastOffset)
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 2})
+	require.NoError(t, err)
+	require.Equal(t, []byte(`{"third": true}`), consume.Record.Value)
+	require.Equal(t, uint64(2), consume.Record.Offset)
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Offset:     0,
+		Compressed: true,
+	})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, api.Compression_GZIP, res.Record.Compression)
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, api.Compression_FLATE, res.Record.Compression)
+	require.Equal(t, uint64(1), res.Record.Offset)
+	require.Equal(t, uint64(2), res.Record.LastOffset)
+	records, err := api.Decompress(res.Record)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(records))
+	require.Equal(t, []byte(`{"second": true}`), records[0].Value)
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record:      &api.Record{Value: []byte("unknown")},
+		Compression: api.Compression(99),
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
 func testProduceConsumeStream(
 	t *testing.T,
 	client,
@@ -273,10 +430,9 @@ func testProduceConsumeStream(
 			res, err := stream.Recv()
 			require.NoError(t, err)
 
-			require.Equal(t, res.Record, &api.Record{
-				Value:  record.Value,
-				Offset: uint64(i),
-			})
+			require.Equal(t, record.Value, res.Record.Value)
+			require.Equal(t, uint64(i), res.Record.Offset)
+			require.NotNil(t, res.Record.Timestamp)
 		}
 	}
 }
@@ -315,3 +471,489 @@ func testUnauthorized(
 		t.Fatalf("got code: %d, want: %d", gotCode, wantCode)
 	}
 }
+
+func testReadCommitted(
+	t *testing.T,
+	client api.LogClient,
+	nobodyClient api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+	_, err := nobodyClient.BeginTransaction(ctx, &api.BeginTransactionRequest{
+		Transaction: "order",
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.BeginTransaction(ctx, &api.BeginTransactionRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.CommitTransaction(ctx, &api.CommitTransactionRequest{
+		Transaction: "order",
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	for _, id := range []string{"aborted", "order"} {
+		_, err = client.BeginTransaction(ctx, &api.BeginTransactionRequest{
+			Transaction: id,
+		})
+		require.NoError(t, err)
+		_, err = client.Produce(ctx, &api.ProduceRequest{
+			Record:      &api.Record{Value: []byte(id)},
+			Transaction: id,
+		})
+		require.NoError(t, err)
+	}
+	_, err = client.AbortTransaction(ctx, &api.AbortTransactionRequest{
+		Transaction: "aborted",
+	})
+	require.NoError(t, err)
+
+	req := &api.ConsumeRequest{Isolation: api.Isolation_READ_COMMITTED}
+	_, err = client.Consume(ctx, req)
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+	res, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.NoError(t, err)
+	require.Equal(t, []byte("order"), res.Record.Value)
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.ConsumeStream(streamCtx, req)
+	require.NoError(t, err)
+	_, err = client.CommitTransaction(ctx, &api.CommitTransactionRequest{
+		Transaction: "order",
+	})
+	require.NoError(t, err)
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("order"), res.Record.Value)
+	require.Equal(t, "order", res.Record.Transaction)
+	require.Equal(t, uint64(1), res.Record.Offset)
+}
+
+func testConsumeMinOffset(
+	t *testing.T,
+	client api.LogClient,
+	_ api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+	req := &api.ConsumeRequest{
+		Consistency: api.Consistency_CONSISTENCY_MIN_OFFSET,
+		MinOffset:   1,
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err := client.Consume(timeoutCtx, req)
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	var res *api.ConsumeResponse
+	done := make(chan error)
+	go func() {
+		var err error
+		res, err = client.Consume(ctx, req)
+		done <- err
+	}()
+	for _, value := range []string{"first", "second"} {
+		_, err = client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value)},
+		})
+		require.NoError(t, err)
+	}
+	select {
+	case err = <-done:
+		require.NoError(t, err)
+		require.Equal(t, []byte("first"), res.Record.Value)
+	case <-time.After(time.Second):
+		t.Fatal("consume didn't return once the record was appended")
+	}
+}
+
+func testTopics(
+	t *testing.T,
+	client api.LogClient,
+	_ api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+	for _, topic := range []string{"orders", "payments"} {
+		_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Topic: topic})
+		require.NoError(t, err)
+	}
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Topic: "orders"})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Topic: "a/b"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	list, err := client.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders", "payments"}, list.Topics)
+
+	// topics have offsets of their own
+	for _, topic := range []string{"", "orders", "orders"} {
+		_, err = client.Produce(ctx, &api.ProduceRequest{
+			Topic:  topic,
+			Record: &api.Record{Value: []byte(topic)},
+		})
+		require.NoError(t, err)
+	}
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Topic:  "orders",
+		Offset: 1,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("orders"), consume.Record.Value)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{
+		Topic:  "payments",
+		Offset: 0,
+	})
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+
+	_, err = client.DeleteTopic(ctx, &api.DeleteTopicRequest{Topic: "orders"})
+	require.NoError(t, err)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "orders"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Topic:  "orders",
+		Record: &api.Record{},
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func testTopicAuthorization(
+	t *testing.T,
+	rootClient,
+	nobodyClient api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+	_, err := nobodyClient.CreateTopic(ctx, &api.CreateTopicRequest{
+		Topic: "public",
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = rootClient.CreateTopic(ctx, &api.CreateTopicRequest{
+		Topic: "public",
+	})
+	require.NoError(t, err)
+	_, err = rootClient.Produce(ctx, &api.ProduceRequest{
+		Topic:  "public",
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+
+	// the policy lets nobody consume the public topic only
+	consume, err := nobodyClient.Consume(ctx, &api.ConsumeRequest{
+		Topic: "public",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), consume.Record.Value)
+	_, err = nobodyClient.Produce(ctx, &api.ProduceRequest{
+		Topic:  "public",
+		Record: &api.Record{},
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobodyClient.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobodyClient.DeleteTopic(ctx, &api.DeleteTopicRequest{
+		Topic: "public",
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestServerPartitions(t *testing.T) {
+	client, _, config, teardown := setupTest(t, func(config *Config) {
+		config.Partitions = []CommitLog{config.CommitLog}
+		for i := 0; i < 2; i++ {
+			dir, err := ioutil.TempDir("", "server-partition-test")
+			require.NoError(t, err)
+			clog, err := log.NewTopics(dir, log.Config{})
+			require.NoError(t, err)
+			config.Partitions = append(config.Partitions, clog)
+		}
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	key := []byte("customer-42")
+	want := api.Partition(key, 3)
+	for i := 0; i < 2; i++ {
+		produce, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("keyed"), Key: key},
+		})
+		require.NoError(t, err)
+		require.Equal(t, want, produce.Partition)
+		require.Equal(t, uint64(i), produce.Offset)
+	}
+	partition := (want + 1) % 3
+	batch, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records:   []*api.Record{{Value: []byte("explicit")}},
+		Partition: &partition,
+	})
+	require.NoError(t, err)
+	require.Equal(t, partition, batch.Partition)
+	require.Equal(t, uint64(0), batch.FirstOffset)
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Partition: want,
+		Offset:    1,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("keyed"), consume.Record.Value)
+	hw, err := config.Partitions[partition].HighWatermark("")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), hw)
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Partition: 3})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	partition = 3
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record:    &api.Record{},
+		Partition: &partition,
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// countingLog counts the reads of the log it wraps.
+type countingLog struct {
+	CommitLog
+	reads int64
+}
+
+func (l *countingLog) Read(topic string, off uint64) (*api.Record, error) {
+	atomic.AddInt64(&l.reads, 1)
+	return l.CommitLog.Read(topic, off)
+}
+
+func TestConsumeStreamWaitsForRecords(t *testing.T) {
+	var clog *countingLog
+	client, _, _, teardown := setupTest(t, func(config *Config) {
+		clog = &countingLog{CommitLog: config.CommitLog}
+		config.CommitLog = clog
+		config.ConsumeStreamMaxWait = 50 * time.Millisecond
+	})
+	defer teardown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{})
+	require.NoError(t, err)
+	time.Sleep(300 * time.Millisecond)
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("late")},
+	})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("late"), res.Record.Value)
+
+	// the stream read the log when a record was appended and every max
+	// wait, rather than in a busy loop
+	require.Less(t, atomic.LoadInt64(&clog.reads), int64(20))
+}
+
+func TestProduceRejectedWhileDiskIsFull(t *testing.T) {
+	disk := &fakeDisk{used: 0.95}
+	guard, err := newDiskGuard("", 0.9, 0.8, time.Hour, disk.usage)
+	require.NoError(t, err)
+	defer guard.Close()
+	client, _, cfg, teardown := setupTest(t, func(config *Config) {
+		config.WriteGuard = guard
+	})
+	defer teardown()
+
+	// health checks report produce requests aren't served
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	gsrv, err := NewGRPCServer(cfg)
+	require.NoError(t, err)
+	go gsrv.Serve(l)
+	defer gsrv.Stop()
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	health := healthpb.NewHealthClient(conn)
+	requireProduceHealth := func(want healthpb.HealthCheckResponse_ServingStatus) {
+		t.Helper()
+		res, err := health.Check(context.Background(), &healthpb.HealthCheckRequest{
+			Service: ProduceHealthService,
+		})
+		require.NoError(t, err)
+		require.Equal(t, want, res.Status)
+	}
+	requireProduceHealth(healthpb.HealthCheckResponse_NOT_SERVING)
+
+	ctx := context.Background()
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("rejected")},
+	})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records: []*api.Record{{Value: []byte("rejected")}},
+	})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	// reads are still served
+	_, err = client.Consume(ctx, &api.ConsumeRequest{})
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+
+	disk.set(0.7)
+	require.NoError(t, guard.check())
+	requireProduceHealth(healthpb.HealthCheckResponse_SERVING)
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("accepted")},
+	})
+	require.NoError(t, err)
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset: produce.Offset,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("accepted"), consume.Record.Value)
+}
+
+// followerLog is a commit log that never leads.
+type followerLog struct {
+	CommitLog
+}
+
+func (l *followerLog) VerifyLeader() error {
+	return api.ErrNotLeader{Leader: "leader:8400"}
+}
+
+func TestLinearizableConsume(t *testing.T) {
+	client, _, _, teardown := setupTest(t, func(config *Config) {
+		config.CommitLog = &followerLog{CommitLog: config.CommitLog}
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("first")},
+	})
+	require.NoError(t, err)
+	res, err := client.Consume(ctx, &api.ConsumeRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []byte("first"), res.Record.Value)
+
+	req := &api.ConsumeRequest{
+		Consistency: api.Consistency_CONSISTENCY_LINEARIZABLE,
+	}
+	_, err = client.Consume(ctx, req)
+	st := status.Convert(err)
+	require.Equal(t, codes.Unavailable, st.Code())
+	info := st.Details()[0].(*errdetails.ErrorInfo)
+	require.Equal(t, "leader:8400", info.Metadata["leader"])
+	stream, err := client.ConsumeStream(ctx, req)
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+// writeFollowerLog is a commit log whose writes fail as it doesn't lead.
+type writeFollowerLog struct {
+	CommitLog
+	leader string
+}
+
+func (l *writeFollowerLog) Produce(*api.ProduceRequest) (uint64, error) {
+	return 0, api.ErrNotLeader{Leader: l.leader}
+}
+
+func (l *writeFollowerLog) ProduceBatch(*api.ProduceBatchRequest) (
+	uint64,
+	uint64,
+	error,
+) {
+	return 0, 0, api.ErrNotLeader{Leader: l.leader}
+}
+
+// clientForwarder forwards to the clients by address.
+type clientForwarder map[string]api.LogClient
+
+func (f clientForwarder) Client(addr string) (api.LogClient, error) {
+	return f[addr], nil
+}
+
+func TestProduceForwarding(t *testing.T) {
+	leader, _, _, teardownLeader := setupTest(t, nil)
+	defer teardownLeader()
+	forwarder := clientForwarder{"leader:8400": leader}
+	follower, _, _, teardownFollower := setupTest(t, func(config *Config) {
+		config.CommitLog = &writeFollowerLog{
+			CommitLog: config.CommitLog,
+			leader:    "leader:8400",
+		}
+		config.Forwarder = forwarder
+	})
+	defer teardownFollower()
+	disabled, _, _, teardownDisabled := setupTest(t, func(config *Config) {
+		config.CommitLog = &writeFollowerLog{
+			CommitLog: config.CommitLog,
+			leader:    "leader:8400",
+		}
+	})
+	defer teardownDisabled()
+
+	ctx := context.Background()
+	produce, err := follower.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("forwarded")},
+	})
+	require.NoError(t, err)
+	batch, err := follower.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records: []*api.Record{{Value: []byte("a")}, {Value: []byte("b")}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, produce.Offset+1, batch.FirstOffset)
+	consume, err := leader.Consume(ctx, &api.ConsumeRequest{
+		Offset: produce.Offset,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("forwarded"), consume.Record.Value)
+
+	// forwarding disabled, the client gets the leader's address
+	_, err = disabled.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("rejected")},
+	})
+	st := status.Convert(err)
+	require.Equal(t, codes.Unavailable, st.Code())
+	info := st.Details()[0].(*errdetails.ErrorInfo)
+	require.Equal(t, "NOT_LEADER", info.Reason)
+	require.Equal(t, "leader:8400", info.Metadata["leader"])
+
+	// forwarded requests aren't forwarded again
+	forwarder["leader:8400"] = follower
+	_, err = follower.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("looped")},
+	})
+	st = status.Convert(err)
+	require.Equal(t, codes.Unavailable, st.Code())
+	info = st.Details()[0].(*errdetails.ErrorInfo)
+	require.Equal(t, "leader:8400", info.Metadata["leader"])
+}
+
+func TestForwardedProduceAuthorization(t *testing.T) {
+	rootClient, nobodyClient, _, teardown := setupTest(t, nil)
+	defer teardown()
+
+	forwardedFor := func(sub string) context.Context {
+		return metadata.AppendToOutgoingContext(
+			context.Background(),
+			forwardedMetadataKey,
+			sub,
+		)
+	}
+	produce := &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("forwarded")},
+	}
+
+	// the request is authorized as the client the follower got it from
+	_, err := rootClient.Produce(forwardedFor("nobody"), produce)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = rootClient.ProduceBatch(
+		forwardedFor("nobody"),
+		&api.ProduceBatchRequest{Records: []*api.Record{produce.Record}},
+	)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// only peers allowed to forward can forward on behalf of clients
+	_, err = nobodyClient.Produce(forwardedFor("root"), produce)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = rootClient.Produce(forwardedFor("root"), produce)
+	require.NoError(t, err)
+}